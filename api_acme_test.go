@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert returns a PEM certificate for host valid for the given duration,
+// signed by parent (self-signed when parent is nil).
+func testCert(t *testing.T, host string, valid time.Duration, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) ([]byte, *x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(valid),
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid, tmpl.KeyUsage = true, true, x509.KeyUsageCertSign|x509.KeyUsageDigitalSignature
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, _ := x509.ParseCertificate(der)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), crt, key
+}
+
+func TestCertRenewReason(t *testing.T) {
+	withScratchEtc(t)
+	_, ca, caKey := testCert(t, "Test CA", 10*365*24*time.Hour, nil, nil)
+	selfSigned, _, _ := testCert(t, "vpn.example.com", 365*24*time.Hour, nil, nil)
+	issued, _, _ := testCert(t, "vpn.example.com", 90*24*time.Hour, ca, caKey)
+	expiring, _, _ := testCert(t, "vpn.example.com", 10*24*time.Hour, ca, caKey)
+
+	for _, tc := range []struct {
+		name   string
+		cert   []byte
+		domain string
+		want   string
+	}{
+		{"fresh", issued, "vpn.example.com", ""},
+		{"self-signed", selfSigned, "vpn.example.com", "sertifikat self-signed"},
+		{"old domain", issued, "new.example.com", "sertifikat bukan untuk domain ini"},
+		{"no domain", issued, "", ""},
+		{"expiring", expiring, "vpn.example.com", "sertifikat akan expired"},
+	} {
+		if tc.domain != "" {
+			writeTestFile(t, DomainFile, tc.domain+"\n")
+		} else {
+			writeTestFile(t, DomainFile, "")
+		}
+		info, err := parseCertPair(tc.cert, nil)
+		if got := certRenewReason(info, err, getDomain(), 30); got != tc.want {
+			t.Errorf("%s: reason %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	if got := certRenewReason(CertInfo{}, fmt.Errorf("missing"), "vpn.example.com", 30); got != "sertifikat tidak bisa dibaca" {
+		t.Errorf("unreadable: reason %q", got)
+	}
+}
+
+// TestObtainCertificatePebble runs a full http-01 order against Pebble. It
+// is skipped unless PEBBLE_DIRECTORY is set. From the Pebble source tree:
+//
+//	pebble-challtestsrv -http01 "" -https01 "" -tlsalpn01 "" -doh ""
+//	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//
+// then run, with port 5002 free for the challenge server:
+//
+//	PEBBLE_DIRECTORY=https://localhost:14000/dir \
+//	PEBBLE_CA=<pebble>/test/certs/pebble.minica.pem \
+//	go test -run Pebble zivpn-api.go api_*_test.go
+func TestObtainCertificatePebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set")
+	}
+	withScratchEtc(t)
+
+	cfg := AcmeCfg{
+		Directory: directory,
+		CACert:    os.Getenv("PEBBLE_CA"),
+		Email:     "admin@zivpn.test",
+		Challenge: "http-01",
+		HTTPAddr:  ":5002",
+	}
+	for i, domain := range []string{"vpn.zivpn.test", "sg-1.zivpn.test"} {
+		var stages []string
+		certPEM, keyPEM, err := obtainCertificate(cfg, domain, func(_ int, stage string) { stages = append(stages, stage) })
+		if err != nil {
+			t.Fatalf("order %d for %s: %v", i, domain, err)
+		}
+		if got := strings.Join(stages, ","); got != "registering,validating,finalizing,downloading" {
+			t.Errorf("stages %s", got)
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("issued pair: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := leaf.VerifyHostname(domain); err != nil {
+			t.Errorf("issued certificate: %v", err)
+		}
+		if len(pair.Certificate) < 2 {
+			t.Errorf("%s: chain has %d certificates, want the intermediate too", domain, len(pair.Certificate))
+		}
+	}
+	// The second order reused the account key written by the first.
+	if _, err := os.Stat(filepath.Join(AcmeDir, "account.key")); err != nil {
+		t.Errorf("account key: %v", err)
+	}
+
+	// Without the Pebble root the directory is not trusted.
+	cfg.CACert = ""
+	if _, _, err := obtainCertificate(cfg, "vpn.zivpn.test", func(int, string) {}); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("untrusted directory: %v, want a certificate error", err)
+	}
+}
+
+func TestAcmeHTTPClientCACert(t *testing.T) {
+	dir := t.TempDir()
+	caPEM, _, _ := testCert(t, "Test CA", time.Hour, nil, nil)
+	good, bad := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "bad.pem")
+	writeTestFile(t, good, string(caPEM))
+	writeTestFile(t, bad, "not a certificate")
+
+	if c, err := acmeHTTPClient(""); err != nil || c.Transport != nil {
+		t.Errorf("no ca_cert: %v, transport %v", err, c.Transport)
+	}
+	if _, err := acmeHTTPClient(good); err != nil {
+		t.Errorf("valid ca_cert: %v", err)
+	}
+	for _, f := range []string{bad, filepath.Join(dir, "missing.pem")} {
+		if _, err := acmeHTTPClient(f); err == nil {
+			t.Errorf("%s accepted", filepath.Base(f))
+		}
+	}
+}
+
+func TestObtainCertificateNeedsOrderLocation(t *testing.T) {
+	withScratchEtc(t)
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(acmeDirectory{NewNonce: srv.URL + "/nonce", NewAccount: srv.URL + "/account", NewOrder: srv.URL + "/order"})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.Header().Set("Location", srv.URL+"/account/1")
+		w.WriteHeader(201)
+		io.WriteString(w, `{"status":"valid"}`)
+	})
+	// A broken server that creates the order but does not say where it is.
+	mux.HandleFunc("/order", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.WriteHeader(201)
+		io.WriteString(w, `{"status":"pending","authorizations":[],"finalize":"`+srv.URL+`/finalize"}`)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("client went on to %s %q", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := AcmeCfg{Directory: srv.URL + "/dir", Challenge: "http-01", HTTPAddr: "127.0.0.1:0"}
+	_, _, err := obtainCertificate(cfg, "vpn.zivpn.test", func(int, string) {})
+	if err == nil || !strings.Contains(err.Error(), "no Location header") {
+		t.Fatalf("order without Location: %v", err)
+	}
+}
+
+func TestDomainHandlerSavesAcmeBeforeArming(t *testing.T) {
+	dir := withScratchEtc(t)
+	t.Cleanup(func() { cron.remove("acme-renew") })
+	body := map[string]interface{}{"acme": map[string]interface{}{"enabled": true, "email": "admin@zivpn.test", "challenge": "http-01"}}
+
+	writeTestFile(t, filepath.Join(dir, "blocked"), "")
+	good := AcmeFile
+	AcmeFile = filepath.Join(dir, "blocked", "acme.json")
+	if code, _ := callJSON(t, domainHandler, "POST", "/api/domain", body); code != 500 {
+		t.Fatalf("unwritable acme.json: got %d, want 500", code)
+	}
+	if _, ok := cron.status("acme-renew"); ok {
+		t.Fatal("renewal armed although the ACME config was not saved")
+	}
+
+	AcmeFile = good
+	if code, res := callJSON(t, domainHandler, "POST", "/api/domain", body); code != 200 {
+		t.Fatalf("save: %d %s", code, res.Message)
+	}
+	if !loadAcmeCfg().Enabled {
+		t.Error("ACME config not saved")
+	}
+	if _, ok := cron.status("acme-renew"); !ok {
+		t.Error("renewal not armed")
+	}
+}
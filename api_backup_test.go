@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupEncryptionPassphrase(t *testing.T) {
+	withScratchEtc(t)
+
+	code, res := callJSON(t, backupEncryptionHandler, "GET", "/api/backup/encryption", nil)
+	if code != 200 {
+		t.Fatalf("GET: %d %s", code, res.Message)
+	}
+	if d, _ := res.Data.(map[string]interface{}); d["mode"] != "passphrase" || d["passphrase"] != "" {
+		t.Fatalf("fresh server: %v", res.Data)
+	}
+
+	for _, body := range []BackupEncRequest{{Passphrase: "short"}, {Mode: "rot13"}, {Mode: "age"}} {
+		if code, res := callJSON(t, backupEncryptionHandler, "POST", "/api/backup/encryption", body); code != 400 {
+			t.Errorf("%+v: got %d (%s), want 400", body, code, res.Message)
+		}
+	}
+	if _, err := os.Stat(BackupEncFile); !os.IsNotExist(err) {
+		t.Fatalf("rejected change wrote %s", BackupEncFile)
+	}
+
+	const pass = "old-server-passphrase"
+	if code, res := callJSON(t, backupEncryptionHandler, "POST", "/api/backup/encryption", BackupEncRequest{Passphrase: pass}); code != 200 {
+		t.Fatalf("set passphrase: %d %s", code, res.Message)
+	}
+	if got := readTestFile(t, BackupPassphraseFile); got != pass+"\n" {
+		t.Errorf("passphrase file = %q", got)
+	}
+	var saved BackupEncCfg
+	if err := json.Unmarshal([]byte(readTestFile(t, BackupEncFile)), &saved); err != nil || saved.Mode != "passphrase" || saved.PassphraseFile != BackupPassphraseFile {
+		t.Errorf("saved config %+v (%v)", saved, err)
+	}
+	if _, res := callJSON(t, backupEncryptionHandler, "GET", "/api/backup/encryption", nil); res.Data.(map[string]interface{})["passphrase"] != pass {
+		t.Errorf("GET after set: %v", res.Data)
+	}
+}
+
+func TestDecryptWithGivenPassphrase(t *testing.T) {
+	withScratchEtc(t)
+	dir := t.TempDir()
+	sealed, err := sealBackup([]byte("PK\x03\x04 archive"), []byte("passphrase-of-old-vps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "backup.zip.enc")
+	if err := ioutil.WriteFile(src, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh server has no passphrase file yet.
+	if _, err := decryptBackupFile(src, loadBackupEncCfg()); err == nil || !strings.Contains(err.Error(), "send the passphrase") {
+		t.Fatalf("no local passphrase: %v", err)
+	}
+	writeTestFile(t, BackupPassphraseFile, "passphrase-of-new-vps\n")
+	if _, err := decryptBackupFile(src, loadBackupEncCfg()); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("local passphrase: %v", err)
+	}
+
+	plain, err := decryptBackupFile(src, loadBackupEncCfg().withPassphrase(" passphrase-of-old-vps\n"))
+	if err != nil {
+		t.Fatalf("given passphrase: %v", err)
+	}
+	if got := readTestFile(t, plain); got != "PK\x03\x04 archive" {
+		t.Errorf("decrypted %q", got)
+	}
+}
+
+// withScratchBackups points backups, archives and jobs at temporary
+// directories and backs up only config.json and users.db.
+func withScratchBackups(t *testing.T) {
+	t.Helper()
+	withScratchEtc(t)
+	oldBackup, oldArchive, oldJobDir, oldJobs := BackupDir, ArchiveDir, JobDir, jobs
+	oldFiles, oldRequired := backupFiles, requiredBackupFiles
+	BackupDir = t.TempDir()
+	ArchiveDir = filepath.Join(BackupDir, "archives")
+	JobDir = t.TempDir()
+	jobs = &jobQueue{jobs: make(map[string]*Job)}
+	backupFiles = []string{ConfigFile, UserDB}
+	requiredBackupFiles = []string{ConfigFile}
+	t.Cleanup(func() {
+		BackupDir, ArchiveDir, JobDir, jobs = oldBackup, oldArchive, oldJobDir, oldJobs
+		backupFiles, requiredBackupFiles = oldFiles, oldRequired
+	})
+}
+
+func waitTestJob(t *testing.T, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if j, ok := jobs.get(id); ok && j.done() {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return Job{}
+}
+
+func TestBackupArchiveJob(t *testing.T) {
+	withScratchBackups(t)
+	writeTestFile(t, ConfigFile, configFixture)
+	writeTestFile(t, UserDB, "alice | 2030-01-01\nbob | 2030-01-01\n")
+
+	code, res := callJSON(t, backupArchiveHandler, "POST", "/api/backup/archive", nil)
+	if code != 202 {
+		t.Fatalf("POST: %d %s", code, res.Message)
+	}
+	id, _ := res.Data.(map[string]interface{})["job_id"].(string)
+	if j := waitTestJob(t, id); j.Status != JobSucceeded {
+		t.Fatalf("archive job %s: %s", j.Status, j.Error)
+	}
+
+	download := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		backupArchiveHandler(w, httptest.NewRequest("GET", "/api/backup/archive?job="+id, nil))
+		return w
+	}
+	w := download()
+	if w.Code != 200 {
+		t.Fatalf("GET: %d %s", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Body.String(), encMagic) || w.Header().Get("X-Backup-Users") != "2" {
+		t.Errorf("archive: users %q, %d bytes", w.Header().Get("X-Backup-Users"), w.Body.Len())
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), ".zip.enc") {
+		t.Errorf("Content-Disposition %q", w.Header().Get("Content-Disposition"))
+	}
+	if w := download(); w.Code != 410 {
+		t.Errorf("second GET: %d, want 410", w.Code)
+	}
+	if entries, _ := ioutil.ReadDir(BackupDir); len(entries) != 1 {
+		t.Errorf("%d entries left in BackupDir, want only archives/", len(entries))
+	}
+
+	for target, want := range map[string]int{"/api/backup/archive": 404, "/api/backup/archive?job=nope": 404} {
+		w := httptest.NewRecorder()
+		backupArchiveHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != want {
+			t.Errorf("%s: %d, want %d", target, w.Code, want)
+		}
+	}
+}
+
+func TestMergeRestoreKeepsSuspensions(t *testing.T) {
+	withScratchEtc(t)
+	var cur Config
+	cur.Auth.Mode = "passwords"
+	cur.Auth.Config = []string{"alice"}
+	b, _ := marshalConfig(cur)
+	writeTestFile(t, ConfigFile, string(b))
+	// bob is suspended here: in users.db but not in auth.config.
+	writeTestFile(t, UserDB, "alice|2030-01-01\nbob|2030-01-01\n")
+
+	backup := cur
+	backup.Auth.Config = []string{"alice", "bob", "erin"}
+	bb, _ := marshalConfig(backup)
+	files := map[string][]byte{
+		"config.json": bb,
+		"users.db":    []byte("alice|2030-01-01\nbob|2030-01-01\nerin|2030-01-01\n"),
+	}
+
+	for _, mode := range []string{"users", "full"} {
+		t.Run(mode, func(t *testing.T) {
+			out, err := selectRestoreFiles(files, RestoreRequest{Mode: mode, Strategy: "merge"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Config
+			if err := json.Unmarshal(out["config.json"], &got); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got.Auth.Config, ",") != "alice,erin" {
+				t.Fatalf("auth.config = %v, want [alice erin]", got.Auth.Config)
+			}
+		})
+	}
+}
+
+func TestRestoredPasswords(t *testing.T) {
+	d := UserDiff{
+		Added:   []UserChange{{Password: "erin"}},
+		Removed: []UserChange{{Password: "carol"}},
+		Changed: []UserChange{{Password: "bob"}},
+	}
+	if got := strings.Join(restoredPasswords(d), ","); got != "erin,bob" {
+		t.Fatalf("restoredPasswords = %q, want erin,bob", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCronDayOfWeek(t *testing.T) {
+	for expr, want := range map[string]uint64{
+		"0 0 * * *":   0x7f,
+		"0 0 * * 7":   1 << 0,
+		"0 0 * * 0":   1 << 0,
+		"0 0 * * 5-7": 1<<5 | 1<<6 | 1<<0,
+		"0 0 * * */7": 1 << 0,
+		"0 0 * * 1-5": 0x3e,
+		"0 0 * * 0,3": 1<<0 | 1<<3,
+		"@weekly":     1 << 0,
+	} {
+		s, err := parseCron(expr)
+		if err != nil {
+			t.Errorf("%q: %v", expr, err)
+			continue
+		}
+		if s.dow != want {
+			t.Errorf("%q: dow = %07b, want %07b", expr, s.dow, want)
+		}
+	}
+	for _, expr := range []string{"0 0 * * 8", "0 0 * * 17", "0 0 * * 6-5", "0 0 * * */0"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q: accepted", expr)
+		}
+	}
+}
+
+func TestCronNextSunday(t *testing.T) {
+	s, err := parseCron("30 2 * * 5-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2030-01-07 is a Monday; the next run is Friday 2030-01-11.
+	from := time.Date(2030, 1, 7, 12, 0, 0, 0, time.UTC)
+	want := []time.Time{
+		time.Date(2030, 1, 11, 2, 30, 0, 0, time.UTC),
+		time.Date(2030, 1, 12, 2, 30, 0, 0, time.UTC),
+		time.Date(2030, 1, 13, 2, 30, 0, 0, time.UTC),
+		time.Date(2030, 1, 18, 2, 30, 0, 0, time.UTC),
+	}
+	for _, w := range want {
+		from = s.next(from)
+		if !from.Equal(w) {
+			t.Fatalf("next = %s, want %s", from, w)
+		}
+	}
+}
+
+func TestToggleAutoBackupSavesBeforeArming(t *testing.T) {
+	dir := withScratchEtc(t)
+	t.Cleanup(func() { cron.remove("backup") })
+
+	// A file where the config's directory should be makes every save fail.
+	writeTestFile(t, filepath.Join(dir, "blocked"), "")
+	good := AutoBackupFile
+	AutoBackupFile = filepath.Join(dir, "blocked", "backup_auto.json")
+	if code, _ := callJSON(t, toggleAutoBackupHandler, "POST", "/api/backup/auto", nil); code != 500 {
+		t.Fatalf("toggle with an unwritable config: got %d, want 500", code)
+	}
+	if _, ok := cron.status("backup"); ok {
+		t.Fatal("backup job armed although its config was not saved")
+	}
+
+	AutoBackupFile = good
+	if code, res := callJSON(t, toggleAutoBackupHandler, "POST", "/api/backup/auto", nil); code != 200 {
+		t.Fatalf("toggle: %d %s", code, res.Message)
+	}
+	if !loadAutoBackupCfg().Enabled {
+		t.Error("enabled state not saved")
+	}
+	if _, ok := cron.status("backup"); !ok {
+		t.Error("backup job not armed")
+	}
+}
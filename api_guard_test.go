@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable time source for guard.now.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// withGuard swaps apiGuard and the API key for the duration of a test.
+func withGuard(t *testing.T, cfg SecurityCfg, key string) *fakeClock {
+	t.Helper()
+	oldGuard, oldKey := apiGuard, getAuthToken()
+	clock := &fakeClock{t: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	apiGuard = newGuard(cfg)
+	apiGuard.now = clock.now
+	setAuthToken(key)
+	t.Cleanup(func() {
+		apiGuard = oldGuard
+		setAuthToken(oldKey)
+	})
+	return clock
+}
+
+func guardedRequest(h http.HandlerFunc, ip, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/api/info", nil)
+	r.RemoteAddr = ip + ":40000"
+	if key != "" {
+		r.Header.Set("X-API-Key", key)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, 200, true, "OK", nil)
+}
+
+func TestGuardRateLimit(t *testing.T) {
+	clock := withGuard(t, SecurityCfg{RatePerSecond: 2, Burst: 3, MaxFailures: 5, LockoutSeconds: 60, MaxLockout: 600}, "secret")
+	h := authMiddleware(okHandler)
+
+	for i := 0; i < 3; i++ {
+		if w := guardedRequest(h, "203.0.113.1", "secret"); w.Code != 200 {
+			t.Fatalf("request %d within burst: got %d", i, w.Code)
+		}
+	}
+	w := guardedRequest(h, "203.0.113.1", "secret")
+	if w.Code != 429 {
+		t.Fatalf("request over burst: got %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After = %q, want 1", w.Header().Get("Retry-After"))
+	}
+
+	// Another client has its own bucket.
+	if w := guardedRequest(h, "203.0.113.2", "secret"); w.Code != 200 {
+		t.Fatalf("other client: got %d", w.Code)
+	}
+
+	// Two requests per second refill.
+	clock.advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if w := guardedRequest(h, "203.0.113.1", "secret"); w.Code != 200 {
+			t.Fatalf("request %d after refill: got %d", i, w.Code)
+		}
+	}
+	if w := guardedRequest(h, "203.0.113.1", "secret"); w.Code != 429 {
+		t.Fatalf("third request after refill: got %d, want 429", w.Code)
+	}
+	if apiGuard.stats.RateLimited != 2 {
+		t.Errorf("rate limited = %d, want 2", apiGuard.stats.RateLimited)
+	}
+}
+
+func TestGuardLockout(t *testing.T) {
+	clock := withGuard(t, SecurityCfg{RatePerSecond: 100, Burst: 100, MaxFailures: 3, LockoutSeconds: 60, MaxLockout: 100}, "secret")
+	h := authMiddleware(okHandler)
+	ip := "198.51.100.7"
+
+	lockOut := func() {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			if w := guardedRequest(h, ip, "wrong"); w.Code != 401 {
+				t.Fatalf("bad key %d: got %d, want 401", i, w.Code)
+			}
+		}
+	}
+
+	lockOut()
+	w := guardedRequest(h, ip, "secret")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("locked client: got %d Retry-After %q, want 429 / 60", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// The second lockout doubles but is capped at MaxLockout.
+	clock.advance(61 * time.Second)
+	lockOut()
+	if w := guardedRequest(h, ip, "secret"); w.Header().Get("Retry-After") != "100" {
+		t.Fatalf("second lockout Retry-After = %q, want 100", w.Header().Get("Retry-After"))
+	}
+
+	// A good key after the lockout resets the failure count.
+	clock.advance(101 * time.Second)
+	if w := guardedRequest(h, ip, "secret"); w.Code != 200 {
+		t.Fatalf("after lockout: got %d", w.Code)
+	}
+	for i := 0; i < 2; i++ {
+		guardedRequest(h, ip, "wrong")
+	}
+	if w := guardedRequest(h, ip, "secret"); w.Code != 200 {
+		t.Fatalf("failures below threshold locked the client: got %d", w.Code)
+	}
+}
+
+func TestGuardAllowlist(t *testing.T) {
+	withGuard(t, SecurityCfg{RatePerSecond: 100, Burst: 100, MaxFailures: 5, LockoutSeconds: 60, MaxLockout: 60, Allowlist: []string{"10.0.0.0/8", "192.0.2.5"}}, "")
+	h := authMiddleware(okHandler)
+
+	for ip, want := range map[string]int{
+		"10.1.2.3":    200,
+		"192.0.2.5":   200,
+		"192.0.2.6":   403,
+		"127.0.0.1":   200,
+		"203.0.113.9": 403,
+	} {
+		if w := guardedRequest(h, ip, ""); w.Code != want {
+			t.Errorf("%s: got %d, want %d", ip, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testLicenseIP = "198.51.100.10"
+
+// withLicense starts from an unchecked license, with no API key and a
+// fresh guard, and restores the global state afterwards.
+func withLicense(t *testing.T) string {
+	t.Helper()
+	dir := withScratchEtc(t)
+	withGuard(t, SecurityCfg{RatePerSecond: 1000, Burst: 1000, MaxFailures: 5, LockoutSeconds: 60, MaxLockout: 60}, "")
+	licenseMutex.Lock()
+	old := license
+	license = LicenseStatus{}
+	licenseMutex.Unlock()
+	t.Cleanup(func() {
+		licenseMutex.Lock()
+		license = old
+		licenseMutex.Unlock()
+	})
+	writeTestFile(t, ConfigFile, configFixture)
+	writeTestFile(t, UserDB, "alice | 2030-01-01\nbob | 2030-01-01\n")
+	return dir
+}
+
+func licenseDate(days int) string {
+	return time.Now().AddDate(0, 0, days).Format("2006-01-02")
+}
+
+func writeLicenseCfg(t *testing.T, cfg LicenseCfg) {
+	t.Helper()
+	b, _ := json.Marshal(cfg)
+	writeTestFile(t, LicenseFile, string(b))
+}
+
+func expectLicenseState(t *testing.T, want string) {
+	t.Helper()
+	if st := currentLicense(); st.State != want {
+		t.Fatalf("license state %q (%s), want %q", st.State, st.Error, want)
+	}
+}
+
+// expectLocked checks that no handler changes state while the license is
+// locked, whichever method is used.
+func expectLocked(t *testing.T) {
+	t.Helper()
+	db := readTestFile(t, UserDB)
+	for path, h := range map[string]http.HandlerFunc{
+		"/api/user/delete":    deleteUserHandler,
+		"/api/user/renew":     renewUserHandler,
+		"/api/backup":         handleBackupHandler,
+		"/api/backup/cleanup": cleanupOldBackupsHandler,
+		"/api/backup/auto":    toggleAutoBackupHandler,
+		"/api/nodes/sg-1/":    nodeProxyHandler,
+	} {
+		body := UserRequest{Password: "alice", Days: 30}
+		if code, res := callJSON(t, authMiddleware(h), "GET", path+"?password=alice", body); code != 405 && code != 403 {
+			t.Errorf("GET %s while locked: %d %s", path, code, res.Message)
+		}
+		if code, res := callJSON(t, authMiddleware(h), "POST", path, body); code != 403 {
+			t.Errorf("POST %s while locked: %d %s", path, code, res.Message)
+		}
+	}
+	if code, _ := callJSON(t, authMiddleware(nodeProxyHandler), "GET", "/api/nodes/sg-1/users", nil); code != 403 {
+		t.Errorf("GET through the node proxy while locked: %d, want 403", code)
+	}
+	if got := readTestFile(t, UserDB); got != db {
+		t.Errorf("users.db changed while locked:\n%s", got)
+	}
+}
+
+func TestLicenseLockWithLocalAllowlist(t *testing.T) {
+	dir := withLicense(t)
+	allow := filepath.Join(dir, "izin-list")
+	forged := filepath.Join(dir, "forged")
+	writeTestFile(t, allow, fmt.Sprintf("# vendor list\n%s %s\n", testLicenseIP, licenseDate(-10)))
+	writeTestFile(t, forged, fmt.Sprintf("%s %s\n203.0.113.7 %s\n", testLicenseIP, licenseDate(365), licenseDate(365)))
+	writeLicenseCfg(t, LicenseCfg{Source: allow, GraceDays: 3, IP: testLicenseIP})
+
+	if err := refreshLicense(); err != nil {
+		t.Fatal(err)
+	}
+	expectLicenseState(t, licenseExpired)
+	expectLocked(t)
+
+	cfgBefore := readTestFile(t, LicenseFile)
+	for name, req := range map[string]map[string]interface{}{
+		"disable":        {"source": "", "ip": testLicenseIP},
+		"forged file":    {"source": forged, "ip": testLicenseIP},
+		"other ip":       {"source": allow, "ip": "203.0.113.7"},
+		"detected ip":    {"source": allow},
+		"longer grace":   {"source": allow, "ip": testLicenseIP, "grace_days": 90},
+		"forged via GET": {"source": forged},
+	} {
+		method := "POST"
+		if name == "forged via GET" {
+			method = "GET"
+		}
+		callJSON(t, authMiddleware(licenseHandler), method, "/api/license", req)
+		if got := readTestFile(t, LicenseFile); got != cfgBefore {
+			t.Fatalf("%s: license.json changed while locked:\n%s", name, got)
+		}
+		expectLicenseState(t, licenseExpired)
+	}
+	if code, res := callJSON(t, authMiddleware(licenseHandler), "POST", "/api/license", map[string]interface{}{"source": "", "ip": testLicenseIP}); code != 403 {
+		t.Fatalf("disabling a locked license: %d %s, want 403", code, res.Message)
+	}
+
+	// Saving the same settings only re-checks.
+	if code, res := callJSON(t, authMiddleware(licenseHandler), "POST", "/api/license", map[string]interface{}{"source": allow, "ip": testLicenseIP, "grace_days": 2}); code != 200 {
+		t.Fatalf("unchanged source: %d %s", code, res.Message)
+	}
+	expectLicenseState(t, licenseExpired)
+
+	// Renewal by the vendor unlocks management again.
+	writeTestFile(t, allow, fmt.Sprintf("%s %s\n", testLicenseIP, licenseDate(30)))
+	if code, _ := callJSON(t, authMiddleware(licenseHandler), "GET", "/api/license?refresh=1", nil); code != 200 {
+		t.Fatalf("refresh: %d", code)
+	}
+	expectLicenseState(t, licenseActive)
+	if code, res := callJSON(t, authMiddleware(deleteUserHandler), "POST", "/api/user/delete", UserRequest{Password: "alice"}); code != 200 {
+		t.Fatalf("delete after renewal: %d %s", code, res.Message)
+	}
+}
+
+func TestLicenseLockWithHTTPSource(t *testing.T) {
+	dir := withLicense(t)
+	var mu sync.Mutex
+	list := "203.0.113.1 " + licenseDate(30) + "\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, list)
+	}))
+	defer srv.Close()
+	writeLicenseCfg(t, LicenseCfg{Source: srv.URL + "/izin", GraceDays: 3, IP: testLicenseIP})
+
+	if err := refreshLicense(); err != nil {
+		t.Fatal(err)
+	}
+	expectLicenseState(t, licenseUnauthorized)
+	expectLocked(t)
+
+	forged := filepath.Join(dir, "forged")
+	writeTestFile(t, forged, testLicenseIP+" "+licenseDate(365)+"\n")
+	if code, res := callJSON(t, authMiddleware(licenseHandler), "POST", "/api/license", map[string]interface{}{"source": forged, "ip": testLicenseIP}); code != 403 {
+		t.Fatalf("switching to a local file while unauthorized: %d %s, want 403", code, res.Message)
+	}
+	expectLicenseState(t, licenseUnauthorized)
+
+	mu.Lock()
+	list += testLicenseIP + " " + licenseDate(30) + "\n"
+	mu.Unlock()
+	if err := refreshLicense(); err != nil {
+		t.Fatal(err)
+	}
+	expectLicenseState(t, licenseActive)
+
+	// Once active the admin may change the source again.
+	if code, res := callJSON(t, authMiddleware(licenseHandler), "POST", "/api/license", map[string]interface{}{"source": forged, "ip": testLicenseIP}); code != 200 {
+		t.Fatalf("changing source while active: %d %s", code, res.Message)
+	}
+	if code, res := callJSON(t, authMiddleware(renewUserHandler), "POST", "/api/user/renew", UserRequest{Password: "bob", Days: 30}); code != 200 {
+		t.Fatalf("renew while active: %d %s", code, res.Message)
+	}
+}
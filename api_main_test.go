@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain runs the tests with an empty PATH, so handlers that restart
+// zivpn or touch the firewall never reach the host's tools.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "zivpn-test-bin")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("PATH", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// withScratchEtc points the config, user, sync, bot, obfs rotation, node,
+// license, backup encryption, auto backup, scheduler state and ACME files at
+// a temporary directory for the duration of a test and returns that directory.
+// Without a bot config, admin notifications are skipped.
+func withScratchEtc(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, p := range []*string{
+		&ConfigFile, &UserDB, &DomainFile, &SyncFile, &SyncStateFile, &SyncQueueFile,
+		&BotConfigFile, &ObfsRotationFile, &NodesFile, &LicenseFile, &LicenseStateFile, &IzinFile,
+		&BackupEncFile, &BackupPassphraseFile, &AutoBackupFile, &SchedulerStateFile, &AcmeFile, &AcmeDir,
+	} {
+		old := *p
+		*p = filepath.Join(dir, filepath.Base(old))
+		t.Cleanup(func() { *p = old })
+	}
+	return dir
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// callJSON sends payload to h and decodes the Response envelope.
+func callJSON(t *testing.T, h http.HandlerFunc, method, target string, payload interface{}) (int, Response) {
+	t.Helper()
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, target, &body)
+	r.RemoteAddr = "127.0.0.1:40000"
+	w := httptest.NewRecorder()
+	h(w, r)
+	var res Response
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s %s: bad JSON %q", method, target, w.Body.String())
+	}
+	return w.Code, res
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeNode is a stand-in ZiVPN API that only answers requests carrying
+// its own key and records what it was asked.
+type fakeNode struct {
+	key   string
+	users []string
+
+	mu      sync.Mutex
+	last    *http.Request
+	created []UserRequest
+}
+
+func (f *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = r
+	if r.Header.Get("X-API-Key") != f.key {
+		jsonResponse(w, 401, false, "Unauthorized", nil)
+		return
+	}
+	switch r.URL.Path {
+	case "/api/users":
+		var out []map[string]string
+		for _, u := range f.users {
+			out = append(out, map[string]string{"password": u, "expired": "2030-01-01", "status": "Active"})
+		}
+		jsonResponse(w, 200, true, "OK", out)
+	case "/api/user/create":
+		var req UserRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.created = append(f.created, req)
+		jsonResponse(w, 200, true, "User created", map[string]string{"password": req.Password})
+	default:
+		jsonResponse(w, 404, false, "Not found", nil)
+	}
+}
+
+func (f *fakeNode) createdPasswords() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for _, c := range f.created {
+		out = append(out, c.Password)
+	}
+	return out
+}
+
+// testCluster starts a stand-in for this server (reached through Port) and
+// one for node sg-1, and registers sg-1 plus "dead", whose server is gone.
+func testCluster(t *testing.T) (local, sg1 *fakeNode) {
+	t.Helper()
+	withScratchEtc(t)
+
+	local = &fakeNode{key: "local-key", users: []string{"alice", "bob"}}
+	sg1 = &fakeNode{key: "sg1-key", users: []string{"carol"}}
+	localSrv := httptest.NewServer(local)
+	sg1Srv := httptest.NewServer(sg1)
+	deadSrv := httptest.NewServer(http.NotFoundHandler())
+	deadSrv.Close()
+	t.Cleanup(localSrv.Close)
+	t.Cleanup(sg1Srv.Close)
+
+	u, _ := url.Parse(localSrv.URL)
+	oldPort, oldKey := Port, getAuthToken()
+	Port = ":" + u.Port()
+	setAuthToken(local.key)
+	t.Cleanup(func() {
+		Port = oldPort
+		setAuthToken(oldKey)
+	})
+
+	if err := saveNodes([]Node{
+		{Name: "sg-1", URL: sg1Srv.URL + "/api", Key: sg1.key},
+		{Name: "dead", URL: deadSrv.URL + "/api", Key: "dead-key"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return local, sg1
+}
+
+func TestNodeProxySwapsKey(t *testing.T) {
+	_, sg1 := testCluster(t)
+
+	r := httptest.NewRequest("GET", "/api/nodes/sg-1/users?page=2", nil)
+	r.Header.Set("X-API-Key", "local-key")
+	r.Header.Set("X-Forwarded-For", "203.0.113.50")
+	w := httptest.NewRecorder()
+	nodeProxyHandler(w, r)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "carol") {
+		t.Fatalf("proxied GET: %d %s", w.Code, w.Body.String())
+	}
+
+	sg1.mu.Lock()
+	last := sg1.last
+	sg1.mu.Unlock()
+	if got := last.Header.Get("X-API-Key"); got != "sg1-key" {
+		t.Errorf("node saw X-API-Key %q, want its own key", got)
+	}
+	if last.URL.Path != "/api/users" || last.URL.RawQuery != "page=2" {
+		t.Errorf("node saw %s?%s, want /api/users?page=2", last.URL.Path, last.URL.RawQuery)
+	}
+	if xff := last.Header.Get("X-Forwarded-For"); strings.Contains(xff, "203.0.113.50") {
+		t.Errorf("client X-Forwarded-For reached the node: %q", xff)
+	}
+
+	for path, want := range map[string]int{
+		"/api/nodes/ghost/users":  404,
+		"/api/nodes/local/users":  400,
+		"/api/nodes/sg-1/nodes":   400,
+		"/api/nodes/sg-1":         400,
+		"/api/nodes/dead/users":   502,
+		"/api/nodes/sg-1/nothing": 404,
+	} {
+		code, res := callJSON(t, nodeProxyHandler, "GET", path, nil)
+		if code != want {
+			t.Errorf("%s: got %d (%s), want %d", path, code, res.Message, want)
+		}
+		if want == 502 && !strings.Contains(res.Message, "dead unreachable") {
+			t.Errorf("%s: message %q does not name the node", path, res.Message)
+		}
+	}
+}
+
+func TestClusterUsersFanOut(t *testing.T) {
+	testCluster(t)
+
+	code, res := callJSON(t, clusterUsersHandler, "GET", "/api/cluster/users", nil)
+	if code != 200 {
+		t.Fatalf("cluster users: %d %s", code, res.Message)
+	}
+	var data struct {
+		Total int          `json:"total"`
+		Nodes []NodeResult `json:"nodes"`
+	}
+	b, _ := json.Marshal(res.Data)
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Total != 3 {
+		t.Errorf("total = %d, want 3", data.Total)
+	}
+	want := []struct {
+		node string
+		ok   bool
+	}{{LocalNode, true}, {"sg-1", true}, {"dead", false}}
+	if len(data.Nodes) != len(want) {
+		t.Fatalf("got %d node results, want %d: %+v", len(data.Nodes), len(want), data.Nodes)
+	}
+	for i, w := range want {
+		if nr := data.Nodes[i]; nr.Node != w.node || nr.Success != w.ok {
+			t.Errorf("result %d = %s/%v (%s), want %s/%v", i, nr.Node, nr.Success, nr.Message, w.node, w.ok)
+		}
+	}
+}
+
+func TestClusterCreateUser(t *testing.T) {
+	local, sg1 := testCluster(t)
+
+	code, res := callJSON(t, clusterCreateUserHandler, "POST", "/api/cluster/user/create",
+		ClusterUserRequest{Password: "dave", Days: 30, Nodes: []string{"sg-1", "ghost"}})
+	if code != 400 || !strings.Contains(res.Message, `unknown node "ghost"`) {
+		t.Fatalf("unknown node: %d %s", code, res.Message)
+	}
+	if len(sg1.createdPasswords()) != 0 {
+		t.Fatal("a request naming an unknown node still created users")
+	}
+
+	code, res = callJSON(t, clusterCreateUserHandler, "POST", "/api/cluster/user/create",
+		ClusterUserRequest{Password: "dave", Days: 30, Skip: []string{"dead"}})
+	if code != 200 || !res.Success || res.Message != "Created on 2/2 nodes" {
+		t.Fatalf("create on reachable nodes: %d %v %s", code, res.Success, res.Message)
+	}
+	for name, n := range map[string]*fakeNode{"local": local, "sg-1": sg1} {
+		if got := n.createdPasswords(); len(got) != 1 || got[0] != "dave" {
+			t.Errorf("%s created %v, want [dave]", name, got)
+		}
+	}
+
+	code, res = callJSON(t, clusterCreateUserHandler, "POST", "/api/cluster/user/create",
+		ClusterUserRequest{Password: "erin", Days: 30})
+	if code != 200 || res.Success || res.Message != "Created on 2/3 nodes" {
+		t.Fatalf("create with a dead node: %d %v %s", code, res.Success, res.Message)
+	}
+	list, _ := res.Data.([]interface{})
+	if len(list) != 3 {
+		t.Fatalf("got %d node results, want 3", len(list))
+	}
+	if dead, _ := list[2].(map[string]interface{}); dead["node"] != "dead" || dead["success"] != false {
+		t.Errorf("dead node result: %v", list[2])
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeRotation(t *testing.T, value string, at time.Time) {
+	t.Helper()
+	b, _ := json.Marshal(ObfsRotation{Obfs: value, At: at, Created: time.Now()})
+	writeTestFile(t, ObfsRotationFile, string(b))
+}
+
+func currentObfsTimer() *time.Timer {
+	obfsTimerMu.Lock()
+	defer obfsTimerMu.Unlock()
+	return obfsTimer
+}
+
+func stopObfsTimer(t *testing.T) {
+	t.Cleanup(func() {
+		obfsTimerMu.Lock()
+		if obfsTimer != nil {
+			obfsTimer.Stop()
+			obfsTimer = nil
+		}
+		obfsTimerMu.Unlock()
+	})
+}
+
+func TestObfsChangeDropsPendingRotation(t *testing.T) {
+	withScratchEtc(t)
+	stopObfsTimer(t)
+	writeTestFile(t, ConfigFile, configFixture)
+	writeRotation(t, "scheduledObfs1", time.Now().Add(time.Hour))
+
+	armObfsRotation()
+	if currentObfsTimer() == nil {
+		t.Fatal("pending rotation was not armed")
+	}
+
+	mutex.Lock()
+	obfsChanged("manualObfs123")
+	mutex.Unlock()
+	if _, ok := loadObfsRotation(); ok {
+		t.Error("pending rotation survived an obfs change")
+	}
+	if currentObfsTimer() != nil {
+		t.Error("rotation timer still armed after an obfs change")
+	}
+
+	// A timer that fires after the rotation was dropped changes nothing.
+	if _, err := rotateObfs("scheduledObfs1", true, func(int, string) {}); err != errRotationGone {
+		t.Fatalf("stale scheduled rotation: %v, want errRotationGone", err)
+	}
+	if got := readTestFile(t, ConfigFile); got != configFixture {
+		t.Fatalf("stale scheduled rotation rewrote config.json:\n%s", got)
+	}
+}
+
+func TestObfsTimerRetriesBusyJob(t *testing.T) {
+	withScratchEtc(t)
+	stopObfsTimer(t)
+	oldDir, oldJobs := JobDir, jobs
+	JobDir = t.TempDir()
+	jobs = &jobQueue{jobs: make(map[string]*Job)}
+	t.Cleanup(func() { JobDir, jobs = oldDir, oldJobs })
+
+	release := make(chan struct{})
+	defer close(release)
+	if _, started := jobs.submit("obfs-rotate", true, func(func(int, string)) (interface{}, string, error) {
+		<-release
+		return nil, "done", nil
+	}); !started {
+		t.Fatal("blocking job did not start")
+	}
+
+	writeRotation(t, "scheduledObfs2", time.Now().Add(-time.Second))
+	armObfsRotation()
+	first := currentObfsTimer()
+	deadline := time.Now().Add(2 * time.Second)
+	for currentObfsTimer() == first && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if currentObfsTimer() == first || currentObfsTimer() == nil {
+		t.Fatal("busy obfs-rotate slot dropped the rotation instead of retrying")
+	}
+	if _, err := os.Stat(ObfsRotationFile); err != nil {
+		t.Fatalf("pending rotation lost: %v", err)
+	}
+}
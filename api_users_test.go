@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// configFixture has keys the API does not manage, a custom key order and
+// values that a plain re-encode would rewrite (<, &, 1.50, nested objects).
+const configFixture = `{
+  "server": "sg-1 <primary>",
+  "auth": {
+    "extra": {
+      "header": "a&b"
+    },
+    "config": [
+      "alice",
+      "bob"
+    ],
+    "mode": "passwords"
+  },
+  "obfs": "zivpn",
+  "up_mbps": 1.50,
+  "listen": ":5667",
+  "cert": "/etc/zivpn/zivpn.crt",
+  "key": "/etc/zivpn/zivpn.key",
+  "resolver": {
+    "type": "udp",
+    "udp": {
+      "addr": "1.1.1.1:53"
+    }
+  }
+}`
+
+func withAuthConfig(users ...string) string {
+	list := "[\n      \"" + strings.Join(users, "\",\n      \"") + "\"\n    ]"
+	return strings.Replace(configFixture, "[\n      \"alice\",\n      \"bob\"\n    ]", list, 1)
+}
+
+func TestConfigRoundTripIsByteIdentical(t *testing.T) {
+	withScratchEtc(t)
+	writeTestFile(t, ConfigFile, configFixture)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":5667" || cfg.Obfs != "zivpn" || len(cfg.Auth.Config) != 2 {
+		t.Fatalf("loadConfig: %+v", cfg)
+	}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, ConfigFile); got != configFixture {
+		t.Fatalf("load/save changed config.json:\n%s", got)
+	}
+}
+
+func TestUserHandlersOnlyTouchAuthConfig(t *testing.T) {
+	withScratchEtc(t)
+	writeTestFile(t, ConfigFile, configFixture)
+	writeTestFile(t, UserDB, "alice | 2030-01-01 | reseller\nbob | 2030-01-01\n")
+
+	if code, res := callJSON(t, createUserHandler, "POST", "/api/user/create", UserRequest{Password: "carol", Days: 30}); code != 200 {
+		t.Fatalf("create: %d %s", code, res.Message)
+	}
+	if got, want := readTestFile(t, ConfigFile), withAuthConfig("alice", "bob", "carol"); got != want {
+		t.Fatalf("create rewrote more than auth.config:\n%s\nwant:\n%s", got, want)
+	}
+
+	if code, res := callJSON(t, deleteUserHandler, "POST", "/api/user/delete", UserRequest{Password: "alice"}); code != 200 {
+		t.Fatalf("delete: %d %s", code, res.Message)
+	}
+	want := withAuthConfig("bob", "carol")
+	if got := readTestFile(t, ConfigFile); got != want {
+		t.Fatalf("delete rewrote more than auth.config:\n%s\nwant:\n%s", got, want)
+	}
+
+	if code, res := callJSON(t, renewUserHandler, "POST", "/api/user/renew", UserRequest{Password: "bob", Days: 30}); code != 200 {
+		t.Fatalf("renew: %d %s", code, res.Message)
+	}
+	if got := readTestFile(t, ConfigFile); got != want {
+		t.Fatalf("renew changed config.json:\n%s", got)
+	}
+
+	db := readTestFile(t, UserDB)
+	if strings.Contains(db, "alice") || !strings.HasPrefix(db, "bob | ") || !strings.Contains(db, "\ncarol | ") {
+		t.Errorf("users.db after create/delete/renew:\n%s", db)
+	}
+}
+
+func TestSuspendedUserCreateAndDelete(t *testing.T) {
+	withScratchEtc(t)
+	writeTestFile(t, ConfigFile, configFixture)
+	writeTestFile(t, UserDB, "alice | 2030-01-01 | reseller\nbob | 2030-01-01\n")
+
+	if code, res := callJSON(t, suspendUserHandler, "POST", "/api/user/suspend", map[string]string{"password": "bob"}); code != 200 {
+		t.Fatalf("suspend: %d %s", code, res.Message)
+	}
+	if got, want := readTestFile(t, ConfigFile), withAuthConfig("alice"); got != want {
+		t.Fatalf("suspend left config.json as:\n%s", got)
+	}
+
+	if code, _ := callJSON(t, createUserHandler, "POST", "/api/user/create", UserRequest{Password: "bob", Days: 30}); code != 409 {
+		t.Fatalf("create of a suspended user: got %d, want 409", code)
+	}
+	if db := readTestFile(t, UserDB); strings.Count(db, "bob |") != 1 {
+		t.Fatalf("create duplicated a suspended user:\n%s", db)
+	}
+
+	if code, res := callJSON(t, deleteUserHandler, "POST", "/api/user/delete", UserRequest{Password: "bob"}); code != 200 {
+		t.Fatalf("delete of a suspended user: %d %s", code, res.Message)
+	}
+	if db := readTestFile(t, UserDB); db != "alice | 2030-01-01 | reseller\n" {
+		t.Fatalf("users.db after delete:\n%s", db)
+	}
+	if code, _ := callJSON(t, deleteUserHandler, "POST", "/api/user/delete", UserRequest{Password: "bob"}); code != 404 {
+		t.Fatalf("second delete: got %d, want 404", code)
+	}
+}
+
+func TestMergeUserDBKeepsNotes(t *testing.T) {
+	cur := "alice | 2030-01-01 | reseller budi\nbob | 2030-05-01\ncarol | 2030-02-01 | vip | tg:@carol\n"
+	incoming := "alice | 2030-03-01\nbob | 2030-04-01 | trial\ncarol | 2030-06-01 | vip | tg:@carol2\ndave | 2030-07-01 | new\n"
+	want := "alice | 2030-03-01 | reseller budi\n" +
+		"bob | 2030-05-01 | trial\n" +
+		"carol | 2030-06-01 | vip | tg:@carol2\n" +
+		"dave | 2030-07-01 | new\n"
+	if got := string(mergeUserDB([]byte(cur), []byte(incoming))); got != want {
+		t.Fatalf("mergeUserDB:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	withScratchEtc(t)
+	writeTestFile(t, ConfigFile, withAuthConfig("alice", "carol", "dave"))
+	writeTestFile(t, UserDB, "alice | 2030-01-01 | reseller, budi\n"+
+		"bob | 2030-02-01 | suspended reseller\n"+
+		"carol | 2020-01-01\n"+
+		"dave | 2030-03-01\n")
+
+	export := func(format string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		exportUsersHandler(w, httptest.NewRequest("GET", "/api/users/export?format="+format, nil))
+		if w.Code != 200 {
+			t.Fatalf("export %s: %d %s", format, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	exports := map[string]string{"json": export("json"), "csv": export("csv")}
+	var want []ExportUser
+	if err := json.Unmarshal([]byte(exports["json"]), &want); err != nil || len(want) != 4 {
+		t.Fatalf("JSON export is not a bare array of 4 users (%v):\n%s", err, exports["json"])
+	}
+
+	for format, body := range exports {
+		t.Run(format, func(t *testing.T) {
+			withScratchEtc(t)
+			writeTestFile(t, ConfigFile, withAuthConfig("zed"))
+			writeTestFile(t, UserDB, "")
+
+			importUsers := func(query string) ImportReport {
+				t.Helper()
+				r := httptest.NewRequest("POST", "/api/users/import?format="+format+query, strings.NewReader(body))
+				w := httptest.NewRecorder()
+				importUsersHandler(w, r)
+				var res struct {
+					Data ImportReport `json:"data"`
+				}
+				if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &res) != nil {
+					t.Fatalf("import%s: %d %s", query, w.Code, w.Body.String())
+				}
+				return res.Data
+			}
+
+			rep := importUsers("&dry_run=true")
+			if rep.Imported != len(want) || len(rep.Rows) != len(want) {
+				t.Fatalf("dry run imported %d of %d: %+v", rep.Imported, len(want), rep.Rows)
+			}
+			for i, u := range want {
+				row := rep.Rows[i]
+				if row.Password != u.Password || row.Expired != u.Expired || row.Note != u.Note || row.UserStatus != u.Status {
+					t.Errorf("row %d = %s/%s/%q/%s, want %s/%s/%q/%s", i,
+						row.Password, row.Expired, row.Note, row.UserStatus, u.Password, u.Expired, u.Note, u.Status)
+				}
+			}
+			if readTestFile(t, UserDB) != "" {
+				t.Fatal("dry run wrote users.db")
+			}
+
+			importUsers("")
+			if got, want := readTestFile(t, ConfigFile), withAuthConfig("zed", "alice", "dave"); got != want {
+				t.Errorf("import enabled the wrong users:\n%s", got)
+			}
+			if got := export(format); got != body {
+				t.Errorf("re-export differs:\n%s\nwant:\n%s", got, body)
+			}
+		})
+	}
+}
+
+func TestImportUserStatus(t *testing.T) {
+	today := "2026-06-15"
+	for _, c := range []struct{ status, exp, want string }{
+		{"", "2030-01-01", "active"},
+		{"Active", "2030-01-01", "active"},
+		{"suspended", "2030-01-01", "suspended"},
+		{"expired", "2030-01-01", "suspended"},
+		{"active", "2026-06-14", "expired"},
+		{"", "2026-06-15", "active"},
+	} {
+		if got, err := importUserStatus(c.status, c.exp, today); err != nil || got != c.want {
+			t.Errorf("%q %s: %q %v, want %q", c.status, c.exp, got, err, c.want)
+		}
+	}
+	if _, err := importUserStatus("banned", "2030-01-01", today); err == nil {
+		t.Error("unknown status accepted")
+	}
+}
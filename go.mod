@@ -4,4 +4,5 @@ go 1.18
 
 require (
     github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+    golang.org/x/crypto v0.20.0
 )
\ No newline at end of file
@@ -66,7 +66,10 @@ run_silent 'Removing rclone config' \
 
 # ========= REMOVE IPTABLES RULES =========
 run_silent "Cleaning iptables rules" \
-"iptables -t nat -D PREROUTING -p udp --dport 6000:19999 -j DNAT --to-destination :5667 2>/dev/null"
+"iptables -t nat -S PREROUTING 2>/dev/null | grep -- '-j DNAT --to-destination :5667' | sed 's/^-A //' | while read -r rule; do iptables -t nat -D \$rule; done; nft delete table ip zivpn_nat 2>/dev/null; true"
+
+run_silent "Removing ban rules" \
+"for t in iptables ip6tables; do \$t -S INPUT 2>/dev/null | grep -- '-j ZIVPN-BAN' | sed 's/^-A //' | while read -r rule; do \$t -D \$rule; done; \$t -F ZIVPN-BAN 2>/dev/null; \$t -X ZIVPN-BAN 2>/dev/null; done; nft delete table inet zivpn_ban 2>/dev/null; true"
 
 # ========= REMOVE CRON JOBS =========
 run_silent "Removing cron jobs" \
@@ -2,22 +2,57 @@ package main
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
-const (
+// The file paths are variables so tests can point them at a scratch
+// directory.
+var (
 	ConfigFile     = "/etc/zivpn/config.json"
 	UserDB         = "/etc/zivpn/users.db"
 	DomainFile     = "/etc/zivpn/domain"
@@ -26,14 +61,29 @@ const (
 	RcloneRemote   = "drive:ZIVPN-BACKUP"
 	Port           = ":8080"
 	AutoBackupFile = "/etc/zivpn/backup_auto.json"
+	SecurityFile   = "/etc/zivpn/api-security.json"
+	MetricsKeyFile = "/etc/zivpn/metrics-key"
 )
 
 var (
-	AuthToken   = ""
-	mutex       = &sync.Mutex{}
-	backupMutex = &sync.Mutex{}
+	MetricsToken = ""
+	mutex        = &sync.Mutex{}
+	backupMutex  = &sync.Mutex{}
+
+	// authToken holds the API key as a string. A restore can replace it
+	// while requests are being served, so it is only accessed atomically.
+	authToken atomic.Value
 )
 
+func getAuthToken() string {
+	s, _ := authToken.Load().(string)
+	return s
+}
+
+func setAuthToken(token string) {
+	authToken.Store(token)
+}
+
 type Config struct {
 	Listen string `json:"listen"`
 	Cert   string `json:"cert"`
@@ -43,6 +93,9 @@ type Config struct {
 		Mode   string   `json:"mode"`
 		Config []string `json:"config"`
 	} `json:"auth"`
+
+	raw     rawObject
+	authRaw rawObject
 }
 
 type UserRequest struct {
@@ -51,12 +104,23 @@ type UserRequest struct {
 }
 
 type BackupRequest struct {
-	BackupID string `json:"backup_id"`
+	BackupID   string `json:"backup_id"`
+	Passphrase string `json:"passphrase,omitempty"`
 }
 
 type AutoBackupCfg struct {
-	Enabled  bool   `json:"enabled"`
-	Schedule string `json:"schedule"`
+	Enabled   bool      `json:"enabled"`
+	Schedule  string    `json:"schedule"`
+	Retention Retention `json:"retention"`
+}
+
+type SecurityCfg struct {
+	RatePerSecond  float64  `json:"rate_per_second"`
+	Burst          int      `json:"burst"`
+	MaxFailures    int      `json:"max_failures"`
+	LockoutSeconds int      `json:"lockout_seconds"`
+	MaxLockout     int      `json:"max_lockout_seconds"`
+	Allowlist      []string `json:"allowlist"`
 }
 
 type Response struct {
@@ -92,10 +156,164 @@ func loadConfig() (Config, error) {
 }
 
 func saveConfig(cfg Config) error {
-	b, _ := json.MarshalIndent(cfg, "", "  ")
+	b, err := marshalConfig(cfg)
+	if err != nil {
+		return err
+	}
 	return ioutil.WriteFile(ConfigFile, b, 0644)
 }
 
+// marshalConfig indents cfg without escaping <, > and &, so values written
+// by hand come back byte for byte.
+func marshalConfig(cfg Config) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(cfg); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// rawObject is a JSON object that remembers its key order and the exact
+// value of every key, so settings the API does not manage survive a
+// load/save cycle.
+type rawObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func (o *rawObject) UnmarshalJSON(b []byte) error {
+	o.keys, o.values = nil, map[string]json.RawMessage{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if d, ok := t.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("expected a JSON object")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := t.(string)
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		if _, dup := o.values[key]; !dup {
+			o.keys = append(o.keys, key)
+		}
+		o.values[key] = v
+	}
+	_, err = dec.Token()
+	return err
+}
+
+func (o rawObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		b.Write(kb)
+		b.WriteByte(':')
+		b.Write(o.values[k])
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// with returns a copy of o where key holds v. The stored bytes are kept
+// when they already decode to v, and new keys are appended at the end.
+func (o rawObject) with(key string, v interface{}) (rawObject, error) {
+	out := rawObject{keys: append([]string(nil), o.keys...), values: make(map[string]json.RawMessage, len(o.values)+1)}
+	for k, val := range o.values {
+		out.values[k] = val
+	}
+	if old, ok := out.values[key]; ok {
+		cur := reflect.New(reflect.TypeOf(v))
+		if json.Unmarshal(old, cur.Interface()) == nil && reflect.DeepEqual(cur.Elem().Interface(), v) {
+			return out, nil
+		}
+	} else {
+		out.keys = append(out.keys, key)
+	}
+	b, err := marshalNoEscape(v)
+	if err != nil {
+		return out, err
+	}
+	out.values[key] = b
+	return out, nil
+}
+
+func marshalNoEscape(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+type configFields Config
+
+// UnmarshalJSON fills the known fields and keeps the whole document, the
+// auth section included, for MarshalJSON.
+func (c *Config) UnmarshalJSON(b []byte) error {
+	var raw rawObject
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	var f configFields
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	*c = Config(f)
+	c.raw = raw
+	if a, ok := raw.values["auth"]; ok {
+		if err := json.Unmarshal(a, &c.authRaw); err != nil {
+			return fmt.Errorf("auth: %v", err)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes the loaded document back with the known fields
+// updated in place, preserving key order and unknown keys.
+func (c Config) MarshalJSON() ([]byte, error) {
+	auth := c.authRaw
+	var err error
+	for _, kv := range []struct {
+		key string
+		val interface{}
+	}{{"mode", c.Auth.Mode}, {"config", c.Auth.Config}} {
+		if auth, err = auth.with(kv.key, kv.val); err != nil {
+			return nil, err
+		}
+	}
+
+	out := c.raw
+	for _, kv := range []struct {
+		key string
+		val interface{}
+	}{{"listen", c.Listen}, {"cert", c.Cert}, {"key", c.Key}, {"obfs", c.Obfs}, {"auth", auth}} {
+		if out, err = out.with(kv.key, kv.val); err != nil {
+			return nil, err
+		}
+	}
+	return out.MarshalJSON()
+}
+
 func loadUsers() ([]string, error) {
 	b, err := ioutil.ReadFile(UserDB)
 	if err != nil {
@@ -130,6 +348,7 @@ func appendToFile(path, content string) error {
 
 func restartAll() {
     go func() {
+        metrics.restarted()
         cmd := exec.Command("systemctl", "restart", "zivpn.service")
         cmd.Stdout = io.Discard
         cmd.Stderr = io.Discard
@@ -137,16 +356,551 @@ func restartAll() {
     }()
 }
 
+func defaultSecurityCfg() SecurityCfg {
+	return SecurityCfg{
+		RatePerSecond:  5,
+		Burst:          20,
+		MaxFailures:    5,
+		LockoutSeconds: 60,
+		MaxLockout:     3600,
+	}
+}
+
+func loadSecurityCfg() SecurityCfg {
+	cfg := defaultSecurityCfg()
+	if b, err := ioutil.ReadFile(SecurityFile); err == nil {
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			log.Println("invalid", SecurityFile, err)
+			return defaultSecurityCfg()
+		}
+	}
+	if cfg.RatePerSecond <= 0 {
+		cfg.RatePerSecond = 5
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = 20
+	}
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = 5
+	}
+	if cfg.LockoutSeconds <= 0 {
+		cfg.LockoutSeconds = 60
+	}
+	if cfg.MaxLockout < cfg.LockoutSeconds {
+		cfg.MaxLockout = cfg.LockoutSeconds
+	}
+	return cfg
+}
+
+type clientState struct {
+	tokens    float64
+	lastSeen  time.Time
+	failures  int
+	lockouts  int
+	lockUntil time.Time
+}
+
+type guardStats struct {
+	Allowed      uint64 `json:"allowed"`
+	RateLimited  uint64 `json:"rate_limited"`
+	Unauthorized uint64 `json:"unauthorized"`
+	LockedOut    uint64 `json:"locked_out"`
+	NotAllowed   uint64 `json:"not_allowlisted"`
+}
+
+// guard keeps per-IP rate limit and failed-login state for authMiddleware.
+type guard struct {
+	mu      sync.Mutex
+	cfg     SecurityCfg
+	nets    []*net.IPNet
+	clients map[string]*clientState
+	stats   guardStats
+	now     func() time.Time
+}
+
+func newGuard(cfg SecurityCfg) *guard {
+	g := &guard{
+		cfg:     cfg,
+		clients: make(map[string]*clientState),
+		now:     time.Now,
+	}
+	for _, a := range cfg.Allowlist {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if !strings.Contains(a, "/") {
+			if strings.Contains(a, ":") {
+				a += "/128"
+			} else {
+				a += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			log.Println("invalid allowlist entry", a, err)
+			continue
+		}
+		g.nets = append(g.nets, n)
+	}
+	return g
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (g *guard) allowedNet(ip string) bool {
+	if len(g.nets) == 0 {
+		return true
+	}
+	p := net.ParseIP(ip)
+	if p == nil {
+		return false
+	}
+	if p.IsLoopback() {
+		return true
+	}
+	for _, n := range g.nets {
+		if n.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *guard) client(ip string, now time.Time) *clientState {
+	c, ok := g.clients[ip]
+	if !ok {
+		c = &clientState{tokens: float64(g.cfg.Burst), lastSeen: now}
+		g.clients[ip] = c
+		return c
+	}
+	elapsed := now.Sub(c.lastSeen).Seconds()
+	c.tokens = math.Min(float64(g.cfg.Burst), c.tokens+elapsed*g.cfg.RatePerSecond)
+	c.lastSeen = now
+	return c
+}
+
+// check decides whether a request from ip may proceed. It returns the HTTP
+// status and message to reject with, or 0 when the request is allowed.
+func (g *guard) check(ip string) (int, string, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.allowedNet(ip) {
+		g.stats.NotAllowed++
+		return 403, "Forbidden", 0
+	}
+
+	now := g.now()
+	c := g.client(ip, now)
+	if now.Before(c.lockUntil) {
+		g.stats.LockedOut++
+		return 429, "Too many failed attempts", c.lockUntil.Sub(now)
+	}
+	if c.tokens < 1 {
+		g.stats.RateLimited++
+		wait := time.Duration((1 - c.tokens) / g.cfg.RatePerSecond * float64(time.Second))
+		return 429, "Rate limit exceeded", wait
+	}
+	c.tokens--
+	return 0, "", 0
+}
+
+// fail records a rejected API key. Every MaxFailures consecutive failures
+// lock the client out, doubling the lockout each time up to MaxLockout.
+func (g *guard) fail(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.stats.Unauthorized++
+	now := g.now()
+	c := g.client(ip, now)
+	c.failures++
+	if c.failures < g.cfg.MaxFailures {
+		return
+	}
+	c.failures = 0
+	d := time.Duration(g.cfg.LockoutSeconds) * time.Second << uint(c.lockouts)
+	if max := time.Duration(g.cfg.MaxLockout) * time.Second; d > max || d <= 0 {
+		d = max
+	} else {
+		c.lockouts++
+	}
+	c.lockUntil = now.Add(d)
+	log.Printf("locking out %s for %s after repeated auth failures", ip, d)
+}
+
+func (g *guard) succeed(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.stats.Allowed++
+	if c, ok := g.clients[ip]; ok {
+		c.failures = 0
+		c.lockouts = 0
+	}
+}
+
+// sweep drops idle clients so the map does not grow without bound.
+func (g *guard) sweep(idle time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	for ip, c := range g.clients {
+		if now.Sub(c.lastSeen) > idle && now.After(c.lockUntil) {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+func (g *guard) snapshot() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	locked := []map[string]interface{}{}
+	for ip, c := range g.clients {
+		if now.Before(c.lockUntil) {
+			locked = append(locked, map[string]interface{}{
+				"ip":    ip,
+				"until": c.lockUntil.Format(time.RFC3339),
+			})
+		}
+	}
+	return map[string]interface{}{
+		"stats":     g.stats,
+		"clients":   len(g.clients),
+		"locked":    locked,
+		"allowlist": g.cfg.Allowlist,
+	}
+}
+
+var apiGuard = newGuard(defaultSecurityCfg())
+
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if AuthToken != "" && r.Header.Get("X-API-Key") != AuthToken {
+		ip := clientIP(r)
+		if status, msg, wait := apiGuard.check(ip); status != 0 {
+			if wait > 0 {
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			}
+			jsonResponse(w, status, false, msg, nil)
+			return
+		}
+		if token := getAuthToken(); token != "" && r.Header.Get("X-API-Key") != token {
+			apiGuard.fail(ip)
 			jsonResponse(w, 401, false, "Unauthorized", nil)
 			return
 		}
+		apiGuard.succeed(ip)
+		// Handlers that change state refuse GET, so reads stay available
+		// while the license is locked. Node requests are proxied whatever
+		// their method and are locked as a whole. /api/license enforces the
+		// lock itself.
+		if (r.Method != http.MethodGet || strings.HasPrefix(r.URL.Path, "/api/nodes/")) && !strings.HasPrefix(r.URL.Path, "/api/license") {
+			if msg, blocked := licenseBlocked(); blocked {
+				jsonResponse(w, 403, false, msg, nil)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type routeMetrics struct {
+	codes   map[int]uint64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// apiMetrics holds the counters exported on /metrics. Everything is guarded
+// by a single mutex; the API does not see enough traffic for this to matter.
+type apiMetrics struct {
+	mu                sync.Mutex
+	routes            map[string]*routeMetrics
+	restarts          uint64
+	backupSuccess     uint64
+	backupFailure     uint64
+	lastBackupSuccess time.Time
+}
+
+var metrics = &apiMetrics{routes: make(map[string]*routeMetrics)}
+
+func (m *apiMetrics) observe(route string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rm, ok := m.routes[route]
+	if !ok {
+		rm = &routeMetrics{codes: make(map[int]uint64), buckets: make([]uint64, len(latencyBuckets))}
+		m.routes[route] = rm
+	}
+	rm.codes[code]++
+	sec := d.Seconds()
+	for i, le := range latencyBuckets {
+		if sec <= le {
+			rm.buckets[i]++
+		}
+	}
+	rm.sum += sec
+	rm.count++
+}
+
+func (m *apiMetrics) restarted() {
+	m.mu.Lock()
+	m.restarts++
+	m.mu.Unlock()
+}
+
+func (m *apiMetrics) backupDone(ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ok {
+		m.backupSuccess++
+		m.lastBackupSuccess = time.Now()
+	} else {
+		m.backupFailure++
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		next(rec, r)
+		metrics.observe(route, rec.status, time.Since(start))
+	}
+}
+
+type userCounts struct {
+	Total       int
+	Active      int
+	Expired     int
+	Suspended   int
+	Expiring24h int
+}
+
+// countUsers classifies users.db entries. An account whose password is no
+// longer in config.json is counted as suspended rather than active.
+func countUsers() userCounts {
+	var c userCounts
+	users, _ := loadUsers()
+	enabled := map[string]bool{}
+	if cfg, err := loadConfig(); err == nil {
+		for _, p := range cfg.Auth.Config {
+			enabled[p] = true
+		}
+	}
+	now := time.Now()
+	today := now.Format("2006-01-02")
+	for _, line := range users {
+		parts := strings.Split(line, "|")
+		if len(parts) < 2 {
+			continue
+		}
+		pass := strings.TrimSpace(parts[0])
+		exp := strings.TrimSpace(parts[1])
+		c.Total++
+		switch {
+		case exp < today:
+			c.Expired++
+		case !enabled[pass]:
+			c.Suspended++
+		default:
+			c.Active++
+			if t, err := time.ParseInLocation("2006-01-02", exp, time.Local); err == nil {
+				if t.AddDate(0, 0, 1).Sub(now) <= 24*time.Hour {
+					c.Expiring24h++
+				}
+			}
+		}
+	}
+	return c
+}
+
+type promWriter struct {
+	b strings.Builder
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	fmt.Fprintf(&p.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(&p.b, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (p *promWriter) gauge(name, help string, v float64) {
+	p.header(name, "gauge", help)
+	p.sample(name, "", v)
+}
+
+func promLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+func renderMetrics() string {
+	var p promWriter
+
+	uc := countUsers()
+	p.header("zivpn_users", "gauge", "Number of VPN accounts by state.")
+	p.sample("zivpn_users", `state="total"`, float64(uc.Total))
+	p.sample("zivpn_users", `state="active"`, float64(uc.Active))
+	p.sample("zivpn_users", `state="expired"`, float64(uc.Expired))
+	p.sample("zivpn_users", `state="suspended"`, float64(uc.Suspended))
+	p.gauge("zivpn_users_expiring_24h", "Active accounts expiring within the next 24 hours.", float64(uc.Expiring24h))
+
+	metrics.mu.Lock()
+	routes := make([]string, 0, len(metrics.routes))
+	for r := range metrics.routes {
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+	p.header("zivpn_api_requests_total", "counter", "API requests by route and status code.")
+	for _, r := range routes {
+		rm := metrics.routes[r]
+		codes := make([]int, 0, len(rm.codes))
+		for c := range rm.codes {
+			codes = append(codes, c)
+		}
+		sort.Ints(codes)
+		for _, c := range codes {
+			p.sample("zivpn_api_requests_total", fmt.Sprintf(`route="%s",code="%d"`, promLabel(r), c), float64(rm.codes[c]))
+		}
+	}
+	p.header("zivpn_api_request_duration_seconds", "histogram", "API request latency by route.")
+	for _, r := range routes {
+		rm := metrics.routes[r]
+		l := promLabel(r)
+		for i, le := range latencyBuckets {
+			p.sample("zivpn_api_request_duration_seconds_bucket", fmt.Sprintf(`route="%s",le="%s"`, l, strconv.FormatFloat(le, 'g', -1, 64)), float64(rm.buckets[i]))
+		}
+		p.sample("zivpn_api_request_duration_seconds_bucket", fmt.Sprintf(`route="%s",le="+Inf"`, l), float64(rm.count))
+		p.sample("zivpn_api_request_duration_seconds_sum", fmt.Sprintf(`route="%s"`, l), rm.sum)
+		p.sample("zivpn_api_request_duration_seconds_count", fmt.Sprintf(`route="%s"`, l), float64(rm.count))
+	}
+	p.header("zivpn_core_restarts_total", "counter", "Restarts of zivpn.service requested by the API.")
+	p.sample("zivpn_core_restarts_total", "", float64(metrics.restarts))
+	p.header("zivpn_backups_total", "counter", "Backup attempts by result.")
+	p.sample("zivpn_backups_total", `result="success"`, float64(metrics.backupSuccess))
+	p.sample("zivpn_backups_total", `result="failure"`, float64(metrics.backupFailure))
+	last := 0.0
+	if !metrics.lastBackupSuccess.IsZero() {
+		last = float64(metrics.lastBackupSuccess.Unix())
+	}
+	metrics.mu.Unlock()
+	p.gauge("zivpn_backup_last_success_timestamp_seconds", "Unix time of the last successful backup.", last)
+
+	apiGuard.mu.Lock()
+	gs := apiGuard.stats
+	apiGuard.mu.Unlock()
+	p.header("zivpn_api_rejected_total", "counter", "API requests rejected before reaching a handler.")
+	p.sample("zivpn_api_rejected_total", `reason="rate_limited"`, float64(gs.RateLimited))
+	p.sample("zivpn_api_rejected_total", `reason="unauthorized"`, float64(gs.Unauthorized))
+	p.sample("zivpn_api_rejected_total", `reason="locked_out"`, float64(gs.LockedOut))
+	p.sample("zivpn_api_rejected_total", `reason="not_allowlisted"`, float64(gs.NotAllowed))
+
+	st := collectSystemStats()
+	p.gauge("zivpn_host_cpu_cores", "Number of CPU cores.", float64(st.Cores))
+	p.gauge("zivpn_host_memory_total_bytes", "Total memory.", float64(st.Memory.Total))
+	p.gauge("zivpn_host_memory_used_bytes", "Memory in use (total minus available).", float64(st.Memory.Used))
+	p.gauge("zivpn_host_memory_available_bytes", "Available memory.", float64(st.Memory.Available))
+	p.gauge("zivpn_host_disk_total_bytes", "Size of the root filesystem.", float64(st.Disk.Total))
+	p.gauge("zivpn_host_disk_used_bytes", "Used space on the root filesystem.", float64(st.Disk.Used))
+	p.gauge("zivpn_host_disk_free_bytes", "Free space on the root filesystem.", float64(st.Disk.Free))
+	p.header("zivpn_host_load", "gauge", "System load average.")
+	p.sample("zivpn_host_load", `period="1m"`, st.Load.Load1)
+	p.sample("zivpn_host_load", `period="5m"`, st.Load.Load5)
+	p.sample("zivpn_host_load", `period="15m"`, st.Load.Load15)
+	p.gauge("zivpn_host_uptime_seconds", "Host uptime.", float64(st.Uptime))
+	p.header("zivpn_host_network_receive_bytes_total", "counter", "Bytes received per interface.")
+	for _, i := range st.Interfaces {
+		p.sample("zivpn_host_network_receive_bytes_total", fmt.Sprintf(`iface="%s"`, promLabel(i.Name)), float64(i.RxBytes))
+	}
+	p.header("zivpn_host_network_transmit_bytes_total", "counter", "Bytes transmitted per interface.")
+	for _, i := range st.Interfaces {
+		p.sample("zivpn_host_network_transmit_bytes_total", fmt.Sprintf(`iface="%s"`, promLabel(i.Name)), float64(i.TxBytes))
+	}
+	online.mu.Lock()
+	p.gauge("zivpn_online_clients", "Client IPs with an active UDP session to the core.", float64(len(online.sessions)))
+	online.mu.Unlock()
+
+	up := 0.0
+	if isActive("zivpn") {
+		up = 1
+	}
+	p.gauge("zivpn_core_up", "Whether zivpn.service is active.", up)
+
+	return p.b.String()
+}
+
+// metricsAuth protects /metrics with its own token so a scraper never holds
+// the management API key. Without a metrics key file, /metrics is only
+// served to clients on localhost.
+func metricsAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if status, msg, _ := apiGuard.check(ip); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+		token := MetricsToken
+		if token == "" {
+			if p := net.ParseIP(ip); p == nil || !p.IsLoopback() {
+				http.Error(w, "Metrics key not configured, only localhost may scrape", 403)
+				return
+			}
+			apiGuard.succeed(ip)
+			next(w, r)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if got == "" {
+			got = r.Header.Get("X-Metrics-Key")
+		}
+		if got != token {
+			apiGuard.fail(ip)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		apiGuard.succeed(ip)
 		next(w, r)
 	}
 }
 
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, renderMetrics())
+}
+
+func securityStatsHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, 200, true, "OK", apiGuard.snapshot())
+}
+
 func getDomain() string {
     b, err := ioutil.ReadFile(DomainFile)
     if err != nil {
@@ -176,18 +930,25 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A suspended user is only in users.db, so check both.
+	users, _ := loadUsers()
+	exists := userInDB(users, req.Password)
 	for _, u := range cfg.Auth.Config {
 		if u == req.Password {
-			jsonResponse(w, 409, false, "User exists", nil)
-			return
+			exists = true
 		}
 	}
+	if exists {
+		jsonResponse(w, 409, false, "User exists", nil)
+		return
+	}
 
 	cfg.Auth.Config = append(cfg.Auth.Config, req.Password)
 	_ = saveConfig(cfg)
 
 	exp := time.Now().Add(24 * time.Hour * time.Duration(req.Days)).Format("2006-01-02")
 	_ = appendToFile(UserDB, fmt.Sprintf("%s | %s\n", req.Password, exp))
+	userChanged(req.Password)
 
 	go restartAll()
 
@@ -195,10 +956,16 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	"password": req.Password,
 	"expired": exp,
 	"domain": getDomain(), 
+	"obfs": cfg.Obfs,
+	"port": clientPorts(cfg),
   })
 }
 
 func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
 	var req UserRequest
 	_ = json.NewDecoder(r.Body).Decode(&req)
 	if req.Password == "" {
@@ -211,25 +978,28 @@ func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	cfg, _ := loadConfig()
 	var newAuth []string
-	found := false
+	enabled := false
 
 	for _, u := range cfg.Auth.Config {
 		if u == req.Password {
-			found = true
+			enabled = true
 			continue
 		}
 		newAuth = append(newAuth, u)
 	}
 
-	if !found {
+	// Suspended users are in users.db only, as in localRecords.
+	users, _ := loadUsers()
+	if !enabled && !userInDB(users, req.Password) {
 		jsonResponse(w, 404, false, "User not found", nil)
 		return
 	}
 
-	cfg.Auth.Config = newAuth
-	_ = saveConfig(cfg)
+	if enabled {
+		cfg.Auth.Config = newAuth
+		_ = saveConfig(cfg)
+	}
 
-	users, _ := loadUsers()
 	var newUsers []string
 	for _, line := range users {
 		if !strings.HasPrefix(line, req.Password+" ") &&
@@ -238,13 +1008,29 @@ func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	_ = saveUsers(newUsers)
+	userChanged(req.Password)
 
 	go restartAll()
 	jsonResponse(w, 200, true, "User deleted", nil)
 }
 
-func renewUserHandler(w http.ResponseWriter, r *http.Request) {
-	var req UserRequest
+// userInDB reports whether lines, as read by loadUsers, hold password.
+func userInDB(lines []string, password string) bool {
+	for _, line := range lines {
+		parts := strings.Split(line, "|")
+		if len(parts) >= 2 && strings.TrimSpace(parts[0]) == password {
+			return true
+		}
+	}
+	return false
+}
+
+func renewUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	var req UserRequest
 	_ = json.NewDecoder(r.Body).Decode(&req)
 
 	if req.Password == "" || req.Days <= 0 {
@@ -279,7 +1065,8 @@ func renewUserHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			newExp = old.Add(time.Hour * 24 * time.Duration(req.Days)).Format("2006-01-02")
-			newUsers = append(newUsers, fmt.Sprintf("%s | %s", pass, newExp))
+			parts[1] = " " + newExp + " "
+			newUsers = append(newUsers, strings.TrimSpace(pass+" |"+strings.Join(parts[1:], "|")))
 
 		} else {
 			newUsers = append(newUsers, line)
@@ -292,6 +1079,7 @@ func renewUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	_ = saveUsers(newUsers)
+	userChanged(req.Password)
 	go restartAll()
 
 	jsonResponse(w, 200, true, "User renewed", map[string]string{
@@ -327,373 +1115,8395 @@ func listUsersHandler(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, 200, true, "OK", out)
 }
 
-func execOut(cmd string) string {
-	out, err := exec.Command("bash", "-c", cmd).CombinedOutput()
-	if err != nil {
-		return ""
-	}
-	s := strings.TrimSpace(string(out))
-	lines := strings.Split(s, "\n")
-	if len(lines) > 0 {
-		return strings.TrimSpace(lines[0])
-	}
-	return ""
+const maxImportSize = 8 << 20
+
+// ImportRow is one imported user. UserStatus is the account state from the
+// file (active, suspended or expired, as written by the export); Status is
+// the outcome of the import.
+type ImportRow struct {
+	Line       int    `json:"line"`
+	Password   string `json:"password"`
+	Expired    string `json:"expired,omitempty"`
+	Note       string `json:"note,omitempty"`
+	UserStatus string `json:"user_status,omitempty"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason,omitempty"`
 }
 
-func isActive(service string) bool {
-	out, err := exec.Command("systemctl", "is-active", service).Output()
-	if err != nil {
+type ImportReport struct {
+	DryRun   bool        `json:"dry_run"`
+	Total    int         `json:"total"`
+	Imported int         `json:"imported"`
+	Skipped  int         `json:"skipped"`
+	Invalid  int         `json:"invalid"`
+	Rows     []ImportRow `json:"rows"`
+}
+
+// validPassword rejects passwords that would corrupt users.db or that the
+// core cannot use as an auth string.
+func validPassword(p string) bool {
+	if p == "" || len(p) > 64 || strings.Contains(p, "|") {
 		return false
 	}
-	return strings.TrimSpace(string(out)) == "active"
+	for _, c := range p {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
 }
 
-func getSystemInfoHandler(w http.ResponseWriter, r *http.Request) {
-	pub := execOut(`curl -s ifconfig.me`)
-	priv := strings.TrimSpace(execOut(`hostname -I | awk '{print $1}'`))
+var importDateLayouts = []string{
+	"2006-01-02", "2006/01/02", "02-01-2006", "02/01/2006", time.RFC3339, "2006-01-02 15:04:05",
+}
 
-	domain := "Unknown"
-	if b, err := ioutil.ReadFile(DomainFile); err == nil {
-		domain = strings.TrimSpace(string(b))
+// parseImportExpiry accepts a date in common panel formats, a number of
+// days from today, or a Unix timestamp, and returns it as YYYY-MM-DD.
+func parseImportExpiry(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", fmt.Errorf("missing expiry")
 	}
-
-	osInfo := strings.TrimSpace(execOut(`grep PRETTY_NAME /etc/os-release | cut -d= -f2 | tr -d '"'`))
-	if osInfo == "" {
-		osInfo = execOut(`uname -a`)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		switch {
+		case n > 0 && n <= 3650:
+			return time.Now().AddDate(0, 0, int(n)).Format("2006-01-02"), nil
+		case n > 1e12:
+			return time.Unix(n/1000, 0).Format("2006-01-02"), nil
+		case n > 1e9:
+			return time.Unix(n, 0).Format("2006-01-02"), nil
+		}
+		return "", fmt.Errorf("invalid expiry %q", s)
 	}
+	for _, layout := range importDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.Format("2006-01-02"), nil
+		}
+	}
+	return "", fmt.Errorf("invalid expiry %q", s)
+}
 
-	kernel := execOut(`uname -r`)
-
-	cpu := execOut(`grep "model name" /proc/cpuinfo | head -1 | cut -d: -f2`)
-	cpu = strings.TrimSpace(cpu)
-
-	cores := execOut(`nproc`)
-
-	ramUsed := execOut(`free -m | awk '/Mem:/ {print $3}'`)
-	ramTotal := execOut(`free -m | awk '/Mem:/ {print $2}'`)
-	ram := fmt.Sprintf("%sMB / %sMB", strings.TrimSpace(ramUsed), strings.TrimSpace(ramTotal))
-
-	diskUsed := execOut(`df -h / | awk 'NR==2 {print $3}'`)
-	diskAvail := execOut(`df -h / | awk 'NR==2 {print $4}'`)
-	disk := fmt.Sprintf("%s / %s", strings.TrimSpace(diskUsed), strings.TrimSpace(diskAvail))
-
-	uptime := strings.TrimSpace(execOut(`uptime -p | sed 's/up //'`))
+// importUserStatus resolves the account state of an imported user. Only
+// active accounts are enabled in auth.config; a past expiry date always
+// means expired, and an account marked expired that has not run out yet
+// is kept disabled as suspended.
+func importUserStatus(status, exp, today string) (string, error) {
+	s := strings.ToLower(strings.TrimSpace(status))
+	switch s {
+	case "", "active", "suspended", "expired":
+	default:
+		return "", fmt.Errorf("unknown status %q", status)
+	}
+	switch {
+	case exp < today:
+		return "expired", nil
+	case s == "suspended" || s == "expired":
+		return "suspended", nil
+	}
+	return "active", nil
+}
 
-	backupCount := 0
-	if out, err := exec.Command("rclone", "lsjson", RcloneRemote).Output(); err == nil {
-		var arr []map[string]interface{}
-		if json.Unmarshal(out, &arr) == nil {
-			for _, x := range arr {
-				if n, ok := x["Name"].(string); ok && strings.HasSuffix(n, ".zip") {
-					backupCount++
-				}
+// parseImportCSV reads password,expiry[,note[,status]] rows, the layout of
+// the CSV export. A first row that names the columns is skipped.
+func parseImportCSV(b []byte) ([]ImportRow, error) {
+	cr := csv.NewReader(bytes.NewReader(b))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	var rows []ImportRow
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(rows) == 0 && len(rec) > 0 {
+			switch strings.ToLower(strings.TrimSpace(rec[0])) {
+			case "password", "pass", "user", "username":
+				continue
 			}
 		}
+		row := ImportRow{Line: line}
+		if len(rec) > 0 {
+			row.Password = strings.TrimSpace(rec[0])
+		}
+		if len(rec) > 1 {
+			row.Expired = strings.TrimSpace(rec[1])
+		}
+		if len(rec) > 2 {
+			row.Note = strings.TrimSpace(rec[2])
+		}
+		if len(rec) > 3 {
+			row.UserStatus = strings.TrimSpace(rec[3])
+		}
+		rows = append(rows, row)
 	}
+	return rows, nil
+}
 
-	userCount := 0
-	if b, err := ioutil.ReadFile(UserDB); err == nil {
-		lines := strings.Split(string(b), "\n")
-		now := time.Now().Format("2006-01-02")
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-			if line == "" || !strings.Contains(line, "|") {
-				continue
+func pickString(m map[string]interface{}, keys ...string) string {
+	for _, k := range keys {
+		switch v := m[k].(type) {
+		case string:
+			if v != "" {
+				return v
 			}
-			parts := strings.Split(line, "|")
-			if len(parts) >= 2 {
-				exp := strings.TrimSpace(parts[1])
-				if exp >= now {
-					userCount++
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+// parseImportJSON accepts an array of user objects, or an object holding
+// one under "users" or "clients" as other panels export, or under "data"
+// as in an API response. Common field names for password, expiry, note
+// and status are recognised; "enable": false marks a suspended account.
+func parseImportJSON(b []byte) ([]ImportRow, error) {
+	var list []map[string]interface{}
+	if err := json.Unmarshal(b, &list); err != nil {
+		var wrap map[string]json.RawMessage
+		if err2 := json.Unmarshal(b, &wrap); err2 != nil {
+			return nil, err
+		}
+		for _, k := range []string{"users", "clients", "data"} {
+			if raw, ok := wrap[k]; ok {
+				if err := json.Unmarshal(raw, &list); err != nil {
+					return nil, fmt.Errorf("%s: %v", k, err)
 				}
+				break
 			}
 		}
 	}
-
-	serviceStatus := "active"
-	if !isActive("zivpn") || !isActive("zivpn-api") || !isActive("zivpn-bot") {
-		serviceStatus = "inactive"
+	rows := make([]ImportRow, 0, len(list))
+	for i, m := range list {
+		status := strings.TrimSpace(pickString(m, "status"))
+		if on, ok := m["enable"].(bool); ok && !on && status == "" {
+			status = "suspended"
+		}
+		rows = append(rows, ImportRow{
+			Line:       i + 1,
+			Password:   strings.TrimSpace(pickString(m, "password", "pass", "auth", "username", "user")),
+			Expired:    strings.TrimSpace(pickString(m, "expired", "expiry", "exp", "expiry_date", "expiryTime", "expire")),
+			Note:       strings.TrimSpace(pickString(m, "note", "remark", "comment", "email")),
+			UserStatus: status,
+		})
 	}
-
-	jsonResponse(w, 200, true, "OK", map[string]interface{}{
-		"public_ip":    pub,
-		"private_ip":   priv,
-		"domain":       domain,
-		"os":           osInfo,
-		"kernel":       kernel,
-		"cpu":          cpu,
-		"cores":        cores,
-		"ram":          ram,
-		"disk":         disk,
-		"uptime":       uptime,
-		"port":         "5667 UDP, 8080 API",
-		"service":      serviceStatus,
-		"server_time":  time.Now().Format("2006-01-02 15:04:05"),
-		"backup_count": backupCount,
-		"user_count":   userCount,
-	})
+	return rows, nil
 }
 
-func createZip(dest string, paths []string) error {
-	f, err := os.Create(dest)
-	if err != nil {
-		return err
+func importFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return strings.ToLower(f)
 	}
-	defer f.Close()
-
-	w := zip.NewWriter(f)
-	defer w.Close()
-
-	for _, p := range paths {
-		if s, err := os.Stat(p); err == nil && !s.IsDir() {
-			src, err := os.Open(p)
-			if err != nil {
-				continue
-			}
-			header, _ := zip.FileInfoHeader(s)
-			header.Name = filepath.Base(p)
-			dst, _ := w.CreateHeader(header)
-			io.Copy(dst, src)
-			src.Close()
-		}
+	if strings.Contains(r.Header.Get("Content-Type"), "json") {
+		return "json"
 	}
-	return nil
+	return "csv"
 }
 
-func handleBackupHandler(w http.ResponseWriter, r *http.Request) {
-	backupMutex.Lock()
-	defer backupMutex.Unlock()
-
-	id := generateBackupID()
-	filename := id + ".zip"
-	temp := filepath.Join(BackupDir, filename)
-
-	files := []string{
-		ConfigFile, UserDB, DomainFile, ApiKeyFile,
-		"/etc/zivpn/bot-config.json",
-		"/etc/zivpn/zivpn.crt",
-		"/etc/zivpn/zivpn.key",
+func importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
 	}
-
-	_ = createZip(temp, files)
-
-	if _, err := exec.Command("rclone", "copy", temp, RcloneRemote).CombinedOutput(); err != nil {
-		jsonResponse(w, 500, false, "Upload failed", nil)
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxImportSize+1))
+	if err != nil {
+		jsonResponse(w, 400, false, "Read body error", nil)
+		return
+	}
+	if len(body) > maxImportSize {
+		jsonResponse(w, 413, false, fmt.Sprintf("Import exceeds %d MB", maxImportSize>>20), nil)
 		return
 	}
 
-	list, err := exec.Command("rclone", "lsjson", RcloneRemote).Output()
+	var rows []ImportRow
+	switch importFormat(r) {
+	case "csv":
+		rows, err = parseImportCSV(body)
+	case "json":
+		rows, err = parseImportJSON(body)
+	default:
+		jsonResponse(w, 400, false, "Unknown format, use csv or json", nil)
+		return
+	}
 	if err != nil {
-		jsonResponse(w, 500, false, "Failed reading drive list", nil)
+		jsonResponse(w, 400, false, "Parse error: "+err.Error(), nil)
 		return
 	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	mutex.Lock()
+	defer mutex.Unlock()
 
-	var driveFiles []map[string]interface{}
-	json.Unmarshal(list, &driveFiles)
+	cfg, err := loadConfig()
+	if err != nil {
+		jsonResponse(w, 500, false, "Read config error", nil)
+		return
+	}
+	exists := map[string]bool{}
+	for _, p := range cfg.Auth.Config {
+		exists[p] = true
+	}
+	users, _ := loadUsers()
+	for _, l := range users {
+		exists[strings.TrimSpace(strings.Split(l, "|")[0])] = true
+	}
 
-	var fileID string
-	for _, f := range driveFiles {
-		if f["Name"] == filename {
-			if idStr, ok := f["ID"].(string); ok {
-				fileID = idStr
+	rep := ImportReport{DryRun: dryRun, Total: len(rows), Rows: make([]ImportRow, 0, len(rows))}
+	today := time.Now().Format("2006-01-02")
+	seen := map[string]int{}
+	var lines []string
+	for _, row := range rows {
+		row.Note = strings.NewReplacer("|", "/", "\n", " ", "\r", " ").Replace(row.Note)
+		switch {
+		case !validPassword(row.Password):
+			row.Status, row.Reason = "invalid", "invalid password"
+		case exists[row.Password]:
+			row.Status, row.Reason = "skipped", "user exists"
+		case seen[row.Password] > 0:
+			row.Status, row.Reason = "skipped", fmt.Sprintf("duplicate of line %d", seen[row.Password])
+		default:
+			exp, err := parseImportExpiry(row.Expired)
+			if err != nil {
+				row.Status, row.Reason = "invalid", err.Error()
+				break
+			}
+			state, err := importUserStatus(row.UserStatus, exp, today)
+			if err != nil {
+				row.Status, row.Reason = "invalid", err.Error()
 				break
 			}
+			row.Expired, row.UserStatus = exp, state
+			row.Status = "imported"
+			seen[row.Password] = row.Line
+			line := fmt.Sprintf("%s | %s", row.Password, exp)
+			if row.Note != "" {
+				line += " | " + row.Note
+			}
+			lines = append(lines, line)
+			if state == "active" {
+				cfg.Auth.Config = append(cfg.Auth.Config, row.Password)
+			}
 		}
+		switch row.Status {
+		case "imported":
+			rep.Imported++
+		case "skipped":
+			rep.Skipped++
+		default:
+			rep.Invalid++
+		}
+		rep.Rows = append(rep.Rows, row)
 	}
 
-	if fileID == "" {
-		jsonResponse(w, 500, false, "Unable to detect Google Drive file ID", nil)
+	if dryRun || rep.Imported == 0 {
+		jsonResponse(w, 200, true, fmt.Sprintf("%d users would be imported", rep.Imported), rep)
 		return
 	}
 
-	downloadURL := fmt.Sprintf("https://drive.google.com/uc?id=%s&export=download", fileID)
+	if err := saveUsers(append(users, lines...)); err != nil {
+		jsonResponse(w, 500, false, "Save users error", nil)
+		return
+	}
+	if err := saveConfig(cfg); err != nil {
+		_ = saveUsers(users)
+		jsonResponse(w, 500, false, "Save config error", nil)
+		return
+	}
+	var imported []string
+	for _, row := range rep.Rows {
+		if row.Status == "imported" {
+			imported = append(imported, row.Password)
+		}
+	}
+	userChanged(imported...)
+	go restartAll()
 
-	os.Remove(temp)
+	jsonResponse(w, 200, true, fmt.Sprintf("%d users imported", rep.Imported), rep)
+}
 
-	jsonResponse(w, 200, true, "Backup success", map[string]string{
-		"backup_id":    fileID,
-		"filename":     filename,
-		"download_url": downloadURL,
-	})
+type ExportUser struct {
+	Password string `json:"password"`
+	Expired  string `json:"expired"`
+	Note     string `json:"note,omitempty"`
+	Status   string `json:"status"`
 }
 
-func listBackupsHandler(w http.ResponseWriter, r *http.Request) {
-	out, err := exec.Command("rclone", "lsjson", RcloneRemote).Output()
-	if err != nil {
-		jsonResponse(w, 500, false, err.Error(), nil)
-		return
+func exportUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, _ := loadUsers()
+	enabled := map[string]bool{}
+	if cfg, err := loadConfig(); err == nil {
+		for _, p := range cfg.Auth.Config {
+			enabled[p] = true
+		}
 	}
+	today := time.Now().Format("2006-01-02")
 
-	var arr []map[string]interface{}
-	json.Unmarshal(out, &arr)
-
-	var res []map[string]interface{}
-	for _, f := range arr {
-		name, ok := f["Name"].(string)
-		if !ok || !strings.HasSuffix(name, ".zip") {
+	out := []ExportUser{}
+	for _, l := range users {
+		parts := strings.Split(l, "|")
+		if len(parts) < 2 {
 			continue
 		}
-
-		fileID := ""
-		if idStr, ok := f["ID"].(string); ok {
-			fileID = idStr
+		u := ExportUser{Password: strings.TrimSpace(parts[0]), Expired: strings.TrimSpace(parts[1]), Status: "active"}
+		if len(parts) > 2 {
+			u.Note = strings.TrimSpace(strings.Join(parts[2:], "|"))
 		}
+		switch {
+		case u.Expired < today:
+			u.Status = "expired"
+		case !enabled[u.Password]:
+			u.Status = "suspended"
+		}
+		out = append(out, u)
+	}
 
-		downloadURL := fmt.Sprintf("https://drive.google.com/uc?id=%s&export=download", fileID)
+	name := "zivpn-users-" + time.Now().Format("20060102")
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "", "json":
+		// A bare array, so the file can be sent back to /api/users/import.
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"password", "expiry", "note", "status"})
+		for _, u := range out {
+			cw.Write([]string{u.Password, u.Expired, u.Note, u.Status})
+		}
+		cw.Flush()
+	default:
+		jsonResponse(w, 400, false, "Unknown format, use csv or json", nil)
+	}
+}
 
-		res = append(res, map[string]interface{}{
-			"id":           fileID,
-			"filename":     name,
-			"size":         f["Size"],
-			"download_url": downloadURL,
-		})
+func isActive(service string) bool {
+	out, err := exec.Command("systemctl", "is-active", service).Output()
+	if err != nil {
+		return false
 	}
+	return strings.TrimSpace(string(out)) == "active"
+}
 
-	jsonResponse(w, 200, true, "OK", res)
+type MemStats struct {
+	Total     uint64  `json:"total"`
+	Used      uint64  `json:"used"`
+	Available uint64  `json:"available"`
+	Percent   float64 `json:"percent"`
 }
 
-func restoreHandler(w http.ResponseWriter, r *http.Request) {
-	var req BackupRequest
-	_ = json.NewDecoder(r.Body).Decode(&req)
+type DiskStats struct {
+	Path    string  `json:"path"`
+	Total   uint64  `json:"total"`
+	Used    uint64  `json:"used"`
+	Free    uint64  `json:"free"`
+	Percent float64 `json:"percent"`
+}
 
-	if req.BackupID == "" {
-		jsonResponse(w, 400, false, "Invalid backup ID", nil)
-		return
-	}
+type LoadStats struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+type IfaceStats struct {
+	Name    string   `json:"name"`
+	Addrs   []string `json:"addrs"`
+	RxBytes uint64   `json:"rx_bytes"`
+	TxBytes uint64   `json:"tx_bytes"`
+}
+
+type SystemStats struct {
+	Hostname   string       `json:"hostname"`
+	OS         string       `json:"os"`
+	Kernel     string       `json:"kernel"`
+	CPUModel   string       `json:"cpu"`
+	Cores      int          `json:"cores"`
+	Memory     MemStats     `json:"memory"`
+	Disk       DiskStats    `json:"disk"`
+	Load       LoadStats    `json:"load"`
+	Uptime     uint64       `json:"uptime_seconds"`
+	PrivateIP  string       `json:"private_ip"`
+	Interfaces []IfaceStats `json:"interfaces"`
+}
 
-	tmp := "/tmp/restore.zip"
-	
-	driveURL := fmt.Sprintf("https://drive.google.com/uc?id=%s&export=download", req.BackupID)
-	
-	cmd := exec.Command("wget", "--quiet", "--show-progress", "-O", tmp, driveURL)
-	output, err := cmd.CombinedOutput()
-	
+func readProcFile(path string) string {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		cmd = exec.Command("curl", "-L", "-o", tmp, driveURL)
-		output, err = cmd.CombinedOutput()
-		
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func readMemInfo() MemStats {
+	var m MemStats
+	vals := map[string]uint64{}
+	for _, line := range strings.Split(readProcFile("/proc/meminfo"), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(f[1], 10, 64)
 		if err != nil {
-			cmd = exec.Command(
-				"rclone",
-				"copyto",
-				fmt.Sprintf("drive:/%s", req.BackupID),
-				tmp,
-			)
-			output, err = cmd.CombinedOutput()
-			
-			if err != nil {
-				jsonResponse(w, 500, false, 
-					fmt.Sprintf("Download failed: %s\nOutput: %s", err.Error(), string(output)), 
-					nil)
-				return
-			}
+			continue
 		}
+		vals[strings.TrimSuffix(f[0], ":")] = n * 1024
 	}
-
-	z, err := zip.OpenReader(tmp)
-	if err != nil {
-		jsonResponse(w, 500, false, err.Error(), nil)
-		return
+	m.Total = vals["MemTotal"]
+	if v, ok := vals["MemAvailable"]; ok {
+		m.Available = v
+	} else {
+		m.Available = vals["MemFree"] + vals["Buffers"] + vals["Cached"]
 	}
-	defer z.Close()
-
-	for _, f := range z.File {
-		dst := filepath.Join("/etc/zivpn", f.Name)
-		os.MkdirAll(filepath.Dir(dst), 0755)
-
-		rc, _ := f.Open()
-		out, _ := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode())
-		io.Copy(out, rc)
-		out.Close()
-		rc.Close()
+	if m.Total > m.Available {
+		m.Used = m.Total - m.Available
 	}
+	if m.Total > 0 {
+		m.Percent = round2(float64(m.Used) * 100 / float64(m.Total))
+	}
+	return m
+}
 
-	os.Remove(tmp)
-	go restartAll()
+func readCPUModel() string {
+	for _, line := range strings.Split(readProcFile("/proc/cpuinfo"), "\n") {
+		if strings.HasPrefix(line, "model name") {
+			if i := strings.Index(line, ":"); i >= 0 {
+				return strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return ""
+}
 
-	jsonResponse(w, 200, true, "Restore completed successfully", nil)
+func readUptime() uint64 {
+	f := strings.Fields(readProcFile("/proc/uptime"))
+	if len(f) == 0 {
+		return 0
+	}
+	v, _ := strconv.ParseFloat(f[0], 64)
+	return uint64(v)
 }
 
-func cleanupOldBackupsHandler(w http.ResponseWriter, r *http.Request) {
-	out, err := exec.Command("rclone", "lsjson", RcloneRemote).Output()
-	if err != nil {
-		jsonResponse(w, 500, false, err.Error(), nil)
-		return
+func readLoadAvg() LoadStats {
+	var l LoadStats
+	f := strings.Fields(readProcFile("/proc/loadavg"))
+	if len(f) < 3 {
+		return l
 	}
+	l.Load1, _ = strconv.ParseFloat(f[0], 64)
+	l.Load5, _ = strconv.ParseFloat(f[1], 64)
+	l.Load15, _ = strconv.ParseFloat(f[2], 64)
+	return l
+}
 
-	var arr []map[string]interface{}
-	json.Unmarshal(out, &arr)
+func readDisk(path string) DiskStats {
+	d := DiskStats{Path: path}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return d
+	}
+	bs := uint64(st.Bsize)
+	d.Total = st.Blocks * bs
+	d.Free = st.Bavail * bs
+	d.Used = d.Total - st.Bfree*bs
+	if used := d.Used + d.Free; used > 0 {
+		d.Percent = round2(float64(d.Used) * 100 / float64(used))
+	}
+	return d
+}
 
-	now := time.Now()
-	deleted := 0
+func readOSName() string {
+	for _, line := range strings.Split(readProcFile("/etc/os-release"), "\n") {
+		if strings.HasPrefix(line, "PRETTY_NAME=") {
+			return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"`)
+		}
+	}
+	return readProcFile("/proc/sys/kernel/ostype")
+}
 
-	for _, x := range arr {
-		n, ok := x["Name"].(string)
-		if !ok || !strings.HasSuffix(n, ".zip") {
+func readNetDev() map[string][2]uint64 {
+	out := map[string][2]uint64{}
+	for _, line := range strings.Split(readProcFile("/proc/net/dev"), "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
 			continue
 		}
-		tm, _ := time.Parse(time.RFC3339, x["ModTime"].(string))
-		if now.Sub(tm).Hours() > 168 {
-			exec.Command("rclone", "delete", RcloneRemote+"/"+n).Run()
-			deleted++
+		f := strings.Fields(line[i+1:])
+		if len(f) < 9 {
+			continue
 		}
+		rx, _ := strconv.ParseUint(f[0], 10, 64)
+		tx, _ := strconv.ParseUint(f[8], 10, 64)
+		out[strings.TrimSpace(line[:i])] = [2]uint64{rx, tx}
 	}
-
-	jsonResponse(w, 200, true, "Cleanup OK", map[string]int{
-		"deleted": deleted,
-	})
+	return out
 }
 
-func toggleAutoBackupHandler(w http.ResponseWriter, r *http.Request) {
-	cfg := AutoBackupCfg{Enabled: false, Schedule: "0 2 * * *"}
-
-	if b, err := ioutil.ReadFile(AutoBackupFile); err == nil {
-		json.Unmarshal(b, &cfg)
+func readInterfaces() ([]IfaceStats, string) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, ""
 	}
-
-	cfg.Enabled = !cfg.Enabled
-
-	b, _ := json.MarshalIndent(cfg, "", "  ")
-	_ = ioutil.WriteFile(AutoBackupFile, b, 0644)
-
-	if cfg.Enabled {
-		_ = ioutil.WriteFile("/etc/cron.d/zivpn-backup",
-			[]byte(cfg.Schedule+" root /usr/local/bin/zivpn-backup\n"), 0644)
-	} else {
-		_ = os.Remove("/etc/cron.d/zivpn-backup")
+	counters := readNetDev()
+	var out []IfaceStats
+	private := ""
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagLoopback != 0 || ifc.Flags&net.FlagUp == 0 {
+			continue
+		}
+		s := IfaceStats{Name: ifc.Name, Addrs: []string{}}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			s.Addrs = append(s.Addrs, ipn.IP.String())
+			if private == "" && ipn.IP.To4() != nil {
+				private = ipn.IP.String()
+			}
+		}
+		if c, ok := counters[ifc.Name]; ok {
+			s.RxBytes, s.TxBytes = c[0], c[1]
+		}
+		out = append(out, s)
 	}
+	return out, private
+}
 
-	jsonResponse(w, 200, true, "OK", cfg)
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
 }
 
-func getAutoBackupStatusHandler(w http.ResponseWriter, r *http.Request) {
-	cfg := AutoBackupCfg{Enabled: false, Schedule: "0 2 * * *"}
-	if b, err := ioutil.ReadFile(AutoBackupFile); err == nil {
-		json.Unmarshal(b, &cfg)
+func collectSystemStats() SystemStats {
+	host, _ := os.Hostname()
+	ifaces, private := readInterfaces()
+	return SystemStats{
+		Hostname:   host,
+		OS:         readOSName(),
+		Kernel:     readProcFile("/proc/sys/kernel/osrelease"),
+		CPUModel:   readCPUModel(),
+		Cores:      runtime.NumCPU(),
+		Memory:     readMemInfo(),
+		Disk:       readDisk("/"),
+		Load:       readLoadAvg(),
+		Uptime:     readUptime(),
+		PrivateIP:  private,
+		Interfaces: ifaces,
 	}
-	jsonResponse(w, 200, true, "OK", cfg)
 }
 
-func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+// cachedValue memoizes a slow lookup (network call, remote listing) for ttl.
+// A failed lookup is not retried for errTTL (default one minute); until
+// then the last good value, or nil, is returned.
+type cachedValue struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	errTTL  time.Duration
+	fetched time.Time
+	failed  time.Time
+	value   interface{}
+	fetch   func() (interface{}, error)
+}
 
-	if b, err := ioutil.ReadFile(ApiKeyFile); err == nil {
-		AuthToken = strings.TrimSpace(string(b))
+func (c *cachedValue) get() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.value != nil && time.Since(c.fetched) < c.ttl {
+		return c.value
+	}
+	errTTL := c.errTTL
+	if errTTL == 0 {
+		errTTL = time.Minute
+	}
+	if time.Since(c.failed) < errTTL {
+		return c.value
+	}
+	v, err := c.fetch()
+	if err != nil {
+		c.failed = time.Now()
+		return c.value
+	}
+	c.value, c.fetched, c.failed = v, time.Now(), time.Time{}
+	return v
+}
+
+func (c *cachedValue) invalidate() {
+	c.mu.Lock()
+	c.fetched, c.failed = time.Time{}, time.Time{}
+	c.mu.Unlock()
+}
+
+var publicIPCache = &cachedValue{ttl: time.Hour, fetch: func() (interface{}, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("https://ifconfig.me/ip")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	ip := strings.TrimSpace(string(b))
+	if net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("unexpected response %q", ip)
+	}
+	return ip, nil
+}}
+
+var backupCountCache = &cachedValue{ttl: 10 * time.Minute, fetch: func() (interface{}, error) {
+	store, err := backupStore()
+	if err != nil {
+		return nil, err
+	}
+	list, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	return len(list), nil
+}}
+
+func getPublicIP() string {
+	if v, ok := publicIPCache.get().(string); ok {
+		return v
+	}
+	return ""
+}
+
+func getSystemInfoHandler(w http.ResponseWriter, r *http.Request) {
+	st := collectSystemStats()
+
+	backupCount := 0
+	if n, ok := backupCountCache.get().(int); ok {
+		backupCount = n
+	}
+
+	userCount := 0
+	if b, err := ioutil.ReadFile(UserDB); err == nil {
+		lines := strings.Split(string(b), "\n")
+		now := time.Now().Format("2006-01-02")
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || !strings.Contains(line, "|") {
+				continue
+			}
+			parts := strings.Split(line, "|")
+			if len(parts) >= 2 {
+				exp := strings.TrimSpace(parts[1])
+				if exp >= now {
+					userCount++
+				}
+			}
+		}
+	}
+
+	ports := portsStatus()
+
+	serviceStatus := "active"
+	if !isActive("zivpn") || !isActive("zivpn-api") || !isActive("zivpn-bot") {
+		serviceStatus = "inactive"
+	}
+
+	jsonResponse(w, 200, true, "OK", map[string]interface{}{
+		"public_ip":      getPublicIP(),
+		"private_ip":     st.PrivateIP,
+		"domain":         getDomain(),
+		"hostname":       st.Hostname,
+		"os":             st.OS,
+		"kernel":         st.Kernel,
+		"cpu":            st.CPUModel,
+		"cores":          st.Cores,
+		"memory":         st.Memory,
+		"disk":           st.Disk,
+		"load":           st.Load,
+		"uptime_seconds": st.Uptime,
+		"interfaces":     st.Interfaces,
+		"port":           portSummary(ports),
+		"ports":          ports,
+		"service":        serviceStatus,
+		"server_time":    time.Now().Format("2006-01-02 15:04:05"),
+		"backup_count":   backupCount,
+		"user_count":     userCount,
+		"license":        currentLicense(),
+	})
+}
+
+var (
+	LicenseFile      = "/etc/zivpn/license.json"
+	LicenseStateFile = "/etc/zivpn/license-state.json"
+	IzinFile         = "/etc/zivpn/izin"
+)
+
+const (
+	maxAllowlistSize = 1 << 20
+
+	licenseDisabled     = "disabled"
+	licenseActive       = "active"
+	licenseGrace        = "grace"
+	licenseExpired      = "expired"
+	licenseUnauthorized = "unauthorized"
+	licenseUnknown      = "unknown"
+)
+
+// LicenseCfg points at the izin allowlist ("IP YYYY-MM-DD" per line), a
+// local file or an http(s) URL. IP overrides the detected public IP for
+// servers behind NAT. Without license.json, /etc/zivpn/izin is used when
+// present; otherwise licensing is disabled.
+type LicenseCfg struct {
+	Source    string `json:"source"`
+	GraceDays int    `json:"grace_days"`
+	IP        string `json:"ip,omitempty"`
+}
+
+type LicenseStatus struct {
+	State      string    `json:"state"`
+	IP         string    `json:"ip,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Expires    string    `json:"expires,omitempty"`
+	GraceDays  int       `json:"grace_days"`
+	GraceUntil string    `json:"grace_until,omitempty"`
+	DaysLeft   int       `json:"days_left"`
+	Checked    time.Time `json:"checked"`
+	Verified   time.Time `json:"verified"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var (
+	licenseMutex = &sync.Mutex{}
+	license      LicenseStatus
+)
+
+func loadLicenseCfg() LicenseCfg {
+	cfg := LicenseCfg{GraceDays: 3}
+	if b, err := ioutil.ReadFile(LicenseFile); err == nil {
+		_ = json.Unmarshal(b, &cfg)
+	} else if _, err := os.Stat(IzinFile); err == nil {
+		cfg.Source = IzinFile
+	}
+	return cfg
+}
+
+// parseAllowlist reads "IP YYYY-MM-DD" lines. Blank lines, comments and
+// malformed lines are skipped; a repeated IP keeps its latest date.
+func parseAllowlist(data []byte) map[string]string {
+	out := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || strings.HasPrefix(f[0], "#") || net.ParseIP(f[0]) == nil {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", f[1]); err != nil {
+			continue
+		}
+		if f[1] > out[f[0]] {
+			out[f[0]] = f[1]
+		}
+	}
+	return out
+}
+
+func readAllowlist(source string) (map[string]string, error) {
+	var data []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 15 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", source, resp.Status)
+		}
+		if data, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxAllowlistSize)); err != nil {
+			return nil, err
+		}
+	} else {
+		b, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	}
+	list := parseAllowlist(data)
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%s: no valid entries", source)
+	}
+	return list, nil
+}
+
+// evaluate derives State, DaysLeft and GraceUntil from Expires at now.
+// The license is valid through the expiry date itself.
+func (st *LicenseStatus) evaluate(now time.Time) {
+	if st.State == licenseDisabled || st.State == licenseUnknown {
+		return
+	}
+	if st.Expires == "" {
+		st.State = licenseUnauthorized
+		return
+	}
+	exp, err := time.ParseInLocation("2006-01-02", st.Expires, time.Local)
+	if err != nil {
+		st.State = licenseUnauthorized
+		return
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	graceEnd := exp.AddDate(0, 0, st.GraceDays)
+	st.GraceUntil = graceEnd.Format("2006-01-02")
+	st.DaysLeft = int(math.Round(exp.Sub(today).Hours() / 24))
+	switch {
+	case !today.After(exp):
+		st.State = licenseActive
+	case !today.After(graceEnd):
+		st.State = licenseGrace
+	default:
+		st.State = licenseExpired
+	}
+}
+
+// checkLicense looks this server up in the allowlist. When the source or
+// the public IP is unavailable, the last verified result for the same IP
+// is reused, so going offline neither unlocks nor locks the server.
+func checkLicense(prev LicenseStatus) LicenseStatus {
+	cfg := loadLicenseCfg()
+	st := LicenseStatus{Source: cfg.Source, GraceDays: cfg.GraceDays, Checked: time.Now()}
+	if cfg.Source == "" {
+		st.State = licenseDisabled
+		return st
+	}
+	st.IP = cfg.IP
+	if st.IP == "" {
+		st.IP = getPublicIP()
+	}
+
+	list, err := readAllowlist(cfg.Source)
+	if err == nil && st.IP == "" {
+		err = fmt.Errorf("cannot determine public IP")
+	}
+	if err != nil {
+		st.Error = err.Error()
+		if prev.Verified.IsZero() || prev.Source != cfg.Source || (st.IP != "" && st.IP != prev.IP) {
+			st.State = licenseUnknown
+			return st
+		}
+		st.IP, st.Expires, st.Verified = prev.IP, prev.Expires, prev.Verified
+	} else {
+		st.Expires = list[st.IP]
+		st.Verified = st.Checked
+	}
+	st.evaluate(st.Checked)
+	return st
+}
+
+// refreshLicense re-checks the license and tells the admin when the
+// state changes. It runs at startup and hourly as the "license" job.
+func refreshLicense() error {
+	licenseMutex.Lock()
+	prev := license
+	licenseMutex.Unlock()
+
+	st := checkLicense(prev)
+
+	licenseMutex.Lock()
+	license = st
+	licenseMutex.Unlock()
+	b, _ := json.MarshalIndent(st, "", "  ")
+	if err := writeFileAtomic(LicenseStateFile, b, 0600); err != nil {
+		log.Println("license state:", err)
+	}
+
+	if st.State != prev.State && st.State != licenseUnknown {
+		if text := licenseAlert(st, prev); text != "" {
+			_ = notifyAdmin(text)
+		}
+	}
+	if st.Error != "" {
+		return fmt.Errorf("%s", st.Error)
+	}
+	return nil
+}
+
+func licenseAlert(st, prev LicenseStatus) string {
+	switch st.State {
+	case licenseGrace:
+		return fmt.Sprintf("⚠️ *LISENSI HABIS*\n━━━━━━━━━━━━━━━━━━━━\n🌍 *IP:* `%s`\n📅 *Expired:* %s\n⏳ *Masa tenggang s/d:* %s\n━━━━━━━━━━━━━━━━━━━━\n_Perpanjang lisensi sebelum masa tenggang berakhir, setelah itu menu manajemen dikunci._",
+			st.IP, st.Expires, st.GraceUntil)
+	case licenseExpired:
+		return fmt.Sprintf("⛔ *LISENSI BERAKHIR*\n━━━━━━━━━━━━━━━━━━━━\n🌍 *IP:* `%s`\n📅 *Expired:* %s\n━━━━━━━━━━━━━━━━━━━━\n_Buat/hapus/renew akun dan pengaturan server dikunci sampai lisensi diperpanjang._",
+			st.IP, st.Expires)
+	case licenseUnauthorized:
+		return fmt.Sprintf("⛔ *IP TIDAK TERDAFTAR*\n━━━━━━━━━━━━━━━━━━━━\n🌍 *IP:* `%s`\n📄 *Sumber:* `%s`\n━━━━━━━━━━━━━━━━━━━━\n_Menu manajemen dikunci sampai IP ini ditambahkan ke daftar izin._",
+			st.IP, st.Source)
+	case licenseActive:
+		if prev.State == licenseGrace || prev.State == licenseExpired || prev.State == licenseUnauthorized {
+			return fmt.Sprintf("✅ *LISENSI AKTIF*\n━━━━━━━━━━━━━━━━━━━━\n🌍 *IP:* `%s`\n📅 *Berlaku s/d:* %s", st.IP, st.Expires)
+		}
+	}
+	return ""
+}
+
+// loadLicense restores the last result from disk so the state is enforced
+// right after a restart, before the first check has finished.
+func loadLicense() {
+	var st LicenseStatus
+	if b, err := ioutil.ReadFile(LicenseStateFile); err == nil {
+		_ = json.Unmarshal(b, &st)
+	}
+	licenseMutex.Lock()
+	license = st
+	licenseMutex.Unlock()
+}
+
+// currentLicense returns the last check re-evaluated against today, so an
+// expiry takes effect without waiting for the next refresh.
+func currentLicense() LicenseStatus {
+	licenseMutex.Lock()
+	st := license
+	licenseMutex.Unlock()
+	if st.State == "" {
+		st.State = licenseUnknown
+	}
+	st.evaluate(time.Now())
+	return st
+}
+
+// licenseBlocked reports whether management calls must be refused.
+func licenseBlocked() (string, bool) {
+	st := currentLicense()
+	switch st.State {
+	case licenseExpired:
+		return fmt.Sprintf("License for %s expired on %s (grace period ended %s); management is disabled until it is renewed", st.IP, st.Expires, st.GraceUntil), true
+	case licenseUnauthorized:
+		return fmt.Sprintf("Server IP %s is not in the license allowlist; management is disabled", st.IP), true
+	}
+	return "", false
+}
+
+type LicenseRequest struct {
+	Source    string `json:"source"`
+	GraceDays *int   `json:"grace_days"`
+	IP        string `json:"ip"`
+}
+
+// licenseHandler serves GET (status, ?refresh=1 to re-check) and POST
+// (change the allowlist source) on /api/license. While the license is
+// locked, POST may not change the source or IP or extend the grace period.
+func licenseHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("refresh") != "" {
+			_ = refreshLicense()
+		}
+		jsonResponse(w, 200, true, "OK", currentLicense())
+	case http.MethodPost:
+		var req LicenseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonResponse(w, 400, false, "Invalid request", nil)
+			return
+		}
+		old := loadLicenseCfg()
+		cfg := old
+		cfg.Source, cfg.IP = strings.TrimSpace(req.Source), strings.TrimSpace(req.IP)
+		if req.GraceDays != nil {
+			cfg.GraceDays = *req.GraceDays
+		}
+		// A locked server could otherwise unlock itself by pointing at
+		// another allowlist, claiming another IP or stretching the grace.
+		if _, blocked := licenseBlocked(); blocked && (cfg.Source != old.Source || cfg.IP != old.IP || cfg.GraceDays > old.GraceDays) {
+			jsonResponse(w, 403, false, "License is locked; source, ip and grace_days cannot be changed until it is renewed", nil)
+			return
+		}
+		if cfg.GraceDays < 0 || cfg.GraceDays > 90 {
+			jsonResponse(w, 400, false, "grace_days must be 0-90", nil)
+			return
+		}
+		if cfg.IP != "" && net.ParseIP(cfg.IP) == nil {
+			jsonResponse(w, 400, false, "Invalid ip", nil)
+			return
+		}
+		if cfg.Source != "" {
+			if u, err := url.Parse(cfg.Source); err != nil || (!filepath.IsAbs(cfg.Source) && u.Scheme != "http" && u.Scheme != "https") {
+				jsonResponse(w, 400, false, "source must be an absolute path or an http(s) URL", nil)
+				return
+			}
+			if _, err := readAllowlist(cfg.Source); err != nil {
+				jsonResponse(w, 400, false, "Cannot read allowlist: "+err.Error(), nil)
+				return
+			}
+		}
+		b, _ := json.MarshalIndent(cfg, "", "  ")
+		if err := writeFileAtomic(LicenseFile, b, 0644); err != nil {
+			jsonResponse(w, 500, false, "Save license config error", nil)
+			return
+		}
+		_ = refreshLicense()
+		jsonResponse(w, 200, true, "License config saved", currentLicense())
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+	}
+}
+
+const (
+	CorePort       = 5667
+	ConntrackProc  = "/proc/net/nf_conntrack"
+	OnlineIdleTime = 2 * time.Minute
+)
+
+type Session struct {
+	ClientIP  string    `json:"client_ip"`
+	Account   string    `json:"account"`
+	Flows     int       `json:"flows"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	RxBytes   uint64    `json:"rx_bytes"`
+	TxBytes   uint64    `json:"tx_bytes"`
+}
+
+type coreEvent struct {
+	Time    time.Time
+	Level   string
+	Message string
+	Fields  map[string]interface{}
+}
+
+// parseCoreLine parses a zivpn core log line of the form
+// "LEVEL message {json fields}" with an optional leading timestamp.
+func parseCoreLine(line string) (coreEvent, bool) {
+	ev := coreEvent{Fields: map[string]interface{}{}}
+	line = strings.TrimSpace(line)
+	if i := strings.Index(line, "{"); i >= 0 && strings.HasSuffix(line, "}") {
+		if json.Unmarshal([]byte(line[i:]), &ev.Fields) == nil {
+			line = strings.TrimSpace(line[:i])
+		}
+	}
+	f := strings.Fields(line)
+	for i, w := range f {
+		switch strings.ToUpper(w) {
+		case "DEBUG", "INFO", "WARN", "WARNING", "ERROR", "FATAL":
+			ev.Level = strings.ToLower(strings.TrimSuffix(strings.ToUpper(w), "ING"))
+			ev.Message = strings.Join(f[i+1:], " ")
+			if i > 0 {
+				for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.000Z0700", "2006/01/02 15:04:05"} {
+					if t, err := time.Parse(layout, strings.Join(f[:i], " ")); err == nil {
+						ev.Time = t
+						break
+					}
+				}
+			}
+			return ev, true
+		}
+	}
+	return ev, false
+}
+
+func (ev coreEvent) field(keys ...string) string {
+	for _, k := range keys {
+		if v, ok := ev.Fields[k]; ok {
+			if s := strings.TrimSpace(fmt.Sprintf("%v", v)); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+func (ev coreEvent) clientIP() string {
+	addr := ev.field("addr", "src", "remote", "client")
+	if addr == "" {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (ev coreEvent) account() string {
+	return ev.field("auth", "user", "password", "id")
+}
+
+// recentAccounts maps client IPs to the account they last authenticated as
+// during the past hour, based on the ingested core log.
+func recentAccounts() map[string]string {
+	out := map[string]string{}
+	since := time.Now().Add(-time.Hour)
+	for _, r := range coreLogs.snapshot() {
+		if r.Time.Before(since) {
+			continue
+		}
+		if r.ClientIP != "" && r.User != "" {
+			out[r.ClientIP] = r.User
+		}
+	}
+	return out
+}
+
+const (
+	LogIngestFile = "/etc/zivpn/log-ingest.json"
+	LogDir        = "/etc/zivpn/logs"
+)
+
+type LogIngestCfg struct {
+	Source    string `json:"source"`
+	Path      string `json:"path"`
+	RingSize  int    `json:"ring_size"`
+	MaxFileMB int    `json:"max_file_mb"`
+	KeepFiles int    `json:"keep_files"`
+}
+
+type LogRecord struct {
+	Time     time.Time              `json:"time"`
+	Level    string                 `json:"level"`
+	Event    string                 `json:"event"`
+	User     string                 `json:"user,omitempty"`
+	ClientIP string                 `json:"client_ip,omitempty"`
+	Message  string                 `json:"message"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+}
+
+func loadLogIngestCfg() LogIngestCfg {
+	cfg := LogIngestCfg{Source: "journal", RingSize: 2000, MaxFileMB: 5, KeepFiles: 3}
+	if b, err := ioutil.ReadFile(LogIngestFile); err == nil {
+		_ = json.Unmarshal(b, &cfg)
+	}
+	if cfg.RingSize <= 0 {
+		cfg.RingSize = 2000
+	}
+	if cfg.MaxFileMB <= 0 {
+		cfg.MaxFileMB = 5
+	}
+	if cfg.KeepFiles <= 0 {
+		cfg.KeepFiles = 3
+	}
+	return cfg
+}
+
+// classifyEvent maps a core log line onto one of the event kinds exposed by
+// /api/logs.
+func classifyEvent(ev coreEvent) string {
+	msg := strings.ToLower(ev.Message)
+	switch {
+	case strings.Contains(msg, "auth") && (strings.Contains(msg, "fail") || strings.Contains(msg, "invalid") ||
+		strings.Contains(msg, "denied") || strings.Contains(msg, "reject")):
+		return "auth_failure"
+	case strings.Contains(msg, "auth"):
+		return "auth_success"
+	case strings.Contains(msg, "disconnect") || strings.Contains(msg, "closed"):
+		return "disconnect"
+	case strings.Contains(msg, "connect"):
+		return "connect"
+	case ev.Level == "error" || ev.Level == "fatal" || strings.Contains(msg, "error"):
+		return "error"
+	}
+	return "other"
+}
+
+func newLogRecord(ev coreEvent, at time.Time) LogRecord {
+	if ev.Time.IsZero() {
+		ev.Time = at
+	}
+	return LogRecord{
+		Time:     ev.Time,
+		Level:    ev.Level,
+		Event:    classifyEvent(ev),
+		User:     ev.account(),
+		ClientIP: ev.clientIP(),
+		Message:  ev.Message,
+		Fields:   ev.Fields,
+	}
+}
+
+// logRing keeps the most recent core log records in memory and mirrors them
+// to a size-rotated JSON lines file under LogDir.
+type logRing struct {
+	mu      sync.Mutex
+	records []LogRecord
+	next    int
+	full    bool
+	file    *os.File
+	size    int64
+	maxSize int64
+	keep    int
+}
+
+func newLogRing(cfg LogIngestCfg) *logRing {
+	return &logRing{
+		records: make([]LogRecord, cfg.RingSize),
+		maxSize: int64(cfg.MaxFileMB) * 1024 * 1024,
+		keep:    cfg.KeepFiles,
+	}
+}
+
+func (l *logRing) add(rec LogRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records[l.next] = rec
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.persist(rec)
+}
+
+func (l *logRing) persist(rec LogRecord) {
+	if l.file == nil {
+		if err := os.MkdirAll(LogDir, 0700); err != nil {
+			return
+		}
+		f, err := os.OpenFile(filepath.Join(LogDir, "core.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return
+		}
+		st, _ := f.Stat()
+		l.file, l.size = f, st.Size()
+	}
+	b, _ := json.Marshal(rec)
+	n, _ := l.file.Write(append(b, '\n'))
+	l.size += int64(n)
+	if l.size < l.maxSize {
+		return
+	}
+	l.file.Close()
+	l.file = nil
+	base := filepath.Join(LogDir, "core.log")
+	_ = os.Remove(fmt.Sprintf("%s.%d", base, l.keep))
+	for i := l.keep - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", base, i), fmt.Sprintf("%s.%d", base, i+1))
+	}
+	_ = os.Rename(base, base+".1")
+}
+
+// snapshot returns records oldest first.
+func (l *logRing) snapshot() []LogRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []LogRecord
+	if l.full {
+		out = append(out, l.records[l.next:]...)
+	}
+	return append(out, l.records[:l.next]...)
+}
+
+type logQuery struct {
+	User  string
+	Level string
+	Event string
+	Since time.Time
+	Limit int
+}
+
+func (l *logRing) query(q logQuery) []LogRecord {
+	all := l.snapshot()
+	out := []LogRecord{}
+	for i := len(all) - 1; i >= 0 && len(out) < q.Limit; i-- {
+		r := all[i]
+		if q.User != "" && r.User != q.User {
+			continue
+		}
+		if q.Level != "" && r.Level != q.Level {
+			continue
+		}
+		if q.Event != "" && r.Event != q.Event {
+			continue
+		}
+		if !q.Since.IsZero() && r.Time.Before(q.Since) {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+var coreLogs = newLogRing(loadLogIngestCfg())
+
+// followCoreLog feeds the ring from the zivpn.service journal, or from a
+// plain log file when source is "file". It restarts the reader if it exits.
+// The journal is resumed after the last cursor read (kept in LogDir across
+// API restarts) so no entry is ingested twice; a file is only followed
+// from its end.
+func followCoreLog(cfg LogIngestCfg) {
+	cursorFile := filepath.Join(LogDir, "journal.cursor")
+	cursor := ""
+	if b, err := ioutil.ReadFile(cursorFile); err == nil {
+		cursor = strings.TrimSpace(string(b))
+	}
+	saved := cursor
+	saveCursor := func() {
+		if cursor != saved && os.MkdirAll(LogDir, 0700) == nil {
+			if writeFileAtomic(cursorFile, []byte(cursor+"\n"), 0600) == nil {
+				saved = cursor
+			}
+		}
+	}
+
+	for {
+		var cmd *exec.Cmd
+		if cfg.Source == "file" && cfg.Path != "" {
+			cmd = exec.Command("tail", "-n", "0", "-F", cfg.Path)
+		} else {
+			args := []string{"-u", "zivpn.service", "-f", "-o", "json", "--no-pager"}
+			if cursor != "" {
+				args = append(args, "--after-cursor", cursor)
+			} else {
+				args = append(args, "--since", "-1h")
+			}
+			cmd = exec.Command("journalctl", args...)
+		}
+		out, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			log.Println("log follower:", err)
+			time.Sleep(30 * time.Second)
+			continue
+		}
+		sc := bufio.NewScanner(out)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		lastSave := time.Now()
+		for sc.Scan() {
+			if c := ingestLine(sc.Text(), cfg.Source != "file"); c != "" {
+				cursor = c
+				if time.Since(lastSave) > 5*time.Second {
+					saveCursor()
+					lastSave = time.Now()
+				}
+			}
+		}
+		saveCursor()
+		_ = cmd.Wait()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// ingestLine adds one line to coreLogs and returns its journal cursor,
+// if any.
+func ingestLine(line string, journal bool) string {
+	at := time.Now()
+	cursor := ""
+	if journal {
+		var entry struct {
+			Message   interface{} `json:"MESSAGE"`
+			Timestamp string      `json:"__REALTIME_TIMESTAMP"`
+			Cursor    string      `json:"__CURSOR"`
+		}
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			return ""
+		}
+		cursor = entry.Cursor
+		if us, err := strconv.ParseInt(entry.Timestamp, 10, 64); err == nil {
+			at = time.Unix(0, us*int64(time.Microsecond))
+		}
+		msg, ok := entry.Message.(string)
+		if !ok {
+			return cursor
+		}
+		line = msg
+	}
+	ev, ok := parseCoreLine(line)
+	if !ok {
+		return cursor
+	}
+	coreLogs.add(newLogRecord(ev, at))
+	return cursor
+}
+
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	q := logQuery{
+		User:  r.URL.Query().Get("user"),
+		Level: strings.ToLower(r.URL.Query().Get("level")),
+		Event: r.URL.Query().Get("event"),
+		Limit: 100,
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			jsonResponse(w, 400, false, "Invalid limit", nil)
+			return
+		}
+		q.Limit = n
+	}
+	if v := r.URL.Query().Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			q.Since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			q.Since = t
+		} else {
+			jsonResponse(w, 400, false, "Invalid since, use RFC3339 or a duration like 1h", nil)
+			return
+		}
+	}
+	jsonResponse(w, 200, true, "OK", coreLogs.query(q))
+}
+
+type conntrackFlow struct {
+	src     string
+	dport   int
+	rxBytes uint64
+	txBytes uint64
+}
+
+func isCorePort(p int) bool {
+	if p == CorePort {
+		return true
+	}
+	for _, r := range activeDNATRanges() {
+		if r.contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConntrack reads UDP flows in either `conntrack -L` or
+// /proc/net/nf_conntrack format. The first src/dport pair is the original
+// direction; byte counters are only present with nf_conntrack_acct enabled.
+func parseConntrack(data string) []conntrackFlow {
+	var out []conntrackFlow
+	for _, line := range strings.Split(data, "\n") {
+		if !strings.Contains(line, "udp") {
+			continue
+		}
+		var fl conntrackFlow
+		dport, srcSeen, bytesSeen := -1, false, 0
+		for _, tok := range strings.Fields(line) {
+			kv := strings.SplitN(tok, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "src":
+				if !srcSeen {
+					fl.src, srcSeen = kv[1], true
+				}
+			case "dport":
+				if dport < 0 {
+					dport, _ = strconv.Atoi(kv[1])
+				}
+			case "bytes":
+				n, _ := strconv.ParseUint(kv[1], 10, 64)
+				if bytesSeen == 0 {
+					fl.rxBytes = n
+				} else {
+					fl.txBytes = n
+				}
+				bytesSeen++
+			}
+		}
+		fl.dport = dport
+		if fl.src != "" && isCorePort(dport) {
+			out = append(out, fl)
+		}
+	}
+	return out
+}
+
+func readConntrack() []conntrackFlow {
+	if b, err := exec.Command("conntrack", "-L", "-p", "udp").Output(); err == nil {
+		return parseConntrack(string(b))
+	}
+	if b, err := ioutil.ReadFile(ConntrackProc); err == nil {
+		return parseConntrack(string(b))
+	}
+	return nil
+}
+
+type onlineTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+var online = &onlineTracker{sessions: make(map[string]*Session)}
+
+func (o *onlineTracker) refresh() []Session {
+	flows := readConntrack()
+	accounts := recentAccounts()
+	now := time.Now()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	seen := map[string]*Session{}
+	for _, fl := range flows {
+		s, ok := seen[fl.src]
+		if !ok {
+			s = &Session{ClientIP: fl.src, FirstSeen: now}
+			if prev, ok := o.sessions[fl.src]; ok {
+				s.FirstSeen = prev.FirstSeen
+				s.Account = prev.Account
+			}
+			seen[fl.src] = s
+		}
+		s.Flows++
+		s.RxBytes += fl.rxBytes
+		s.TxBytes += fl.txBytes
+		s.LastSeen = now
+		if acc, ok := accounts[fl.src]; ok {
+			s.Account = acc
+		}
+	}
+	for ip, prev := range o.sessions {
+		if _, ok := seen[ip]; !ok && now.Sub(prev.LastSeen) < OnlineIdleTime {
+			seen[ip] = prev
+		}
+	}
+	o.sessions = seen
+
+	out := make([]Session, 0, len(seen))
+	for _, s := range seen {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].FirstSeen.Before(out[j].FirstSeen) })
+	return out
+}
+
+func onlineHandler(w http.ResponseWriter, r *http.Request) {
+	sessions := online.refresh()
+	accounts := map[string]bool{}
+	for _, s := range sessions {
+		if s.Account != "" {
+			accounts[s.Account] = true
+		}
+	}
+	jsonResponse(w, 200, true, "OK", map[string]interface{}{
+		"sessions": sessions,
+		"clients":  len(sessions),
+		"accounts": len(accounts),
+	})
+}
+
+const (
+	BanFile        = "/etc/zivpn/bans.json"
+	BanChain       = "ZIVPN-BAN"
+	BanTable       = "zivpn_ban"
+	DefaultBanMins = 60
+)
+
+type Ban struct {
+	IP      string    `json:"ip"`
+	Account string    `json:"account,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+type KickRequest struct {
+	IP      string `json:"ip"`
+	Account string `json:"account"`
+	Minutes int    `json:"minutes"`
+	Reason  string `json:"reason"`
+}
+
+var banMutex = &sync.Mutex{}
+
+func loadBans() []Ban {
+	var bans []Ban
+	if b, err := ioutil.ReadFile(BanFile); err == nil {
+		_ = json.Unmarshal(b, &bans)
+	}
+	return bans
+}
+
+func saveBans(bans []Ban) error {
+	if bans == nil {
+		bans = []Ban{}
+	}
+	b, _ := json.MarshalIndent(bans, "", "  ")
+	return ioutil.WriteFile(BanFile, b, 0600)
+}
+
+func useNft() bool {
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return false
+	}
+	_, err := exec.LookPath("nft")
+	return err == nil
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func ipTool(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// banPorts are the UDP ports a ban covers: the core's listen port and the
+// forwarded ranges. SSH, the API and everything else stay reachable.
+func banPorts() []PortRange {
+	port := listenPort()
+	out := []PortRange{{port, port}}
+	for _, r := range activeDNATRanges() {
+		if r != (PortRange{port, port}) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// ensureBanChain creates the firewall objects that hold bans and scopes
+// them to banPorts. With iptables this is a ZIVPN-BAN chain jumped to from
+// INPUT for UDP on those ports; with nftables an inet table with one set
+// per address family. It is re-run whenever the ports change.
+func ensureBanChain() error {
+	ports := banPorts()
+	if useNft() {
+		_ = run("nft", "add", "table", "inet", BanTable)
+		_ = run("nft", "add", "set", "inet", BanTable, "ban4", "{ type ipv4_addr; }")
+		_ = run("nft", "add", "set", "inet", BanTable, "ban6", "{ type ipv6_addr; }")
+		if err := run("nft", "list", "chain", "inet", BanTable, "input"); err != nil {
+			if err := run("nft", "add", "chain", "inet", BanTable, "input", "{ type filter hook input priority -10; }"); err != nil {
+				return err
+			}
+		}
+		var list []string
+		for _, r := range ports {
+			list = append(list, r.String())
+		}
+		dports := "{ " + strings.Join(list, ", ") + " }"
+		if err := run("nft", "flush", "chain", "inet", BanTable, "input"); err != nil {
+			return err
+		}
+		if err := run("nft", "add", "rule", "inet", BanTable, "input", "ip", "saddr", "@ban4", "udp", "dport", dports, "drop"); err != nil {
+			return err
+		}
+		return run("nft", "add", "rule", "inet", BanTable, "input", "ip6", "saddr", "@ban6", "udp", "dport", dports, "drop")
+	}
+
+	// Jumps are written the way iptables -S prints them, so stale ones
+	// (another port, or the old blanket jump) can be recognised.
+	want := map[string][]string{}
+	for _, r := range ports {
+		spec := []string{"-p", "udp", "-m", "udp", "--dport", strings.Replace(r.String(), "-", ":", 1), "-j", BanChain}
+		want[strings.Join(spec, " ")] = spec
+	}
+	for _, t := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(t); err != nil {
+			continue
+		}
+		_ = run(t, "-N", BanChain)
+		for _, spec := range want {
+			if run(t, append([]string{"-C", "INPUT"}, spec...)...) != nil {
+				if err := run(t, append([]string{"-I", "INPUT", "1"}, spec...)...); err != nil {
+					return err
+				}
+			}
+		}
+		out, err := exec.Command(t, "-S", "INPUT").Output()
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 4 || f[0] != "-A" || f[len(f)-1] != BanChain {
+				continue
+			}
+			if _, ok := want[strings.Join(f[2:], " ")]; !ok {
+				if err := run(t, append([]string{"-D", "INPUT"}, f[2:]...)...); err != nil {
+					log.Println("ban chain:", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// refreshBanScope moves the ban rules to the current ports after the
+// listen port or the forwarded ranges changed.
+func refreshBanScope() {
+	banMutex.Lock()
+	defer banMutex.Unlock()
+	if len(loadBans()) == 0 {
+		return
+	}
+	if err := ensureBanChain(); err != nil {
+		log.Println("ban chain:", err)
+	}
+}
+
+// protectedIP reports why ip must not be banned: loopback and this
+// server's own addresses would cut off the bot and the API, and so would
+// the address of the admin making the request.
+func protectedIP(ip, caller string) string {
+	p := net.ParseIP(ip)
+	if p == nil {
+		return "invalid IP"
+	}
+	if p.IsLoopback() || p.IsUnspecified() {
+		return "loopback address"
+	}
+	if c := net.ParseIP(caller); c != nil && c.Equal(p) {
+		return "your own address"
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(p) {
+				return "address of this server"
+			}
+		}
+	}
+	if pub := net.ParseIP(getPublicIP()); pub != nil && pub.Equal(p) {
+		return "address of this server"
+	}
+	return ""
+}
+
+func nftSet(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "ban6"
+	}
+	return "ban4"
+}
+
+func blockIP(ip string) error {
+	if useNft() {
+		err := run("nft", "add", "element", "inet", BanTable, nftSet(ip), "{ "+ip+" }")
+		_ = run("conntrack", "-D", "-s", ip)
+		return err
+	}
+	t := ipTool(ip)
+	if run(t, "-C", BanChain, "-s", ip, "-j", "DROP") == nil {
+		return nil
+	}
+	err := run(t, "-A", BanChain, "-s", ip, "-j", "DROP")
+	_ = run("conntrack", "-D", "-s", ip)
+	return err
+}
+
+func unblockIP(ip string) error {
+	if useNft() {
+		return run("nft", "delete", "element", "inet", BanTable, nftSet(ip), "{ "+ip+" }")
+	}
+	t := ipTool(ip)
+	var err error
+	for run(t, "-C", BanChain, "-s", ip, "-j", "DROP") == nil {
+		if err = run(t, "-D", BanChain, "-s", ip, "-j", "DROP"); err != nil {
+			break
+		}
+	}
+	return err
+}
+
+// applyBans re-creates firewall rules from the ban list, dropping expired
+// entries. It runs at API startup so bans survive reboots.
+func applyBans() {
+	banMutex.Lock()
+	defer banMutex.Unlock()
+
+	if err := ensureBanChain(); err != nil {
+		log.Println("ban chain:", err)
+		return
+	}
+	now := time.Now()
+	var keep []Ban
+	for _, b := range loadBans() {
+		if now.After(b.Expires) {
+			_ = unblockIP(b.IP)
+			continue
+		}
+		if why := protectedIP(b.IP, ""); why != "" {
+			log.Printf("dropping ban of %s: %s", b.IP, why)
+			_ = unblockIP(b.IP)
+			continue
+		}
+		if err := blockIP(b.IP); err != nil {
+			log.Println("ban", b.IP, err)
+		}
+		keep = append(keep, b)
+	}
+	_ = saveBans(keep)
+}
+
+func expireBans() {
+	banMutex.Lock()
+	defer banMutex.Unlock()
+
+	now := time.Now()
+	bans := loadBans()
+	var keep []Ban
+	for _, b := range bans {
+		if now.After(b.Expires) {
+			if err := unblockIP(b.IP); err != nil {
+				log.Println("unban", b.IP, err)
+			}
+			continue
+		}
+		keep = append(keep, b)
+	}
+	if len(keep) != len(bans) {
+		_ = saveBans(keep)
+	}
+}
+
+func kickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	var req KickRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	if req.Minutes <= 0 {
+		req.Minutes = DefaultBanMins
+	}
+
+	var ips []string
+	if req.IP != "" {
+		if net.ParseIP(req.IP) == nil {
+			jsonResponse(w, 400, false, "Invalid IP", nil)
+			return
+		}
+		ips = append(ips, req.IP)
+	} else if req.Account != "" {
+		for _, s := range online.refresh() {
+			if s.Account == req.Account {
+				ips = append(ips, s.ClientIP)
+			}
+		}
+		if len(ips) == 0 {
+			jsonResponse(w, 404, false, "No active session for account", nil)
+			return
+		}
+	} else {
+		jsonResponse(w, 400, false, "Invalid request", nil)
+		return
+	}
+	for _, ip := range ips {
+		if why := protectedIP(ip, clientIP(r)); why != "" {
+			jsonResponse(w, 400, false, fmt.Sprintf("Refusing to ban %s: %s", ip, why), nil)
+			return
+		}
+	}
+
+	banMutex.Lock()
+	defer banMutex.Unlock()
+
+	if err := ensureBanChain(); err != nil {
+		jsonResponse(w, 500, false, err.Error(), nil)
+		return
+	}
+
+	now := time.Now()
+	exp := now.Add(time.Duration(req.Minutes) * time.Minute)
+	bans := loadBans()
+	var added []Ban
+	for _, ip := range ips {
+		if err := blockIP(ip); err != nil {
+			jsonResponse(w, 500, false, err.Error(), nil)
+			return
+		}
+		b := Ban{IP: ip, Account: req.Account, Reason: req.Reason, Created: now, Expires: exp}
+		replaced := false
+		for i := range bans {
+			if bans[i].IP == ip {
+				bans[i], replaced = b, true
+			}
+		}
+		if !replaced {
+			bans = append(bans, b)
+		}
+		added = append(added, b)
+	}
+	if err := saveBans(bans); err != nil {
+		jsonResponse(w, 500, false, "Save ban list error", nil)
+		return
+	}
+
+	jsonResponse(w, 200, true, "Session kicked", added)
+}
+
+func unbanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	var req KickRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	if req.IP == "" {
+		jsonResponse(w, 400, false, "Invalid request", nil)
+		return
+	}
+
+	banMutex.Lock()
+	defer banMutex.Unlock()
+
+	bans := loadBans()
+	var keep []Ban
+	found := false
+	for _, b := range bans {
+		if b.IP == req.IP {
+			found = true
+			continue
+		}
+		keep = append(keep, b)
+	}
+	if !found {
+		jsonResponse(w, 404, false, "Ban not found", nil)
+		return
+	}
+	if err := unblockIP(req.IP); err != nil {
+		log.Println("unban", req.IP, err)
+	}
+	_ = saveBans(keep)
+	jsonResponse(w, 200, true, "Ban removed", nil)
+}
+
+func listBansHandler(w http.ResponseWriter, r *http.Request) {
+	banMutex.Lock()
+	bans := loadBans()
+	banMutex.Unlock()
+
+	now := time.Now()
+	out := []Ban{}
+	for _, b := range bans {
+		if now.Before(b.Expires) {
+			out = append(out, b)
+		}
+	}
+	jsonResponse(w, 200, true, "OK", out)
+}
+
+const (
+	DNATFile      = "/etc/zivpn/dnat.json"
+	DNATTable     = "zivpn_nat"
+	maxDNATRanges = 8
+)
+
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+func (r PortRange) contains(p int) bool { return p >= r.Start && p <= r.End }
+
+func (r PortRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// DNATCfg is the forwarding the API owns. ToPort records the port the
+// rules were last written for, so they can be found again after the listen
+// port changes.
+type DNATCfg struct {
+	Ranges    []PortRange `json:"ranges"`
+	Interface string      `json:"interface,omitempty"`
+	ToPort    int         `json:"to_port"`
+}
+
+// DNATRule is a UDP port-forwarding rule found in the firewall.
+type DNATRule struct {
+	Interface string `json:"interface,omitempty"`
+	Range     string `json:"range"`
+	ToPort    int    `json:"to_port"`
+
+	start, end int
+	spec       []string // iptables arguments that delete the rule
+}
+
+var (
+	dnatMutex  = &sync.Mutex{}
+	dnatRangeM sync.RWMutex
+	dnatRanges = []PortRange{{6000, 19999}}
+)
+
+func activeDNATRanges() []PortRange {
+	dnatRangeM.RLock()
+	defer dnatRangeM.RUnlock()
+	return dnatRanges
+}
+
+func setDNATRanges(r []PortRange) {
+	dnatRangeM.Lock()
+	dnatRanges = r
+	dnatRangeM.Unlock()
+}
+
+// loadDNATCfg reports whether the API manages forwarding; until the first
+// POST /api/server/ports the installer's rule is left alone.
+func loadDNATCfg() (DNATCfg, bool) {
+	var cfg DNATCfg
+	b, err := ioutil.ReadFile(DNATFile)
+	if err != nil {
+		return cfg, false
+	}
+	return cfg, json.Unmarshal(b, &cfg) == nil
+}
+
+func saveDNATCfg(cfg DNATCfg) error {
+	if cfg.Ranges == nil {
+		cfg.Ranges = []PortRange{}
+	}
+	b, _ := json.MarshalIndent(cfg, "", "  ")
+	return writeFileAtomic(DNATFile, b, 0644)
+}
+
+// listenPort is the UDP port of the core from config.json.
+func listenPort() int {
+	if cfg, err := loadConfig(); err == nil {
+		if _, p, err := net.SplitHostPort(cfg.Listen); err == nil {
+			if n, err := strconv.Atoi(p); err == nil {
+				return n
+			}
+		}
+	}
+	return CorePort
+}
+
+func parsePortRange(s, sep string) (int, int, bool) {
+	parts := strings.SplitN(s, sep, 2)
+	a, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	b := a
+	if len(parts) == 2 {
+		if b, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, false
+		}
+	}
+	return a, b, true
+}
+
+// parseIptablesDNAT reads `iptables -t nat -S PREROUTING` output and
+// returns the UDP DNAT rules that forward to a local port, e.g.
+// "-A PREROUTING -p udp --dport 6000:19999 -j DNAT --to-destination :5667".
+func parseIptablesDNAT(out string) []DNATRule {
+	var rules []DNATRule
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "-A" {
+			continue
+		}
+		var r DNATRule
+		var proto, target, dest string
+		for i := 2; i+1 < len(f); i++ {
+			switch f[i] {
+			case "-i":
+				r.Interface = f[i+1]
+			case "-p":
+				proto = f[i+1]
+			case "--dport":
+				r.start, r.end, _ = parsePortRange(f[i+1], ":")
+			case "-j":
+				target = f[i+1]
+			case "--to-destination":
+				dest = f[i+1]
+			}
+		}
+		if proto != "udp" || target != "DNAT" || r.start == 0 || !strings.HasPrefix(dest, ":") {
+			continue
+		}
+		r.ToPort, _ = strconv.Atoi(dest[1:])
+		r.Range = PortRange{r.start, r.end}.String()
+		r.spec = append([]string{"-t", "nat", "-D"}, f[1:]...)
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// parseNftDNAT reads the prerouting chain of the API's nftables table,
+// e.g. `iifname "eth0" udp dport 6000-19999 redirect to :5667`.
+func parseNftDNAT(out string) []DNATRule {
+	var rules []DNATRule
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		var r DNATRule
+		for i := 0; i+1 < len(f); i++ {
+			switch {
+			case f[i] == "iifname":
+				r.Interface = strings.Trim(f[i+1], `"`)
+			case f[i] == "udp" && f[i+1] == "dport" && i+2 < len(f):
+				r.start, r.end, _ = parsePortRange(f[i+2], "-")
+			case (f[i] == "redirect" || f[i] == "dnat") && f[i+1] == "to" && i+2 < len(f):
+				r.ToPort, _ = strconv.Atoi(strings.TrimPrefix(f[i+2], ":"))
+			}
+		}
+		if r.start == 0 || r.ToPort == 0 {
+			continue
+		}
+		r.Range = PortRange{r.start, r.end}.String()
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func dnatBackend() string {
+	if useNft() {
+		return "nftables"
+	}
+	return "iptables"
+}
+
+// readDNATRules lists the UDP forwarding rules currently in the firewall.
+func readDNATRules() ([]DNATRule, error) {
+	if useNft() {
+		out, err := exec.Command("nft", "list", "chain", "ip", DNATTable, "prerouting").Output()
+		if err != nil {
+			return nil, nil
+		}
+		return parseNftDNAT(string(out)), nil
+	}
+	out, err := exec.Command("iptables", "-t", "nat", "-S", "PREROUTING").Output()
+	if err != nil {
+		return nil, fmt.Errorf("iptables -t nat -S PREROUTING: %v", err)
+	}
+	return parseIptablesDNAT(string(out)), nil
+}
+
+func rulesToPort(rules []DNATRule, port int) []DNATRule {
+	var out []DNATRule
+	for _, r := range rules {
+		if r.ToPort == port {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func rangesOf(rules []DNATRule) []PortRange {
+	out := []PortRange{}
+	for _, r := range rules {
+		out = append(out, PortRange{r.start, r.end})
+	}
+	return out
+}
+
+func validateDNAT(cfg DNATCfg, port int) error {
+	if len(cfg.Ranges) > maxDNATRanges {
+		return fmt.Errorf("at most %d ranges are allowed", maxDNATRanges)
+	}
+	for i, r := range cfg.Ranges {
+		if r.Start < 1 || r.End > 65535 || r.Start > r.End {
+			return fmt.Errorf("range %s is invalid, use 1-65535 with start <= end", r)
+		}
+		if r.contains(port) {
+			return fmt.Errorf("range %s contains the listen port %d", r, port)
+		}
+		for _, o := range cfg.Ranges[:i] {
+			if r.Start <= o.End && o.Start <= r.End {
+				return fmt.Errorf("ranges %s and %s overlap", o, r)
+			}
+		}
+	}
+	if cfg.Interface != "" {
+		if _, err := net.InterfaceByName(cfg.Interface); err != nil {
+			return fmt.Errorf("interface %q not found", cfg.Interface)
+		}
+	}
+	return nil
+}
+
+func iptablesDNATArgs(r PortRange, iface string, port int) []string {
+	args := []string{"-t", "nat", "-A", "PREROUTING"}
+	if iface != "" {
+		args = append(args, "-i", iface)
+	}
+	dport := strconv.Itoa(r.Start)
+	if r.End != r.Start {
+		dport += ":" + strconv.Itoa(r.End)
+	}
+	return append(args, "-p", "udp", "--dport", dport, "-j", "DNAT", "--to-destination", ":"+strconv.Itoa(port))
+}
+
+// applyDNAT replaces the forwarding rules that point at oldPort or port
+// with cfg. With nftables the API's own table is rebuilt; with iptables
+// the previous rules are put back if any new rule fails. The caller must
+// hold dnatMutex.
+func applyDNAT(cfg DNATCfg, oldPort, port int) error {
+	if useNft() {
+		_ = run("nft", "delete", "table", "ip", DNATTable)
+		if len(cfg.Ranges) == 0 {
+			return nil
+		}
+		if err := run("nft", "add", "table", "ip", DNATTable); err != nil {
+			return err
+		}
+		if err := run("nft", "add", "chain", "ip", DNATTable, "prerouting", "{ type nat hook prerouting priority -100; }"); err != nil {
+			return err
+		}
+		for _, r := range cfg.Ranges {
+			rule := []string{"add", "rule", "ip", DNATTable, "prerouting"}
+			if cfg.Interface != "" {
+				rule = append(rule, "iifname", cfg.Interface)
+			}
+			rule = append(rule, "udp", "dport", r.String(), "redirect", "to", ":"+strconv.Itoa(port))
+			if err := run("nft", rule...); err != nil {
+				_ = run("nft", "delete", "table", "ip", DNATTable)
+				return err
+			}
+		}
+		return nil
+	}
+
+	cur, err := readDNATRules()
+	if err != nil {
+		return err
+	}
+	old := rulesToPort(cur, port)
+	if oldPort != port {
+		old = append(old, rulesToPort(cur, oldPort)...)
+	}
+	for _, r := range old {
+		if err := run("iptables", r.spec...); err != nil {
+			return err
+		}
+	}
+	var added [][]string
+	for _, r := range cfg.Ranges {
+		args := iptablesDNATArgs(r, cfg.Interface, port)
+		if err := run("iptables", args...); err != nil {
+			for _, a := range added {
+				a[2] = "-D"
+				_ = run("iptables", a...)
+			}
+			for _, o := range old {
+				o.spec[2] = "-A"
+				_ = run("iptables", o.spec...)
+			}
+			return err
+		}
+		added = append(added, args)
+	}
+	return nil
+}
+
+// initDNAT runs at startup. A saved configuration is re-applied so the
+// rules survive reboots; otherwise the ranges for the online list are
+// taken from whatever forwards to the listen port.
+func initDNAT() {
+	dnatMutex.Lock()
+	defer dnatMutex.Unlock()
+
+	port := listenPort()
+	cfg, managed := loadDNATCfg()
+	if !managed {
+		if rules, err := readDNATRules(); err == nil && len(rules) > 0 {
+			setDNATRanges(rangesOf(rulesToPort(rules, port)))
+		}
+		return
+	}
+	if cfg.ToPort == 0 {
+		cfg.ToPort = port
+	}
+	if err := applyDNAT(cfg, cfg.ToPort, port); err != nil {
+		log.Println("dnat:", err)
+	}
+	cfg.ToPort = port
+	_ = saveDNATCfg(cfg)
+	setDNATRanges(cfg.Ranges)
+}
+
+// resyncDNAT points the managed rules at a new listen port.
+func resyncDNAT(port int) error {
+	dnatMutex.Lock()
+	defer dnatMutex.Unlock()
+	cfg, managed := loadDNATCfg()
+	if !managed || cfg.ToPort == port {
+		return nil
+	}
+	if err := applyDNAT(cfg, cfg.ToPort, port); err != nil {
+		return err
+	}
+	cfg.ToPort = port
+	return saveDNATCfg(cfg)
+}
+
+type PortsStatus struct {
+	Backend    string      `json:"backend"`
+	Managed    bool        `json:"managed"`
+	ListenPort int         `json:"listen_port"`
+	APIPort    string      `json:"api_port"`
+	Interface  string      `json:"interface,omitempty"`
+	Ranges     []PortRange `json:"ranges"`
+	Rules      []DNATRule  `json:"rules"`
+	InSync     bool        `json:"in_sync"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func portsStatus() PortsStatus {
+	port := listenPort()
+	st := PortsStatus{Backend: dnatBackend(), ListenPort: port, APIPort: strings.TrimPrefix(Port, ":"), Rules: []DNATRule{}}
+	rules, err := readDNATRules()
+	if err != nil {
+		st.Error = err.Error()
+	}
+	if r := rulesToPort(rules, port); r != nil {
+		st.Rules = r
+	}
+	cfg, managed := loadDNATCfg()
+	st.Managed = managed
+	if managed {
+		st.Ranges, st.Interface = cfg.Ranges, cfg.Interface
+		st.InSync = err == nil && reflect.DeepEqual(rangesOf(st.Rules), append([]PortRange{}, cfg.Ranges...))
+	} else {
+		st.Ranges = rangesOf(st.Rules)
+		st.InSync = err == nil
+	}
+	return st
+}
+
+// portSummary is the human readable port line in /api/info.
+func portSummary(st PortsStatus) string {
+	parts := []string{fmt.Sprintf("%d UDP", st.ListenPort)}
+	for _, r := range st.Ranges {
+		parts = append(parts, fmt.Sprintf("%s UDP -> %d", r, st.ListenPort))
+	}
+	return strings.Join(append(parts, st.APIPort+" API"), ", ")
+}
+
+type PortsRequest struct {
+	Ranges    []PortRange `json:"ranges"`
+	Interface string      `json:"interface"`
+	DryRun    bool        `json:"dry_run"`
+}
+
+// serverPortsHandler serves GET (configured and actual forwarding) and
+// POST (replace the forwarded ranges) on /api/server/ports. An empty
+// ranges list removes forwarding.
+func serverPortsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, 200, true, "OK", portsStatus())
+		return
+	case http.MethodPost:
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+
+	var req PortsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Ranges == nil {
+		jsonResponse(w, 400, false, "Invalid request, ranges is required", nil)
+		return
+	}
+	port := listenPort()
+	cfg := DNATCfg{Ranges: req.Ranges, Interface: strings.TrimSpace(req.Interface), ToPort: port}
+	sort.Slice(cfg.Ranges, func(i, j int) bool { return cfg.Ranges[i].Start < cfg.Ranges[j].Start })
+	if err := validateDNAT(cfg, port); err != nil {
+		jsonResponse(w, 400, false, err.Error(), nil)
+		return
+	}
+	if req.DryRun {
+		cmds := []string{}
+		for _, rg := range cfg.Ranges {
+			if useNft() {
+				cmds = append(cmds, fmt.Sprintf("nft add rule ip %s prerouting udp dport %s redirect to :%d", DNATTable, rg, port))
+			} else {
+				cmds = append(cmds, "iptables "+strings.Join(iptablesDNATArgs(rg, cfg.Interface, port), " "))
+			}
+		}
+		jsonResponse(w, 200, true, "Dry run, nothing changed", map[string]interface{}{"config": cfg, "commands": cmds})
+		return
+	}
+
+	dnatMutex.Lock()
+	defer dnatMutex.Unlock()
+	oldPort := port
+	if prev, ok := loadDNATCfg(); ok && prev.ToPort != 0 {
+		oldPort = prev.ToPort
+	}
+	if err := applyDNAT(cfg, oldPort, port); err != nil {
+		jsonResponse(w, 500, false, "Apply failed: "+err.Error(), nil)
+		return
+	}
+	if err := saveDNATCfg(cfg); err != nil {
+		jsonResponse(w, 500, false, "Rules applied but saving failed: "+err.Error(), nil)
+		return
+	}
+	setDNATRanges(cfg.Ranges)
+	refreshBanScope()
+	jsonResponse(w, 200, true, "Port forwarding updated", portsStatus())
+}
+
+var (
+	BackupStoreFile = "/etc/zivpn/backup-store.json"
+	BotConfigFile   = "/etc/zivpn/bot-config.json"
+)
+
+type BackupObject struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"filename"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	DownloadURL string    `json:"download_url"`
+}
+
+// BackupStore is where backup archives live. IDs are whatever the backend
+// uses to address an object (a Drive file ID, an S3 key, a file name).
+type BackupStore interface {
+	Name() string
+	Put(localPath, name string) (BackupObject, error)
+	List() ([]BackupObject, error)
+	Get(id, localPath string) error
+	Delete(id string) error
+}
+
+type BackupStoreCfg struct {
+	Type string `json:"type"`
+
+	Remote string `json:"remote,omitempty"`
+
+	Dir string `json:"dir,omitempty"`
+
+	Endpoint     string `json:"endpoint,omitempty"`
+	Region       string `json:"region,omitempty"`
+	Bucket       string `json:"bucket,omitempty"`
+	Prefix       string `json:"prefix,omitempty"`
+	AccessKey    string `json:"access_key,omitempty"`
+	SecretKey    string `json:"secret_key,omitempty"`
+	PresignHours int    `json:"presign_hours,omitempty"`
+
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	User     string `json:"user,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	Path     string `json:"path,omitempty"`
+	ChatID   int64  `json:"chat_id,omitempty"`
+	BotToken string `json:"bot_token,omitempty"`
+}
+
+func loadBackupStoreCfg() BackupStoreCfg {
+	cfg := BackupStoreCfg{Type: "rclone", Remote: RcloneRemote}
+	if b, err := ioutil.ReadFile(BackupStoreFile); err == nil {
+		_ = json.Unmarshal(b, &cfg)
+	}
+	return cfg
+}
+
+func newBackupStore(cfg BackupStoreCfg) (BackupStore, error) {
+	switch cfg.Type {
+	case "", "rclone":
+		if cfg.Remote == "" {
+			cfg.Remote = RcloneRemote
+		}
+		return &rcloneStore{remote: cfg.Remote}, nil
+	case "local":
+		if cfg.Dir == "" {
+			cfg.Dir = filepath.Join(BackupDir, "archive")
+		}
+		return &localStore{dir: cfg.Dir}, nil
+	case "s3":
+		if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return nil, fmt.Errorf("s3 store needs endpoint, bucket, access_key and secret_key")
+		}
+		if cfg.Region == "" {
+			cfg.Region = "us-east-1"
+		}
+		if cfg.PresignHours <= 0 {
+			cfg.PresignHours = 24
+		}
+		return &s3Store{cfg: cfg, client: &http.Client{Timeout: 10 * time.Minute}}, nil
+	case "sftp":
+		if cfg.Host == "" || cfg.User == "" {
+			return nil, fmt.Errorf("sftp store needs host and user")
+		}
+		if cfg.Port == 0 {
+			cfg.Port = 22
+		}
+		if cfg.Path == "" {
+			cfg.Path = "zivpn-backup"
+		}
+		return &sftpStore{cfg: cfg}, nil
+	case "telegram":
+		if cfg.BotToken == "" || cfg.ChatID == 0 {
+			bc := loadBotCfg()
+			if cfg.BotToken == "" {
+				cfg.BotToken = bc.BotToken
+			}
+			if cfg.ChatID == 0 {
+				cfg.ChatID = bc.AdminID
+			}
+		}
+		if cfg.BotToken == "" || cfg.ChatID == 0 {
+			return nil, fmt.Errorf("telegram store needs bot_token and chat_id")
+		}
+		return &telegramStore{cfg: cfg, index: filepath.Join(BackupDir, "telegram-index.json")}, nil
+	}
+	return nil, fmt.Errorf("unknown backup store type %q", cfg.Type)
+}
+
+func backupStore() (BackupStore, error) {
+	return newBackupStore(loadBackupStoreCfg())
+}
+
+func isBackupName(name string) bool {
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".zip.enc") || strings.HasSuffix(name, ".zip.age")
+}
+
+// rcloneStore is the original Google Drive (or any rclone remote) backend.
+type rcloneStore struct {
+	remote string
+}
+
+func (s *rcloneStore) Name() string { return "rclone:" + s.remote }
+
+func (s *rcloneStore) isDrive() bool {
+	out, err := exec.Command("rclone", "config", "dump").Output()
+	if err != nil {
+		return strings.HasPrefix(s.remote, "drive:")
+	}
+	var remotes map[string]map[string]string
+	if json.Unmarshal(out, &remotes) != nil {
+		return false
+	}
+	name := strings.SplitN(s.remote, ":", 2)[0]
+	return remotes[name]["type"] == "drive"
+}
+
+func (s *rcloneStore) url(id string) string {
+	if id == "" || !s.isDrive() {
+		return ""
+	}
+	return fmt.Sprintf("https://drive.google.com/uc?id=%s&export=download", id)
+}
+
+func (s *rcloneStore) List() ([]BackupObject, error) {
+	out, err := exec.Command("rclone", "lsjson", s.remote).Output()
+	if err != nil {
+		return nil, fmt.Errorf("rclone lsjson: %v", err)
+	}
+	var arr []struct {
+		Name    string
+		ID      string
+		Size    int64
+		ModTime time.Time
+	}
+	if err := json.Unmarshal(out, &arr); err != nil {
+		return nil, err
+	}
+	drive := s.isDrive()
+	var res []BackupObject
+	for _, f := range arr {
+		if !isBackupName(f.Name) {
+			continue
+		}
+		id := f.ID
+		if id == "" {
+			id = f.Name
+		}
+		o := BackupObject{ID: id, Name: f.Name, Size: f.Size, ModTime: f.ModTime}
+		if drive && f.ID != "" {
+			o.DownloadURL = fmt.Sprintf("https://drive.google.com/uc?id=%s&export=download", f.ID)
+		}
+		res = append(res, o)
+	}
+	return res, nil
+}
+
+func (s *rcloneStore) find(id string) (BackupObject, bool) {
+	list, err := s.List()
+	if err != nil {
+		return BackupObject{}, false
+	}
+	for _, o := range list {
+		if o.ID == id || o.Name == id {
+			return o, true
+		}
+	}
+	return BackupObject{}, false
+}
+
+func (s *rcloneStore) Put(localPath, name string) (BackupObject, error) {
+	if out, err := exec.Command("rclone", "copyto", localPath, s.remote+"/"+name).CombinedOutput(); err != nil {
+		return BackupObject{}, fmt.Errorf("upload failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	o, ok := s.find(name)
+	if !ok {
+		return BackupObject{}, fmt.Errorf("uploaded %s but it is missing from %s", name, s.remote)
+	}
+	return o, nil
+}
+
+func (s *rcloneStore) Get(id, localPath string) error {
+	name := id
+	if o, ok := s.find(id); ok {
+		name = o.Name
+	}
+	out, err := exec.Command("rclone", "copyto", s.remote+"/"+name, localPath).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if u := s.url(id); u != "" {
+		if _, werr := exec.Command("wget", "--quiet", "-O", localPath, u).CombinedOutput(); werr == nil {
+			return nil
+		}
+		if _, cerr := exec.Command("curl", "-fsSL", "-o", localPath, u).CombinedOutput(); cerr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("download failed: %v: %s", err, strings.TrimSpace(string(out)))
+}
+
+func (s *rcloneStore) Delete(id string) error {
+	name := id
+	if o, ok := s.find(id); ok {
+		name = o.Name
+	}
+	if out, err := exec.Command("rclone", "deletefile", s.remote+"/"+name).CombinedOutput(); err != nil {
+		return fmt.Errorf("rclone deletefile: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// localStore keeps archives in a directory on this server.
+type localStore struct {
+	dir string
+}
+
+func (s *localStore) Name() string { return "local:" + s.dir }
+
+func (s *localStore) path(id string) (string, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid backup id %q", id)
+	}
+	return filepath.Join(s.dir, id), nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (s *localStore) Put(localPath, name string) (BackupObject, error) {
+	dst, err := s.path(name)
+	if err != nil {
+		return BackupObject{}, err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return BackupObject{}, err
+	}
+	if err := copyFile(localPath, dst, 0600); err != nil {
+		return BackupObject{}, err
+	}
+	st, err := os.Stat(dst)
+	if err != nil {
+		return BackupObject{}, err
+	}
+	return BackupObject{ID: name, Name: name, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (s *localStore) List() ([]BackupObject, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []BackupObject
+	for _, e := range entries {
+		if e.IsDir() || !isBackupName(e.Name()) {
+			continue
+		}
+		res = append(res, BackupObject{ID: e.Name(), Name: e.Name(), Size: e.Size(), ModTime: e.ModTime()})
+	}
+	return res, nil
+}
+
+func (s *localStore) Get(id, localPath string) error {
+	src, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, localPath, 0600)
+}
+
+func (s *localStore) Delete(id string) error {
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// s3Store talks to any S3-compatible service (AWS, MinIO, R2, Wasabi) using
+// path-style requests signed with AWS Signature Version 4.
+type s3Store struct {
+	cfg    BackupStoreCfg
+	client *http.Client
+}
+
+func (s *s3Store) Name() string { return "s3:" + s.cfg.Bucket }
+
+func (s *s3Store) key(name string) string {
+	p := strings.Trim(s.cfg.Prefix, "/")
+	if p == "" {
+		return name
+	}
+	return p + "/" + name
+}
+
+func s3Escape(p string) string {
+	parts := strings.Split(p, "/")
+	for i, x := range parts {
+		parts[i] = strings.ReplaceAll(url.QueryEscape(x), "+", "%20")
+	}
+	return strings.Join(parts, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func (s *s3Store) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimRight(s.cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = "/" + s3Escape(s.cfg.Bucket)
+	if key != "" {
+		u.RawPath += "/" + s3Escape(key)
+	}
+	return u, nil
+}
+
+func (s *s3Store) signingKey(date string) []byte {
+	k := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	k = hmacSHA256(k, s.cfg.Region)
+	k = hmacSHA256(k, "s3")
+	return hmacSHA256(k, "aws4_request")
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k)+"="+strings.ReplaceAll(url.QueryEscape(v), "+", "%20"))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	sig := hex.EncodeToString(hmacSHA256(s.signingKey(date), toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signed, sig))
+}
+
+// presign returns a time-limited GET URL for key.
+func (s *s3Store) presign(key string, now time.Time) string {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return ""
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.cfg.AccessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(s.cfg.PresignHours*3600))
+	q.Set("X-Amz-SignedHeaders", "host")
+	canonical := strings.Join([]string{
+		"GET", u.EscapedPath(), canonicalQuery(q), "host:" + u.Host + "\n", "host", "UNSIGNED-PAYLOAD",
+	}, "\n")
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	q.Set("X-Amz-Signature", hex.EncodeToString(hmacSHA256(s.signingKey(date), toSign)))
+	u.RawQuery = canonicalQuery(q)
+	return u.String()
+}
+
+func (s *s3Store) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, sha256Hex(body), time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+func (s *s3Store) Put(localPath, name string) (BackupObject, error) {
+	body, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return BackupObject{}, err
+	}
+	key := s.key(name)
+	resp, err := s.do("PUT", key, nil, body)
+	if err != nil {
+		return BackupObject{}, err
+	}
+	resp.Body.Close()
+	now := time.Now()
+	return BackupObject{ID: key, Name: name, Size: int64(len(body)), ModTime: now, DownloadURL: s.presign(key, now)}, nil
+}
+
+func (s *s3Store) List() ([]BackupObject, error) {
+	var res []BackupObject
+	token := ""
+	now := time.Now()
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		if p := strings.Trim(s.cfg.Prefix, "/"); p != "" {
+			q.Set("prefix", p+"/")
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range out.Contents {
+			name := path.Base(c.Key)
+			if !isBackupName(name) {
+				continue
+			}
+			res = append(res, BackupObject{ID: c.Key, Name: name, Size: c.Size, ModTime: c.LastModified, DownloadURL: s.presign(c.Key, now)})
+		}
+		if !out.IsTruncated || out.NextContinuationToken == "" {
+			return res, nil
+		}
+		token = out.NextContinuationToken
+	}
+}
+
+func (s *s3Store) objectKey(id string) string {
+	if strings.Contains(id, "/") || strings.Trim(s.cfg.Prefix, "/") == "" {
+		return id
+	}
+	return s.key(id)
+}
+
+func (s *s3Store) Get(id, localPath string) error {
+	resp, err := s.do("GET", s.objectKey(id), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *s3Store) Delete(id string) error {
+	resp, err := s.do("DELETE", s.objectKey(id), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sftpStore shells out to the OpenSSH sftp client in batch mode, so it needs
+// key-based authentication.
+type sftpStore struct {
+	cfg BackupStoreCfg
+}
+
+func (s *sftpStore) Name() string {
+	return fmt.Sprintf("sftp:%s@%s:%s", s.cfg.User, s.cfg.Host, s.cfg.Path)
+}
+
+func (s *sftpStore) batch(cmds ...string) (string, error) {
+	args := []string{"-b", "-", "-P", strconv.Itoa(s.cfg.Port), "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=accept-new"}
+	if s.cfg.KeyFile != "" {
+		args = append(args, "-i", s.cfg.KeyFile)
+	}
+	args = append(args, s.cfg.User+"@"+s.cfg.Host)
+	cmd := exec.Command("sftp", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(cmds, "\n") + "\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("sftp: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func sftpQuote(p string) string {
+	return `"` + strings.ReplaceAll(p, `"`, `\"`) + `"`
+}
+
+func (s *sftpStore) remote(name string) (string, error) {
+	if name == "" || name != path.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid backup id %q", name)
+	}
+	return path.Join(s.cfg.Path, name), nil
+}
+
+func (s *sftpStore) Put(localPath, name string) (BackupObject, error) {
+	dst, err := s.remote(name)
+	if err != nil {
+		return BackupObject{}, err
+	}
+	if _, err := s.batch("-mkdir "+sftpQuote(s.cfg.Path), "put "+sftpQuote(localPath)+" "+sftpQuote(dst)); err != nil {
+		return BackupObject{}, err
+	}
+	st, _ := os.Stat(localPath)
+	o := BackupObject{ID: name, Name: name, ModTime: time.Now(), DownloadURL: fmt.Sprintf("sftp://%s@%s:%d/%s", s.cfg.User, s.cfg.Host, s.cfg.Port, dst)}
+	if st != nil {
+		o.Size = st.Size()
+	}
+	return o, nil
+}
+
+// List parses `ls -ln` output: perms links uid gid size month day time|year name.
+func (s *sftpStore) List() ([]BackupObject, error) {
+	out, err := s.batch("ls -ln " + sftpQuote(s.cfg.Path))
+	if err != nil {
+		return nil, err
+	}
+	var res []BackupObject
+	now := time.Now()
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 9 || strings.HasPrefix(f[0], "sftp>") || !strings.HasPrefix(f[0], "-") {
+			continue
+		}
+		name := path.Base(strings.Join(f[8:], " "))
+		if !isBackupName(name) {
+			continue
+		}
+		size, _ := strconv.ParseInt(f[4], 10, 64)
+		mod, err := time.ParseInLocation("Jan 2 15:04 2006", fmt.Sprintf("%s %s %s %d", f[5], f[6], f[7], now.Year()), time.Local)
+		if err != nil {
+			mod, _ = time.ParseInLocation("Jan 2 2006", strings.Join(f[5:8], " "), time.Local)
+		} else if mod.After(now) {
+			mod = mod.AddDate(-1, 0, 0)
+		}
+		res = append(res, BackupObject{
+			ID: name, Name: name, Size: size, ModTime: mod,
+			DownloadURL: fmt.Sprintf("sftp://%s@%s:%d/%s", s.cfg.User, s.cfg.Host, s.cfg.Port, path.Join(s.cfg.Path, name)),
+		})
+	}
+	return res, nil
+}
+
+func (s *sftpStore) Get(id, localPath string) error {
+	src, err := s.remote(id)
+	if err != nil {
+		return err
+	}
+	_, err = s.batch("get " + sftpQuote(src) + " " + sftpQuote(localPath))
+	return err
+}
+
+func (s *sftpStore) Delete(id string) error {
+	p, err := s.remote(id)
+	if err != nil {
+		return err
+	}
+	_, err = s.batch("rm " + sftpQuote(p))
+	return err
+}
+
+// telegramStore uploads archives as documents to a chat. Telegram cannot
+// list a chat's files, so uploads are tracked in a local index.
+type telegramStore struct {
+	cfg   BackupStoreCfg
+	index string
+}
+
+type telegramEntry struct {
+	BackupObject
+	MessageID int    `json:"message_id"`
+	FileID    string `json:"file_id"`
+}
+
+func (s *telegramStore) Name() string { return fmt.Sprintf("telegram:%d", s.cfg.ChatID) }
+
+func (s *telegramStore) load() []telegramEntry {
+	var out []telegramEntry
+	if b, err := ioutil.ReadFile(s.index); err == nil {
+		_ = json.Unmarshal(b, &out)
+	}
+	return out
+}
+
+func (s *telegramStore) save(entries []telegramEntry) error {
+	b, _ := json.MarshalIndent(entries, "", "  ")
+	return ioutil.WriteFile(s.index, b, 0600)
+}
+
+func (s *telegramStore) call(method string, body io.Reader, contentType string, out interface{}) error {
+	u := fmt.Sprintf("https://api.telegram.org/bot%s/%s", s.cfg.BotToken, method)
+	resp, err := (&http.Client{Timeout: 10 * time.Minute}).Post(u, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Ok          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if !res.Ok {
+		return fmt.Errorf("telegram %s: %s", method, res.Description)
+	}
+	if out != nil {
+		return json.Unmarshal(res.Result, out)
+	}
+	return nil
+}
+
+func (s *telegramStore) Put(localPath, name string) (BackupObject, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return BackupObject{}, err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		_ = mw.WriteField("chat_id", strconv.FormatInt(s.cfg.ChatID, 10))
+		_ = mw.WriteField("caption", "ZiVPN backup "+name)
+		part, err := mw.CreateFormFile("document", name)
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var msg struct {
+		MessageID int   `json:"message_id"`
+		Date      int64 `json:"date"`
+		Document  struct {
+			FileID   string `json:"file_id"`
+			FileSize int64  `json:"file_size"`
+		} `json:"document"`
+	}
+	if err := s.call("sendDocument", pr, mw.FormDataContentType(), &msg); err != nil {
+		return BackupObject{}, err
+	}
+	e := telegramEntry{
+		BackupObject: BackupObject{ID: name, Name: name, Size: msg.Document.FileSize, ModTime: time.Unix(msg.Date, 0)},
+		MessageID:    msg.MessageID,
+		FileID:       msg.Document.FileID,
+	}
+	entries := append(s.load(), e)
+	if err := s.save(entries); err != nil {
+		return BackupObject{}, err
+	}
+	return e.BackupObject, nil
+}
+
+func (s *telegramStore) List() ([]BackupObject, error) {
+	var res []BackupObject
+	for _, e := range s.load() {
+		res = append(res, e.BackupObject)
+	}
+	return res, nil
+}
+
+func (s *telegramStore) find(id string) (telegramEntry, bool) {
+	for _, e := range s.load() {
+		if e.ID == id || e.FileID == id {
+			return e, true
+		}
+	}
+	return telegramEntry{}, false
+}
+
+func (s *telegramStore) Get(id, localPath string) error {
+	e, ok := s.find(id)
+	if !ok {
+		return fmt.Errorf("backup %s not found", id)
+	}
+	var file struct {
+		FilePath string `json:"file_path"`
+	}
+	body := strings.NewReader(url.Values{"file_id": {e.FileID}}.Encode())
+	if err := s.call("getFile", body, "application/x-www-form-urlencoded", &file); err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Timeout: 10 * time.Minute}).Get(fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", s.cfg.BotToken, file.FilePath))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("telegram download: %s", resp.Status)
+	}
+	out, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (s *telegramStore) Delete(id string) error {
+	e, ok := s.find(id)
+	if !ok {
+		return fmt.Errorf("backup %s not found", id)
+	}
+	body := strings.NewReader(url.Values{
+		"chat_id":    {strconv.FormatInt(s.cfg.ChatID, 10)},
+		"message_id": {strconv.Itoa(e.MessageID)},
+	}.Encode())
+	if err := s.call("deleteMessage", body, "application/x-www-form-urlencoded", nil); err != nil {
+		log.Println("telegram delete:", err)
+	}
+	var keep []telegramEntry
+	for _, x := range s.load() {
+		if x.ID != e.ID {
+			keep = append(keep, x)
+		}
+	}
+	return s.save(keep)
+}
+
+var (
+	BackupEncFile        = "/etc/zivpn/backup-encryption.json"
+	BackupPassphraseFile = "/etc/zivpn/backup-passphrase"
+)
+
+const (
+	encMagic      = "ZIVPNENC1"
+	ageMagic      = "age-encryption.org/v1"
+	pbkdf2Iter    = 200000
+	encSaltSize   = 16
+	encKeySize    = 32
+	minPassphrase = 12
+)
+
+// BackupEncCfg is backup-encryption.json. Passphrase is never stored; a
+// restore sets it to open a backup made with another server's passphrase.
+type BackupEncCfg struct {
+	Mode           string   `json:"mode"`
+	PassphraseFile string   `json:"passphrase_file"`
+	Recipients     []string `json:"recipients"`
+	IdentityFile   string   `json:"identity_file"`
+	Passphrase     string   `json:"-"`
+}
+
+// loadBackupEncCfg defaults to passphrase encryption; the passphrase is
+// generated on the first backup if the file does not exist. Mode "none"
+// must be chosen explicitly and then only works with the local store.
+func loadBackupEncCfg() BackupEncCfg {
+	cfg := BackupEncCfg{
+		Mode:           "passphrase",
+		PassphraseFile: BackupPassphraseFile,
+		IdentityFile:   "/etc/zivpn/backup-age-identity.txt",
+	}
+	if b, err := ioutil.ReadFile(BackupEncFile); err == nil {
+		_ = json.Unmarshal(b, &cfg)
+	}
+	return cfg
+}
+
+// withPassphrase returns c with a passphrase given alongside a restore.
+func (c BackupEncCfg) withPassphrase(pass string) BackupEncCfg {
+	c.Passphrase = strings.TrimSpace(pass)
+	return c
+}
+
+func (c BackupEncCfg) passphrase() ([]byte, error) {
+	if c.Passphrase != "" {
+		return []byte(c.Passphrase), nil
+	}
+	b, err := ioutil.ReadFile(c.PassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("read passphrase: %v", err)
+	}
+	p := bytes.TrimSpace(b)
+	if len(p) == 0 {
+		return nil, fmt.Errorf("passphrase file %s is empty", c.PassphraseFile)
+	}
+	return p, nil
+}
+
+// ensurePassphrase creates a random passphrase file when there is none,
+// so default backups are never written in plaintext. The admin is told to
+// keep a copy elsewhere, since the file itself is not backed up.
+func (c BackupEncCfg) ensurePassphrase() ([]byte, error) {
+	if _, err := os.Stat(c.PassphraseFile); !os.IsNotExist(err) {
+		return c.passphrase()
+	}
+	buf := make([]byte, 32)
+	if _, err := crand.Read(buf); err != nil {
+		return nil, err
+	}
+	pass := base64.RawURLEncoding.EncodeToString(buf)
+	if err := writeFileAtomic(c.PassphraseFile, []byte(pass+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("write passphrase: %v", err)
+	}
+	log.Println("generated backup passphrase in", c.PassphraseFile)
+	_ = notifyAdmin(fmt.Sprintf("🔐 *PASSPHRASE BACKUP DIBUAT*\n━━━━━━━━━━━━━━━━━━━━\nBackup sekarang dienkripsi dengan passphrase acak di `%s`.\n━━━━━━━━━━━━━━━━━━━━\n_Salin file tersebut ke tempat aman di luar server. Tanpa passphrase ini backup tidak bisa direstore._", c.PassphraseFile))
+	return []byte(pass), nil
+}
+
+// sealBackup encrypts plain with AES-256-GCM. The layout is
+// magic | iterations (4 bytes) | salt | nonce | ciphertext, and everything
+// before the ciphertext is authenticated as additional data.
+func sealBackup(plain, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, encSaltSize)
+	if _, err := crand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := pbkdf2.Key(passphrase, salt, pbkdf2Iter, encKeySize, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, len(encMagic)+4+len(salt)+len(nonce))
+	header = append(header, encMagic...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(encMagic):], pbkdf2Iter)
+	header = append(header, salt...)
+	header = append(header, nonce...)
+	return gcm.Seal(header, nonce, plain, header), nil
+}
+
+func openBackup(data, passphrase []byte) ([]byte, error) {
+	hdr := len(encMagic) + 4 + encSaltSize
+	if len(data) < hdr || string(data[:len(encMagic)]) != encMagic {
+		return nil, fmt.Errorf("not an encrypted backup")
+	}
+	iter := int(binary.BigEndian.Uint32(data[len(encMagic):]))
+	if iter < 1000 || iter > 10000000 {
+		return nil, fmt.Errorf("invalid encrypted backup header")
+	}
+	salt := data[len(encMagic)+4 : hdr]
+	key := pbkdf2.Key(passphrase, salt, iter, encKeySize, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < hdr+gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("encrypted backup is truncated")
+	}
+	nonce := data[hdr : hdr+gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, data[hdr+gcm.NonceSize():], data[:hdr+gcm.NonceSize()])
+	if err != nil {
+		return nil, fmt.Errorf("backup failed authentication: wrong passphrase or tampered archive")
+	}
+	return plain, nil
+}
+
+// encryptBackupFile encrypts src according to the configured mode and
+// returns the path and file name suffix of the result. With mode "none" it
+// returns src unchanged.
+func encryptBackupFile(src string, cfg BackupEncCfg) (string, string, error) {
+	switch cfg.Mode {
+	case "", "none":
+		return src, "", nil
+	case "passphrase":
+		pass, err := cfg.ensurePassphrase()
+		if err != nil {
+			return "", "", err
+		}
+		plain, err := ioutil.ReadFile(src)
+		if err != nil {
+			return "", "", err
+		}
+		sealed, err := sealBackup(plain, pass)
+		if err != nil {
+			return "", "", err
+		}
+		dst := src + ".enc"
+		return dst, ".enc", ioutil.WriteFile(dst, sealed, 0600)
+	case "age":
+		if len(cfg.Recipients) == 0 {
+			return "", "", fmt.Errorf("age encryption needs at least one recipient")
+		}
+		dst := src + ".age"
+		args := []string{"-o", dst}
+		for _, r := range cfg.Recipients {
+			args = append(args, "-r", r)
+		}
+		args = append(args, src)
+		if out, err := exec.Command("age", args...).CombinedOutput(); err != nil {
+			return "", "", fmt.Errorf("age: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return dst, ".age", nil
+	}
+	return "", "", fmt.Errorf("unknown backup encryption mode %q", cfg.Mode)
+}
+
+// decryptBackupFile detects an encrypted archive by its header and decrypts
+// it next to src. Plain zip files are returned as-is.
+func decryptBackupFile(src string, cfg BackupEncCfg) (string, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, len(ageMagic))
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+	head = head[:n]
+
+	dst := src + ".plain"
+	switch {
+	case bytes.HasPrefix(head, []byte(encMagic)):
+		pass, err := cfg.passphrase()
+		if err != nil {
+			return "", fmt.Errorf("%v; send the passphrase of the server that made the backup", err)
+		}
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return "", err
+		}
+		plain, err := openBackup(data, pass)
+		if err != nil {
+			return "", err
+		}
+		return dst, ioutil.WriteFile(dst, plain, 0600)
+	case bytes.HasPrefix(head, []byte(ageMagic)):
+		out, err := exec.Command("age", "-d", "-i", cfg.IdentityFile, "-o", dst, src).CombinedOutput()
+		if err != nil {
+			os.Remove(dst)
+			return "", fmt.Errorf("age: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return dst, nil
+	}
+	return src, nil
+}
+
+// BackupEncRequest changes the backup encryption; empty fields are kept.
+type BackupEncRequest struct {
+	Mode       string   `json:"mode"`
+	Passphrase string   `json:"passphrase"`
+	Recipients []string `json:"recipients"`
+}
+
+// BackupEncView is the GET /api/backup/encryption response. It includes
+// the passphrase so it can be set on the server a backup is restored on.
+type BackupEncView struct {
+	BackupEncCfg
+	Passphrase string `json:"passphrase"`
+}
+
+func backupEncView(cfg BackupEncCfg) BackupEncView {
+	v := BackupEncView{BackupEncCfg: cfg}
+	if pass, err := cfg.passphrase(); err == nil {
+		v.Passphrase = string(pass)
+	}
+	return v
+}
+
+// backupEncryptionHandler shows (GET) or changes (POST) the backup
+// encryption. A new passphrase only applies to backups made afterwards;
+// older ones need the old passphrase given with the restore.
+func backupEncryptionHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := loadBackupEncCfg()
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, 200, true, "OK", backupEncView(cfg))
+		return
+	case http.MethodPost:
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+
+	var req BackupEncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonResponse(w, 400, false, "Invalid request body", nil)
+		return
+	}
+	if req.Mode != "" {
+		cfg.Mode = req.Mode
+	}
+	if req.Recipients != nil {
+		cfg.Recipients = req.Recipients
+	}
+	switch cfg.Mode {
+	case "passphrase", "none":
+	case "age":
+		if len(cfg.Recipients) == 0 {
+			jsonResponse(w, 400, false, "age encryption needs at least one recipient", nil)
+			return
+		}
+	default:
+		jsonResponse(w, 400, false, fmt.Sprintf("unknown backup encryption mode %q", cfg.Mode), nil)
+		return
+	}
+	pass := strings.TrimSpace(req.Passphrase)
+	if pass != "" && len(pass) < minPassphrase {
+		jsonResponse(w, 400, false, fmt.Sprintf("passphrase must be at least %d characters", minPassphrase), nil)
+		return
+	}
+
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+	if pass != "" {
+		if err := writeFileAtomic(cfg.PassphraseFile, []byte(pass+"\n"), 0600); err != nil {
+			jsonResponse(w, 500, false, "write passphrase: "+err.Error(), nil)
+			return
+		}
+	}
+	b, _ := json.MarshalIndent(cfg, "", "  ")
+	if err := writeFileAtomic(BackupEncFile, b, 0600); err != nil {
+		jsonResponse(w, 500, false, "save config: "+err.Error(), nil)
+		return
+	}
+	jsonResponse(w, 200, true, "Backup encryption updated", backupEncView(cfg))
+}
+
+const (
+	APIVersion   = "1.1.0"
+	ManifestName = "manifest.json"
+	ManifestDir  = "/etc/zivpn/backups/manifests"
+)
+
+var backupFiles = []string{
+	ConfigFile, UserDB, DomainFile, ApiKeyFile,
+	"/etc/zivpn/bot-config.json",
+	"/etc/zivpn/zivpn.crt",
+	"/etc/zivpn/zivpn.key",
+}
+
+// requiredBackupFiles must exist for a backup to be considered successful.
+var requiredBackupFiles = []string{ConfigFile}
+
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type Manifest struct {
+	Version    int            `json:"version"`
+	APIVersion string         `json:"api_version"`
+	Created    time.Time      `json:"created"`
+	Hostname   string         `json:"hostname"`
+	Domain     string         `json:"domain"`
+	UserCount  int            `json:"user_count"`
+	Files      []ManifestFile `json:"files"`
+	Missing    []string       `json:"missing,omitempty"`
+}
+
+type VerifyFile struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type VerifyReport struct {
+	Valid    bool         `json:"valid"`
+	Manifest *Manifest    `json:"manifest,omitempty"`
+	Files    []VerifyFile `json:"files"`
+	Extra    []string     `json:"extra,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// createZip writes paths into dest along with a manifest.json describing
+// them. Missing optional files are recorded in the manifest; a missing
+// required file or any read/write error fails the backup.
+func createZip(dest string, paths []string) (*Manifest, error) {
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	host, _ := os.Hostname()
+	m := &Manifest{
+		Version:    1,
+		APIVersion: APIVersion,
+		Created:    time.Now().UTC(),
+		Hostname:   host,
+		Domain:     getDomain(),
+		UserCount:  countUsers().Total,
+	}
+
+	w := zip.NewWriter(f)
+	for _, p := range paths {
+		s, err := os.Stat(p)
+		if err != nil || s.IsDir() {
+			for _, req := range requiredBackupFiles {
+				if req == p {
+					w.Close()
+					return nil, fmt.Errorf("required file %s is missing", p)
+				}
+			}
+			m.Missing = append(m.Missing, filepath.Base(p))
+			continue
+		}
+		mf, err := addZipFile(w, p, s)
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("add %s: %v", p, err)
+		}
+		m.Files = append(m.Files, mf)
+	}
+
+	mb, _ := json.MarshalIndent(m, "", "  ")
+	mw, err := w.Create(ManifestName)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if _, err := mw.Write(mb); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return m, f.Sync()
+}
+
+func addZipFile(w *zip.Writer, p string, s os.FileInfo) (ManifestFile, error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer src.Close()
+
+	header, err := zip.FileInfoHeader(s)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	header.Name = filepath.Base(p)
+	header.Method = zip.Deflate
+	dst, err := w.CreateHeader(header)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), src)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{Name: header.Name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func readManifest(z *zip.Reader) (*Manifest, error) {
+	for _, f := range z.File {
+		if f.Name != ManifestName {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		var m Manifest
+		if err := json.NewDecoder(io.LimitReader(rc, 1<<20)).Decode(&m); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+		return &m, nil
+	}
+	return nil, nil
+}
+
+// verifyZip checks every file listed in the manifest against its recorded
+// size and SHA-256. Archives from before manifests existed are reported as
+// invalid with an explanatory error but still list their entries.
+func verifyZip(z *zip.Reader) VerifyReport {
+	rep := VerifyReport{Files: []VerifyFile{}}
+	m, err := readManifest(z)
+	if err != nil {
+		rep.Error = err.Error()
+		return rep
+	}
+	entries := map[string]*zip.File{}
+	for _, f := range z.File {
+		if f.Name != ManifestName {
+			entries[f.Name] = f
+		}
+	}
+	if m == nil {
+		rep.Error = "archive has no manifest"
+		for name := range entries {
+			rep.Extra = append(rep.Extra, name)
+		}
+		sort.Strings(rep.Extra)
+		return rep
+	}
+	rep.Manifest = m
+	rep.Valid = true
+	for _, mf := range m.Files {
+		vf := VerifyFile{Name: mf.Name}
+		f, ok := entries[mf.Name]
+		delete(entries, mf.Name)
+		if !ok {
+			vf.Reason = "missing from archive"
+		} else if sum, n, err := zipEntrySHA256(f); err != nil {
+			vf.Reason = err.Error()
+		} else if n != mf.Size {
+			vf.Reason = fmt.Sprintf("size %d, manifest says %d", n, mf.Size)
+		} else if sum != mf.SHA256 {
+			vf.Reason = "checksum mismatch"
+		} else {
+			vf.OK = true
+		}
+		if !vf.OK {
+			rep.Valid = false
+		}
+		rep.Files = append(rep.Files, vf)
+	}
+	for name := range entries {
+		rep.Extra = append(rep.Extra, name)
+	}
+	if len(rep.Extra) > 0 {
+		sort.Strings(rep.Extra)
+		rep.Valid = false
+		rep.Error = "archive contains files not listed in the manifest"
+	}
+	return rep
+}
+
+func zipEntrySHA256(f *zip.File) (string, int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, rc)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func manifestCachePath(name string) string {
+	return filepath.Join(ManifestDir, filepath.Base(name)+".json")
+}
+
+func cacheManifest(name string, m *Manifest) {
+	if m == nil {
+		return
+	}
+	if err := os.MkdirAll(ManifestDir, 0700); err != nil {
+		return
+	}
+	b, _ := json.MarshalIndent(m, "", "  ")
+	_ = ioutil.WriteFile(manifestCachePath(name), b, 0600)
+}
+
+func cachedManifest(name string) *Manifest {
+	b, err := ioutil.ReadFile(manifestCachePath(name))
+	if err != nil {
+		return nil
+	}
+	var m Manifest
+	if json.Unmarshal(b, &m) != nil {
+		return nil
+	}
+	return &m
+}
+
+// fetchBackup downloads a backup from the configured store and decrypts it
+// if needed, with passphrase instead of the local one when it is set. The
+// returned cleanup removes every temporary file.
+func fetchBackup(id, passphrase string) (string, func(), error) {
+	store, err := backupStore()
+	if err != nil {
+		return "", func() {}, err
+	}
+	tmp, err := ioutil.TempFile("", "zivpn-restore-*.zip")
+	if err != nil {
+		return "", func() {}, err
+	}
+	tmp.Close()
+	cleanup := func() { os.Remove(tmp.Name()) }
+	if err := store.Get(id, tmp.Name()); err != nil {
+		cleanup()
+		return "", func() {}, fmt.Errorf("download failed: %v", err)
+	}
+	archive, err := decryptBackupFile(tmp.Name(), loadBackupEncCfg().withPassphrase(passphrase))
+	if err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	if archive != tmp.Name() {
+		cleanup = func() {
+			os.Remove(tmp.Name())
+			os.Remove(archive)
+		}
+	}
+	return archive, cleanup, nil
+}
+
+// buildBackup writes an archive of backupFiles to BackupDir, encrypted
+// according to the backup encryption config. The caller must hold
+// backupMutex and call cleanup when done with the file.
+func buildBackup(progress func(int, string)) (path, name string, m *Manifest, cleanup func(), err error) {
+	cleanup = func() {}
+	filename := generateBackupID() + ".zip"
+	temp := filepath.Join(BackupDir, filename)
+
+	progress(10, "archiving")
+	m, err = createZip(temp, backupFiles)
+	if err != nil {
+		os.Remove(temp)
+		return "", "", nil, cleanup, fmt.Errorf("create archive: %v", err)
+	}
+
+	progress(30, "encrypting")
+	path, suffix, err := encryptBackupFile(temp, loadBackupEncCfg())
+	if err != nil {
+		os.Remove(temp)
+		return "", "", nil, cleanup, fmt.Errorf("encrypt failed: %v", err)
+	}
+	cleanup = func() {
+		os.Remove(temp)
+		os.Remove(path)
+	}
+	return path, filename + suffix, m, cleanup, nil
+}
+
+// runBackup builds a backup and uploads it to the configured store.
+// progress may be nil.
+func runBackup(progress func(int, string)) (BackupObject, *Manifest, string, error) {
+	if progress == nil {
+		progress = func(int, string) {}
+	}
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+
+	store, err := backupStore()
+	if err != nil {
+		metrics.backupDone(false)
+		return BackupObject{}, nil, "", err
+	}
+	if mode := loadBackupEncCfg().Mode; (mode == "" || mode == "none") && loadBackupStoreCfg().Type != "local" {
+		metrics.backupDone(false)
+		return BackupObject{}, nil, "", fmt.Errorf("backup encryption is off; refusing to upload the API key and bot token in plaintext to %s (set mode to passphrase or age)", store.Name())
+	}
+
+	upload, name, m, cleanup, err := buildBackup(progress)
+	defer cleanup()
+	if err != nil {
+		metrics.backupDone(false)
+		return BackupObject{}, nil, "", err
+	}
+
+	progress(50, "uploading")
+	obj, err := store.Put(upload, name)
+	if err != nil {
+		metrics.backupDone(false)
+		return BackupObject{}, nil, "", fmt.Errorf("upload failed: %v", err)
+	}
+
+	cacheManifest(obj.Name, m)
+	backupCountCache.invalidate()
+	metrics.backupDone(true)
+	return obj, m, store.Name(), nil
+}
+
+// ArchiveDir holds archives built for /api/backup/archive until they are
+// downloaded or older than archiveTTL.
+var ArchiveDir = "/etc/zivpn/backups/archives"
+
+const archiveTTL = time.Hour
+
+// ArchiveResult is the result of an archive job.
+type ArchiveResult struct {
+	ArchiveID string    `json:"archive_id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Manifest  *Manifest `json:"manifest"`
+}
+
+// archiveJob builds a backup into ArchiveDir instead of uploading it, so it
+// works without any backup store.
+func archiveJob(progress func(int, string)) (interface{}, string, error) {
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+	sweepArchives(archiveTTL)
+
+	path, name, m, cleanup, err := buildBackup(progress)
+	defer cleanup()
+	if err == nil {
+		err = os.MkdirAll(ArchiveDir, 0700)
+	}
+	id := generateBackupID()
+	dst := filepath.Join(ArchiveDir, id)
+	if err == nil {
+		err = os.Rename(path, dst)
+	}
+	if err != nil {
+		metrics.backupDone(false)
+		return nil, "Backup failed", err
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		metrics.backupDone(false)
+		return nil, "Backup failed", err
+	}
+	metrics.backupDone(true)
+	return ArchiveResult{ArchiveID: id, Filename: name, Size: fi.Size(), Manifest: m}, "Archive ready", nil
+}
+
+// sweepArchives removes archives that were never downloaded.
+func sweepArchives(maxAge time.Duration) {
+	entries, err := ioutil.ReadDir(ArchiveDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if time.Since(e.ModTime()) > maxAge {
+			os.Remove(filepath.Join(ArchiveDir, e.Name()))
+		}
+	}
+}
+
+// backupArchiveHandler serves POST /api/backup/archive, which starts an
+// archive job, and GET /api/backup/archive?job=<job_id>, which streams the
+// finished archive once and then deletes it.
+func backupArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		j, started := jobs.submit("archive", false, archiveJob)
+		jobAccepted(w, j, started)
+		return
+	case http.MethodGet:
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+
+	j, ok := jobs.get(r.URL.Query().Get("job"))
+	if !ok || j.Type != "archive" {
+		jsonResponse(w, 404, false, "Archive job not found", nil)
+		return
+	}
+	if j.Status != JobSucceeded {
+		jsonResponse(w, 409, false, "Archive job is "+j.Status, nil)
+		return
+	}
+	// Jobs loaded from disk hold the result as a plain map.
+	var res ArchiveResult
+	b, _ := json.Marshal(j.Result)
+	if json.Unmarshal(b, &res) != nil || res.ArchiveID == "" || res.Manifest == nil {
+		jsonResponse(w, 500, false, "Archive job has no result", nil)
+		return
+	}
+	f, err := os.Open(filepath.Join(ArchiveDir, filepath.Base(res.ArchiveID)))
+	if err != nil {
+		jsonResponse(w, 410, false, "Archive was already downloaded or has expired", nil)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", res.Filename))
+	w.Header().Set("Content-Length", strconv.FormatInt(res.Size, 10))
+	w.Header().Set("X-Backup-Users", strconv.Itoa(res.Manifest.UserCount))
+	w.Header().Set("X-Backup-Created", res.Manifest.Created.Format(time.RFC3339))
+	if _, err := io.Copy(w, f); err == nil {
+		os.Remove(f.Name())
+	}
+}
+
+func handleBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	j, started := jobs.submit("backup", true, func(progress func(int, string)) (interface{}, string, error) {
+		obj, m, storeName, err := runBackup(progress)
+		if err != nil {
+			return nil, "Backup failed", err
+		}
+		return map[string]interface{}{
+			"backup_id":    obj.ID,
+			"filename":     obj.Name,
+			"download_url": obj.DownloadURL,
+			"store":        storeName,
+			"manifest":     m,
+		}, "Backup success", nil
+	})
+	jobAccepted(w, j, started)
+}
+
+type BackupListItem struct {
+	BackupObject
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+func listBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	store, err := backupStore()
+	if err != nil {
+		jsonResponse(w, 500, false, err.Error(), nil)
+		return
+	}
+	list, err := store.List()
+	if err != nil {
+		jsonResponse(w, 500, false, err.Error(), nil)
+		return
+	}
+	out := []BackupListItem{}
+	for _, o := range list {
+		out = append(out, BackupListItem{BackupObject: o, Manifest: cachedManifest(o.Name)})
+	}
+	jsonResponse(w, 200, true, "OK", out)
+}
+
+func verifyBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	var req BackupRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	if req.BackupID == "" {
+		jsonResponse(w, 400, false, "Invalid backup ID", nil)
+		return
+	}
+
+	archive, cleanup, err := fetchBackup(req.BackupID, req.Passphrase)
+	if err != nil {
+		jsonResponse(w, 500, false, err.Error(), nil)
+		return
+	}
+	defer cleanup()
+
+	z, err := zip.OpenReader(archive)
+	if err != nil {
+		jsonResponse(w, 422, false, "Backup is not a valid zip archive", VerifyReport{Files: []VerifyFile{}, Error: err.Error()})
+		return
+	}
+	defer z.Close()
+
+	rep := verifyZip(&z.Reader)
+	if rep.Manifest != nil {
+		if store, err := backupStore(); err == nil {
+			if list, err := store.List(); err == nil {
+				for _, o := range list {
+					if o.ID == req.BackupID || o.Name == req.BackupID {
+						cacheManifest(o.Name, rep.Manifest)
+					}
+				}
+			}
+		}
+	}
+	if !rep.Valid {
+		jsonResponse(w, 422, false, "Backup failed verification", rep)
+		return
+	}
+	jsonResponse(w, 200, true, "Backup is valid", rep)
+}
+
+const (
+	SnapshotDir     = "/etc/zivpn/backups/snapshots"
+	SnapshotKeep    = 5
+	maxRestoreEntry = 16 << 20
+	healthTimeout   = 15 * time.Second
+)
+
+type restoreTarget struct {
+	Path string
+	Mode os.FileMode
+}
+
+// restorableFiles is the allowlist of archive entries restore will write.
+// Anything else in an archive is ignored.
+var restorableFiles = map[string]restoreTarget{
+	"config.json":     {ConfigFile, 0644},
+	"users.db":        {UserDB, 0644},
+	"domain":          {DomainFile, 0644},
+	"apikey":          {ApiKeyFile, 0600},
+	"bot-config.json": {BotConfigFile, 0600},
+	"zivpn.crt":       {"/etc/zivpn/zivpn.crt", 0644},
+	"zivpn.key":       {"/etc/zivpn/zivpn.key", 0600},
+}
+
+type RestoreRequest struct {
+	BackupID   string `json:"backup_id"`
+	DryRun     bool   `json:"dry_run"`
+	Mode       string `json:"mode"`
+	Strategy   string `json:"strategy"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// userFiles and configFiles split the allowlist for selective restores.
+// config.json belongs to both: its auth section holds the users and the
+// rest is server configuration.
+var (
+	userFiles   = []string{"users.db", "config.json"}
+	configFiles = []string{"config.json", "domain", "apikey", "bot-config.json", "zivpn.crt", "zivpn.key"}
+)
+
+type RestoreFileChange struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+type UserChange struct {
+	Password string `json:"password"`
+	Old      string `json:"old_expired,omitempty"`
+	New      string `json:"new_expired,omitempty"`
+}
+
+type UserDiff struct {
+	Added   []UserChange `json:"added"`
+	Removed []UserChange `json:"removed"`
+	Changed []UserChange `json:"changed"`
+}
+
+type RestoreResult struct {
+	DryRun     bool                `json:"dry_run"`
+	Mode       string              `json:"mode"`
+	Strategy   string              `json:"strategy"`
+	Files      []RestoreFileChange `json:"files"`
+	Users      UserDiff            `json:"users"`
+	Snapshot   string              `json:"snapshot,omitempty"`
+	Healthy    bool                `json:"healthy"`
+	RolledBack bool                `json:"rolled_back"`
+}
+
+// readRestoreEntries validates every archive entry and returns the contents
+// of the allowlisted ones. Entry names containing a path are rejected
+// outright since backups are always flat.
+func readRestoreEntries(z *zip.Reader) (map[string][]byte, []RestoreFileChange, error) {
+	files := map[string][]byte{}
+	var ignored []RestoreFileChange
+	for _, f := range z.File {
+		name := f.Name
+		if name == ManifestName {
+			continue
+		}
+		if name != filepath.Base(name) || strings.ContainsAny(name, `/\`) || name == ".." || name == "." {
+			return nil, nil, fmt.Errorf("archive entry %q has an unsafe path", name)
+		}
+		if _, ok := restorableFiles[name]; !ok || !f.Mode().IsRegular() {
+			ignored = append(ignored, RestoreFileChange{Name: name, Action: "ignored"})
+			continue
+		}
+		if f.UncompressedSize64 > maxRestoreEntry {
+			return nil, nil, fmt.Errorf("archive entry %q is too large", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(rc, maxRestoreEntry+1))
+		rc.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s: %v", name, err)
+		}
+		if len(b) > maxRestoreEntry {
+			return nil, nil, fmt.Errorf("archive entry %q is too large", name)
+		}
+		files[name] = b
+	}
+	if b, ok := files["config.json"]; ok {
+		var cfg Config
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("config.json in backup is invalid: %v", err)
+		}
+	}
+	return files, ignored, nil
+}
+
+func parseUserDB(b []byte) map[string]string {
+	out := map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 2 {
+			continue
+		}
+		out[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return out
+}
+
+func diffUsers(oldDB, newDB []byte) UserDiff {
+	d := UserDiff{Added: []UserChange{}, Removed: []UserChange{}, Changed: []UserChange{}}
+	before, after := parseUserDB(oldDB), parseUserDB(newDB)
+	for p, exp := range after {
+		old, ok := before[p]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, UserChange{Password: p, New: exp})
+		case old != exp:
+			d.Changed = append(d.Changed, UserChange{Password: p, Old: old, New: exp})
+		}
+	}
+	for p, exp := range before {
+		if _, ok := after[p]; !ok {
+			d.Removed = append(d.Removed, UserChange{Password: p, Old: exp})
+		}
+	}
+	for _, l := range [][]UserChange{d.Added, d.Removed, d.Changed} {
+		sort.Slice(l, func(i, j int) bool { return l[i].Password < l[j].Password })
+	}
+	return d
+}
+
+// mergeUserDB unions two users.db files. When a password is in both, the
+// later expiry wins. Fields after the expiry (the note) come from the
+// winning line, or from the other one when the winner has none. Existing
+// entries keep their order, new ones follow.
+func mergeUserDB(cur, incoming []byte) []byte {
+	exp := map[string]string{}
+	extra := map[string][]string{}
+	var order []string
+	for _, db := range [][]byte{cur, incoming} {
+		for _, line := range strings.Split(string(db), "\n") {
+			parts := strings.Split(line, "|")
+			if len(parts) < 2 {
+				continue
+			}
+			p, e := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			old, seen := exp[p]
+			if !seen {
+				order = append(order, p)
+			}
+			if !seen || e > old {
+				exp[p] = e
+				if len(parts) > 2 || !seen {
+					extra[p] = parts[2:]
+				}
+			} else if len(extra[p]) == 0 {
+				extra[p] = parts[2:]
+			}
+		}
+	}
+	var lines []string
+	for _, p := range order {
+		fields := append([]string{p + " ", " " + exp[p] + " "}, extra[p]...)
+		lines = append(lines, strings.TrimSpace(strings.Join(fields, "|")))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func unionStrings(a, b []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, l := range [][]string{a, b} {
+		for _, x := range l {
+			if !seen[x] {
+				seen[x] = true
+				out = append(out, x)
+			}
+		}
+	}
+	return out
+}
+
+// mergeAuth keeps the auth.config membership of users already in the
+// current users.db, so a merge never re-enables a suspended account, and
+// only adds the backup's enabled users that are new here.
+func mergeAuth(cur []string, curDB []byte, backup []string) []string {
+	known := map[string]bool{}
+	for _, p := range authFromUserDB(curDB) {
+		known[p] = true
+	}
+	for _, p := range cur {
+		known[p] = true
+	}
+	var add []string
+	for _, p := range backup {
+		if !known[p] {
+			add = append(add, p)
+		}
+	}
+	return unionStrings(cur, add)
+}
+
+func authFromUserDB(db []byte) []string {
+	var out []string
+	for _, line := range strings.Split(string(db), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) >= 2 {
+			out = append(out, strings.TrimSpace(parts[0]))
+		}
+	}
+	return out
+}
+
+// selectRestoreFiles narrows the archive contents to what the requested
+// mode restores and applies the merge strategy to the user data. It reads
+// the current config.json and users.db, so callers must hold mutex.
+func selectRestoreFiles(files map[string][]byte, req RestoreRequest) (map[string][]byte, error) {
+	keep := map[string]bool{}
+	switch req.Mode {
+	case "users":
+		for _, n := range userFiles {
+			keep[n] = true
+		}
+	case "config":
+		for _, n := range configFiles {
+			keep[n] = true
+		}
+	default:
+		for n := range restorableFiles {
+			keep[n] = true
+		}
+	}
+	out := map[string][]byte{}
+	for n, b := range files {
+		if keep[n] {
+			out[n] = b
+		}
+	}
+
+	curDB, _ := ioutil.ReadFile(UserDB)
+	if db, ok := out["users.db"]; ok && req.Strategy == "merge" {
+		out["users.db"] = mergeUserDB(curDB, db)
+	}
+
+	curRaw, curErr := ioutil.ReadFile(ConfigFile)
+	var cur Config
+	if curErr == nil {
+		if err := json.Unmarshal(curRaw, &cur); err != nil {
+			curErr = err
+		}
+	}
+
+	var backupAuth []string
+	if b, ok := files["config.json"]; ok {
+		var bc Config
+		_ = json.Unmarshal(b, &bc)
+		backupAuth = bc.Auth.Config
+	} else if db, ok := files["users.db"]; ok {
+		backupAuth = authFromUserDB(db)
+	}
+
+	switch req.Mode {
+	case "users":
+		if _, ok := files["users.db"]; !ok && files["config.json"] == nil {
+			return nil, fmt.Errorf("archive contains no user data")
+		}
+		if curErr != nil {
+			return nil, fmt.Errorf("users-only restore needs a readable %s: %v", ConfigFile, curErr)
+		}
+		if req.Strategy == "merge" {
+			cur.Auth.Config = mergeAuth(cur.Auth.Config, curDB, backupAuth)
+		} else {
+			cur.Auth.Config = backupAuth
+		}
+		b, _ := marshalConfig(cur)
+		out["config.json"] = b
+	case "config":
+		if b, ok := out["config.json"]; ok && curErr == nil {
+			var bc Config
+			_ = json.Unmarshal(b, &bc)
+			bc.Auth.Config = cur.Auth.Config
+			nb, _ := marshalConfig(bc)
+			out["config.json"] = nb
+		}
+	default:
+		if b, ok := out["config.json"]; ok && req.Strategy == "merge" && curErr == nil {
+			var bc Config
+			_ = json.Unmarshal(b, &bc)
+			bc.Auth.Config = mergeAuth(cur.Auth.Config, curDB, bc.Auth.Config)
+			nb, _ := marshalConfig(bc)
+			out["config.json"] = nb
+		}
+	}
+	return out, nil
+}
+
+// writeFileAtomic replaces path via a temp file in the same directory so a
+// crash never leaves a half-written config behind.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// snapshotFiles copies every restorable file that currently exists into a
+// new timestamped directory and prunes old snapshots.
+func snapshotFiles() (string, error) {
+	dir := filepath.Join(SnapshotDir, time.Now().Format("20060102-150405.000"))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	for name, t := range restorableFiles {
+		b, err := ioutil.ReadFile(t.Path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			return "", err
+		}
+	}
+	if entries, err := ioutil.ReadDir(SnapshotDir); err == nil && len(entries) > SnapshotKeep {
+		for _, e := range entries[:len(entries)-SnapshotKeep] {
+			_ = os.RemoveAll(filepath.Join(SnapshotDir, e.Name()))
+		}
+	}
+	return dir, nil
+}
+
+// rollbackSnapshot puts back the files captured by snapshotFiles, removing
+// files that did not exist when the snapshot was taken.
+func rollbackSnapshot(dir string) error {
+	var firstErr error
+	for name, t := range restorableFiles {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			_ = os.Remove(t.Path)
+			continue
+		}
+		if err == nil {
+			err = writeFileAtomic(t.Path, b, t.Mode)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// restartCore restarts zivpn.service synchronously and waits for it to stay
+// active, unlike restartAll which fires and forgets.
+func restartCore() error {
+	metrics.restarted()
+	if out, err := exec.Command("systemctl", "restart", "zivpn.service").CombinedOutput(); err != nil {
+		return fmt.Errorf("restart zivpn.service: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	deadline := time.Now().Add(healthTimeout)
+	stable := 0
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		if isActive("zivpn.service") {
+			stable++
+			if stable >= 3 {
+				return nil
+			}
+		} else {
+			stable = 0
+		}
+	}
+	return fmt.Errorf("zivpn.service did not become healthy within %s", healthTimeout)
+}
+
+func reloadAuthToken() {
+	if b, err := ioutil.ReadFile(ApiKeyFile); err == nil {
+		setAuthToken(strings.TrimSpace(string(b)))
+	}
+}
+
+// normalizeRestoreRequest fills in the default mode and strategy and
+// rejects unknown values.
+func normalizeRestoreRequest(req *RestoreRequest) error {
+	switch req.Mode {
+	case "":
+		req.Mode = "full"
+	case "full", "users", "config":
+	default:
+		return fmt.Errorf("invalid mode %q, use full, users or config", req.Mode)
+	}
+	switch req.Strategy {
+	case "":
+		req.Strategy = "replace"
+	case "replace", "merge":
+	default:
+		return fmt.Errorf("invalid strategy %q, use replace or merge", req.Strategy)
+	}
+	return nil
+}
+
+// restoreArchive applies an already downloaded and decrypted archive. With
+// DryRun it only reports what would change.
+func restoreArchive(archive string, req RestoreRequest) (RestoreResult, int, error) {
+	if err := normalizeRestoreRequest(&req); err != nil {
+		return RestoreResult{}, 400, err
+	}
+	res := RestoreResult{DryRun: req.DryRun, Mode: req.Mode, Strategy: req.Strategy, Files: []RestoreFileChange{}}
+
+	z, err := zip.OpenReader(archive)
+	if err != nil {
+		return res, 400, fmt.Errorf("invalid archive: %v", err)
+	}
+	defer z.Close()
+
+	if rep := verifyZip(&z.Reader); rep.Manifest != nil && !rep.Valid {
+		return res, 400, fmt.Errorf("backup failed verification: %s", rep.Error)
+	}
+
+	files, ignored, err := readRestoreEntries(&z.Reader)
+	if err != nil {
+		return res, 400, err
+	}
+	if len(files) == 0 {
+		return res, 400, fmt.Errorf("archive contains no restorable files")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	files, err = selectRestoreFiles(files, req)
+	if err != nil {
+		return res, 400, err
+	}
+	if len(files) == 0 {
+		return res, 400, fmt.Errorf("archive contains nothing to restore in %s mode", req.Mode)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		action := "create"
+		if cur, err := ioutil.ReadFile(restorableFiles[name].Path); err == nil {
+			action = "update"
+			if bytes.Equal(cur, files[name]) {
+				action = "unchanged"
+			}
+		}
+		res.Files = append(res.Files, RestoreFileChange{Name: name, Action: action})
+	}
+	res.Files = append(res.Files, ignored...)
+
+	curUsers, _ := ioutil.ReadFile(UserDB)
+	newUsers, ok := files["users.db"]
+	if !ok {
+		newUsers = curUsers
+	}
+	res.Users = diffUsers(curUsers, newUsers)
+
+	if req.DryRun {
+		return res, 200, nil
+	}
+
+	snap, err := snapshotFiles()
+	if err != nil {
+		return res, 500, fmt.Errorf("pre-restore snapshot failed: %v", err)
+	}
+	res.Snapshot = snap
+
+	for _, name := range names {
+		t := restorableFiles[name]
+		if err := writeFileAtomic(t.Path, files[name], t.Mode); err != nil {
+			_ = rollbackSnapshot(snap)
+			res.RolledBack = true
+			return res, 500, fmt.Errorf("write %s: %v", name, err)
+		}
+	}
+
+	if err := restartCore(); err != nil {
+		log.Println("restore health check:", err)
+		if rerr := rollbackSnapshot(snap); rerr != nil {
+			return res, 500, fmt.Errorf("%v; rollback failed: %v", err, rerr)
+		}
+		res.RolledBack = true
+		reloadAuthToken()
+		if rerr := restartCore(); rerr != nil {
+			return res, 500, fmt.Errorf("%v; rolled back but service is still unhealthy: %v", err, rerr)
+		}
+		return res, 500, fmt.Errorf("%v; previous configuration restored", err)
+	}
+	res.Healthy = true
+	reloadAuthToken()
+	if changed := restoredPasswords(res.Users); len(changed) > 0 {
+		userChanged(changed...)
+	}
+	return res, 200, nil
+}
+
+// restoredPasswords lists the users a restore added or changed so they can
+// be stamped for sync like any other edit.
+func restoredPasswords(d UserDiff) []string {
+	var out []string
+	for _, l := range [][]UserChange{d.Added, d.Changed} {
+		for _, c := range l {
+			out = append(out, c.Password)
+		}
+	}
+	return out
+}
+
+// restoreJob returns a job that obtains an archive with fetch and restores
+// it. Store and upload restores share it so both get the same checks,
+// snapshot and rollback.
+func restoreJob(req RestoreRequest, fetch func() (string, func(), error)) jobFunc {
+	return func(progress func(int, string)) (interface{}, string, error) {
+		progress(10, "downloading")
+		archive, cleanup, err := fetch()
+		if err != nil {
+			return nil, "Restore failed", err
+		}
+		defer cleanup()
+
+		progress(50, "restoring")
+		res, _, err := restoreArchive(archive, req)
+		if err != nil {
+			if res.Mode == "" {
+				return nil, "Restore failed", err
+			}
+			return res, "Restore failed", err
+		}
+		if req.DryRun {
+			return res, "Dry run, nothing changed", nil
+		}
+		return res, "Restore completed successfully", nil
+	}
+}
+
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	var req RestoreRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	if req.BackupID == "" {
+		jsonResponse(w, 400, false, "Invalid backup ID", nil)
+		return
+	}
+	if err := normalizeRestoreRequest(&req); err != nil {
+		jsonResponse(w, 400, false, err.Error(), nil)
+		return
+	}
+
+	j, started := jobs.submit("restore", false, restoreJob(req, func() (string, func(), error) {
+		return fetchBackup(req.BackupID, req.Passphrase)
+	}))
+	jobAccepted(w, j, started)
+}
+
+const (
+	UploadDir        = "/etc/zivpn/backups/uploads"
+	maxRestoreUpload = 64 << 20
+	maxFormField     = 1 << 10
+)
+
+// saveRestoreUpload streams the multipart body into a private file under
+// UploadDir without buffering it in memory. Only the fields file, mode,
+// strategy, dry_run and passphrase are accepted.
+func saveRestoreUpload(w http.ResponseWriter, r *http.Request) (path, filename string, fields map[string]string, status int, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRestoreUpload+64<<10)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return "", "", nil, 400, fmt.Errorf("expected multipart/form-data: %v", err)
+	}
+	if err := os.MkdirAll(UploadDir, 0700); err != nil {
+		return "", "", nil, 500, err
+	}
+	_ = os.Chmod(UploadDir, 0700)
+
+	fields = map[string]string{}
+	fail := func(status int, err error) (string, string, map[string]string, int, error) {
+		if path != "" {
+			os.Remove(path)
+		}
+		return "", "", nil, status, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if strings.Contains(err.Error(), "request body too large") {
+				return fail(413, fmt.Errorf("upload exceeds %d MB", maxRestoreUpload>>20))
+			}
+			return fail(400, fmt.Errorf("invalid upload: %v", err))
+		}
+		name := part.FormName()
+		switch name {
+		case "mode", "strategy", "dry_run", "passphrase":
+			b, err := ioutil.ReadAll(io.LimitReader(part, maxFormField))
+			if err != nil {
+				return fail(400, fmt.Errorf("invalid upload: %v", err))
+			}
+			fields[name] = strings.TrimSpace(string(b))
+		case "file":
+			if path != "" {
+				return fail(400, fmt.Errorf("only one file may be uploaded"))
+			}
+			tmp, err := ioutil.TempFile(UploadDir, "upload-*")
+			if err != nil {
+				return fail(500, err)
+			}
+			path = tmp.Name()
+			filename = filepath.Base(part.FileName())
+			if filename == "." || filename == "/" {
+				filename = "upload"
+			}
+			n, err := io.Copy(tmp, io.LimitReader(part, maxRestoreUpload+1))
+			tmp.Close()
+			if err != nil {
+				if strings.Contains(err.Error(), "request body too large") {
+					return fail(413, fmt.Errorf("upload exceeds %d MB", maxRestoreUpload>>20))
+				}
+				return fail(400, fmt.Errorf("upload interrupted: %v", err))
+			}
+			if n > maxRestoreUpload {
+				return fail(413, fmt.Errorf("upload exceeds %d MB", maxRestoreUpload>>20))
+			}
+			if n == 0 {
+				return fail(400, fmt.Errorf("uploaded file is empty"))
+			}
+		default:
+			return fail(400, fmt.Errorf("unexpected form field %q", name))
+		}
+		part.Close()
+	}
+	if path == "" {
+		return fail(400, fmt.Errorf("missing file"))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fail(500, err)
+	}
+	head := make([]byte, len(ageMagic))
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+	head = head[:n]
+	if !bytes.HasPrefix(head, []byte("PK\x03\x04")) && !bytes.HasPrefix(head, []byte(encMagic)) && !bytes.HasPrefix(head, []byte(ageMagic)) {
+		return fail(415, fmt.Errorf("file is not a zip, .zip.enc or .zip.age backup"))
+	}
+	return path, filename, fields, 200, nil
+}
+
+// restoreUploadHandler restores from an archive sent as the multipart
+// field "file" instead of one fetched from the backup store. The form
+// fields mode, strategy, dry_run and passphrase match the /api/restore body.
+func restoreUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	path, filename, fields, status, err := saveRestoreUpload(w, r)
+	if err != nil {
+		jsonResponse(w, status, false, err.Error(), nil)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(fields["dry_run"])
+	req := RestoreRequest{
+		BackupID:   filename,
+		DryRun:     dryRun,
+		Mode:       fields["mode"],
+		Strategy:   fields["strategy"],
+		Passphrase: fields["passphrase"],
+	}
+	if err := normalizeRestoreRequest(&req); err != nil {
+		os.Remove(path)
+		jsonResponse(w, 400, false, err.Error(), nil)
+		return
+	}
+
+	j, started := jobs.submit("restore", false, restoreJob(req, func() (string, func(), error) {
+		archive, err := decryptBackupFile(path, loadBackupEncCfg().withPassphrase(req.Passphrase))
+		if err != nil {
+			os.Remove(path)
+			return "", func() {}, err
+		}
+		return archive, func() {
+			os.Remove(path)
+			os.Remove(archive)
+		}, nil
+	}))
+	jobAccepted(w, j, started)
+}
+
+// cleanUploads removes uploads left behind by an API restart mid-restore.
+func cleanUploads() {
+	entries, err := ioutil.ReadDir(UploadDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		os.Remove(filepath.Join(UploadDir, e.Name()))
+	}
+}
+
+// ServerConfig is the part of config.json managed by /api/server/config.
+type ServerConfig struct {
+	Listen   string `json:"listen"`
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	Obfs     string `json:"obfs"`
+	AuthMode string `json:"auth_mode"`
+}
+
+// ServerConfigPatch holds the fields to change; nil fields are kept.
+type ServerConfigPatch struct {
+	Listen   *string `json:"listen"`
+	Cert     *string `json:"cert"`
+	Key      *string `json:"key"`
+	Obfs     *string `json:"obfs"`
+	AuthMode *string `json:"auth_mode"`
+	DryRun   bool    `json:"dry_run"`
+}
+
+type ConfigChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+type ServerConfigResult struct {
+	DryRun     bool           `json:"dry_run"`
+	Changes    []ConfigChange `json:"changes"`
+	Config     ServerConfig   `json:"config"`
+	Snapshot   string         `json:"snapshot,omitempty"`
+	Healthy    bool           `json:"healthy"`
+	RolledBack bool           `json:"rolled_back"`
+}
+
+func serverConfigOf(cfg Config) ServerConfig {
+	return ServerConfig{Listen: cfg.Listen, Cert: cfg.Cert, Key: cfg.Key, Obfs: cfg.Obfs, AuthMode: cfg.Auth.Mode}
+}
+
+func validateListen(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("listen must be host:port or :port: %v", err)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("listen host %q is not an IP address", host)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("listen port %q must be 1-65535", port)
+	}
+	if ":"+port == Port {
+		return fmt.Errorf("listen port %s is used by the API", port)
+	}
+	return nil
+}
+
+// validateObfs allows 1-64 printable ASCII characters without spaces or
+// quotes, which every client app accepts in its obfs field.
+func validateObfs(s string) error {
+	if s == "" || len(s) > 64 {
+		return fmt.Errorf("obfs must be 1-64 characters")
+	}
+	for _, c := range s {
+		if c <= ' ' || c > '~' || c == '"' || c == '\'' || c == '\\' {
+			return fmt.Errorf("obfs may only contain printable ASCII without spaces or quotes")
+		}
+	}
+	return nil
+}
+
+func validateServerConfig(sc ServerConfig) error {
+	if err := validateListen(sc.Listen); err != nil {
+		return err
+	}
+	if _, err := tls.LoadX509KeyPair(sc.Cert, sc.Key); err != nil {
+		return fmt.Errorf("cert/key pair cannot be loaded: %v", err)
+	}
+	if err := validateObfs(sc.Obfs); err != nil {
+		return err
+	}
+	if sc.AuthMode != "passwords" {
+		return fmt.Errorf("auth_mode %q is not supported, use passwords", sc.AuthMode)
+	}
+	return nil
+}
+
+func diffServerConfig(a, b ServerConfig) []ConfigChange {
+	out := []ConfigChange{}
+	add := func(field, o, n string) {
+		if o != n {
+			out = append(out, ConfigChange{Field: field, Old: o, New: n})
+		}
+	}
+	add("listen", a.Listen, b.Listen)
+	add("cert", a.Cert, b.Cert)
+	add("key", a.Key, b.Key)
+	add("obfs", a.Obfs, b.Obfs)
+	add("auth_mode", a.AuthMode, b.AuthMode)
+	return out
+}
+
+// applyServerConfig writes cfg atomically, restarts the core and puts the
+// previous files back if the service does not come up healthy. The caller
+// must hold mutex.
+func applyServerConfig(cfg Config, res *ServerConfigResult) error {
+	snap, err := snapshotFiles()
+	if err != nil {
+		return fmt.Errorf("snapshot failed: %v", err)
+	}
+	res.Snapshot = snap
+
+	b, err := marshalConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(ConfigFile, b, 0644); err != nil {
+		return fmt.Errorf("write config: %v", err)
+	}
+
+	if err := restartCore(); err != nil {
+		log.Println("server config health check:", err)
+		if rerr := rollbackSnapshot(snap); rerr != nil {
+			return fmt.Errorf("%v; rollback failed: %v", err, rerr)
+		}
+		res.RolledBack = true
+		if rerr := restartCore(); rerr != nil {
+			return fmt.Errorf("%v; rolled back but service is still unhealthy: %v", err, rerr)
+		}
+		return fmt.Errorf("%v; previous configuration restored", err)
+	}
+	res.Healthy = true
+	return nil
+}
+
+// serverConfigHandler serves GET (current settings) and PATCH (validate,
+// preview and apply) on /api/server/config. A PATCH that changes anything
+// runs as a job because the health check can take several seconds.
+func serverConfigHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		cfg, err := loadConfig()
+		if err != nil {
+			jsonResponse(w, 500, false, "Read config error", nil)
+			return
+		}
+		jsonResponse(w, 200, true, "OK", serverConfigOf(cfg))
+		return
+	case http.MethodPatch, http.MethodPost:
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+
+	var p ServerConfigPatch
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		jsonResponse(w, 400, false, "Invalid request", nil)
+		return
+	}
+
+	mutex.Lock()
+	cfg, err := loadConfig()
+	mutex.Unlock()
+	if err != nil {
+		jsonResponse(w, 500, false, "Read config error", nil)
+		return
+	}
+	cur := serverConfigOf(cfg)
+	next := cur
+	for _, f := range []struct {
+		src *string
+		dst *string
+	}{{p.Listen, &next.Listen}, {p.Cert, &next.Cert}, {p.Key, &next.Key}, {p.Obfs, &next.Obfs}, {p.AuthMode, &next.AuthMode}} {
+		if f.src != nil {
+			*f.dst = strings.TrimSpace(*f.src)
+		}
+	}
+	if err := validateServerConfig(next); err != nil {
+		jsonResponse(w, 400, false, err.Error(), nil)
+		return
+	}
+
+	res := ServerConfigResult{DryRun: p.DryRun, Changes: diffServerConfig(cur, next), Config: next}
+	if p.DryRun || len(res.Changes) == 0 {
+		msg := "Dry run, nothing changed"
+		if len(res.Changes) == 0 {
+			msg = "No changes"
+		}
+		jsonResponse(w, 200, true, msg, res)
+		return
+	}
+
+	j, started := jobs.submit("server-config", true, func(progress func(int, string)) (interface{}, string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cfg, err := loadConfig()
+		if err != nil {
+			return nil, "Apply failed", err
+		}
+		if serverConfigOf(cfg) != cur {
+			return nil, "Apply failed", fmt.Errorf("config.json changed since the preview, try again")
+		}
+		cfg.Listen, cfg.Cert, cfg.Key, cfg.Obfs, cfg.Auth.Mode = next.Listen, next.Cert, next.Key, next.Obfs, next.AuthMode
+
+		progress(30, "applying")
+		if err := applyServerConfig(cfg, &res); err != nil {
+			return res, "Apply failed", err
+		}
+		if next.Obfs != cur.Obfs {
+			obfsChanged(next.Obfs)
+		}
+		if next.Listen != cur.Listen {
+			refreshBanScope()
+			if err := resyncDNAT(listenPort()); err != nil {
+				return res, "Server config updated, but port forwarding was not moved to the new port", err
+			}
+		}
+		return res, "Server config updated", nil
+	})
+	jobAccepted(w, j, started)
+}
+
+var ObfsRotationFile = "/etc/zivpn/obfs-rotation.json"
+
+const (
+	obfsAlphabet   = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	obfsRetryDelay = 30 * time.Second
+)
+
+// ObfsRotation is a pending switch to a new obfs value.
+type ObfsRotation struct {
+	Obfs    string    `json:"obfs"`
+	At      time.Time `json:"at"`
+	Created time.Time `json:"created"`
+}
+
+type ObfsRotateRequest struct {
+	Obfs   string `json:"obfs"`
+	Length int    `json:"length"`
+	At     string `json:"at"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// AccountCard holds what a customer needs to configure the client app.
+type AccountCard struct {
+	Password string     `json:"password"`
+	Expired  string     `json:"expired"`
+	Domain   string     `json:"domain"`
+	Obfs     string     `json:"obfs"`
+	Port     string     `json:"port"`
+	NextObfs string     `json:"next_obfs,omitempty"`
+	SwitchAt *time.Time `json:"switch_at,omitempty"`
+}
+
+var (
+	obfsTimerMu sync.Mutex
+	obfsTimer   *time.Timer
+)
+
+func generateObfs(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = obfsAlphabet[int(b[i])%len(obfsAlphabet)]
+	}
+	return string(b), nil
+}
+
+func loadObfsRotation() (ObfsRotation, bool) {
+	var rot ObfsRotation
+	b, err := ioutil.ReadFile(ObfsRotationFile)
+	if err != nil || json.Unmarshal(b, &rot) != nil || rot.Obfs == "" {
+		return rot, false
+	}
+	return rot, true
+}
+
+// clientPorts is the port line on account cards: the listen port followed
+// by the forwarded ranges.
+func clientPorts(cfg Config) string {
+	port := CorePort
+	if _, p, err := net.SplitHostPort(cfg.Listen); err == nil {
+		port, _ = strconv.Atoi(p)
+	}
+	parts := []string{strconv.Itoa(port)}
+	for _, r := range activeDNATRanges() {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// accountCards returns the client settings of every unexpired user, or
+// only of password when it is set. A pending rotation is included so
+// customers can be sent the new value before the switch.
+func accountCards(password string) ([]AccountCard, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	users, err := loadUsers()
+	if err != nil {
+		return nil, err
+	}
+	rot, pending := loadObfsRotation()
+	domain, ports := getDomain(), clientPorts(cfg)
+	today := time.Now().Format("2006-01-02")
+
+	cards := []AccountCard{}
+	for _, l := range users {
+		parts := strings.Split(l, "|")
+		if len(parts) < 2 {
+			continue
+		}
+		p, e := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if (password != "" && p != password) || (password == "" && e < today) {
+			continue
+		}
+		c := AccountCard{Password: p, Expired: e, Domain: domain, Obfs: cfg.Obfs, Port: ports}
+		if pending {
+			at := rot.At
+			c.NextObfs, c.SwitchAt = rot.Obfs, &at
+		}
+		cards = append(cards, c)
+	}
+	return cards, nil
+}
+
+func accountCardsHandler(w http.ResponseWriter, r *http.Request) {
+	cards, err := accountCards(strings.TrimSpace(r.URL.Query().Get("password")))
+	if err != nil {
+		jsonResponse(w, 500, false, "Read users error", nil)
+		return
+	}
+	jsonResponse(w, 200, true, "OK", cards)
+}
+
+// errRotationGone is returned by rotateObfs for a scheduled rotation that
+// was cancelled or superseded after its timer fired.
+var errRotationGone = fmt.Errorf("rotation is no longer scheduled")
+
+// rotateObfs writes the new obfs value, restarts the core (rolling back
+// when it does not come up) and tells the admin, offering the regenerated
+// account cards. A scheduled rotation only runs while it is still pending.
+func rotateObfs(value string, scheduled bool, progress func(int, string)) (ServerConfigResult, error) {
+	mutex.Lock()
+	if rot, ok := loadObfsRotation(); scheduled && (!ok || rot.Obfs != value) {
+		mutex.Unlock()
+		return ServerConfigResult{}, errRotationGone
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		mutex.Unlock()
+		return ServerConfigResult{}, err
+	}
+	cur := serverConfigOf(cfg)
+	cfg.Obfs = value
+	res := ServerConfigResult{Changes: diffServerConfig(cur, serverConfigOf(cfg)), Config: serverConfigOf(cfg)}
+	progress(30, "applying")
+	err = applyServerConfig(cfg, &res)
+	if err == nil {
+		obfsChanged(value)
+	} else if rot, ok := loadObfsRotation(); ok && rot.Obfs == value {
+		_ = os.Remove(ObfsRotationFile)
+	}
+	mutex.Unlock()
+
+	if err != nil {
+		_ = notifyAdmin(fmt.Sprintf("❌ *ROTASI OBFS GAGAL*\n━━━━━━━━━━━━━━━━━━━━\n%s\n\n_Obfs lama tetap dipakai._", err))
+		return res, err
+	}
+
+	n := 0
+	if cards, err := accountCards(""); err == nil {
+		n = len(cards)
+	}
+	_ = notifyAdminWithButtons(fmt.Sprintf("🔐 *OBFS DIGANTI*\n━━━━━━━━━━━━━━━━━━━━\n🕶 *Lama:* `%s`\n🕶 *Baru:* `%s`\n👥 *Akun aktif:* %d\n━━━━━━━━━━━━━━━━━━━━\n_Client dengan obfs lama tidak bisa terhubung. Kirim ulang kartu akun ke pelanggan._",
+		cur.Obfs, value, n), [][2]string{{"📇 Kartu Akun Baru", "obfs_cards"}})
+	return res, nil
+}
+
+func rotateObfsJob(value string, scheduled bool) jobFunc {
+	return func(progress func(int, string)) (interface{}, string, error) {
+		res, err := rotateObfs(value, scheduled, progress)
+		if err == errRotationGone {
+			return nil, "Rotation no longer scheduled", nil
+		}
+		if err != nil {
+			return res, "Obfs rotation failed", err
+		}
+		return res, "Obfs rotated", nil
+	}
+}
+
+// obfsChanged drops the pending rotation once value is in effect, so the
+// timer cannot later switch back to an older choice. The caller must hold
+// mutex.
+func obfsChanged(value string) {
+	if rot, ok := loadObfsRotation(); ok {
+		_ = os.Remove(ObfsRotationFile)
+		if rot.Obfs != value {
+			_ = notifyAdmin(fmt.Sprintf("🚫 *ROTASI OBFS DIBATALKAN*\n\nObfs `%s` tidak jadi dipakai karena obfs sudah diganti ke `%s`.", rot.Obfs, value))
+		}
+	}
+	armObfsRotation()
+}
+
+// armObfsRotation (re)starts the timer for the pending rotation, if any.
+// A rotation whose time passed while the API was down runs immediately.
+// When another obfs-rotate job is still running, the timer tries again a
+// little later instead of dropping the rotation.
+func armObfsRotation() {
+	obfsTimerMu.Lock()
+	defer obfsTimerMu.Unlock()
+	if obfsTimer != nil {
+		obfsTimer.Stop()
+		obfsTimer = nil
+	}
+	rot, ok := loadObfsRotation()
+	if !ok {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(time.Until(rot.At), func() {
+		if _, started := jobs.submit("obfs-rotate", true, rotateObfsJob(rot.Obfs, true)); !started {
+			obfsTimerMu.Lock()
+			if obfsTimer == t {
+				obfsTimer = time.AfterFunc(obfsRetryDelay, armObfsRotation)
+			}
+			obfsTimerMu.Unlock()
+		}
+	})
+	obfsTimer = t
+}
+
+// obfsRotateHandler serves GET (current value and pending rotation), POST
+// (rotate now or at a given time) and DELETE (cancel the pending rotation)
+// on /api/server/obfs/rotate.
+func obfsRotateHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		cfg, err := loadConfig()
+		if err != nil {
+			jsonResponse(w, 500, false, "Read config error", nil)
+			return
+		}
+		out := map[string]interface{}{"obfs": cfg.Obfs}
+		if rot, ok := loadObfsRotation(); ok {
+			out["pending"] = rot
+		}
+		jsonResponse(w, 200, true, "OK", out)
+		return
+	case http.MethodDelete:
+		rot, ok := loadObfsRotation()
+		if !ok {
+			jsonResponse(w, 404, false, "No rotation scheduled", nil)
+			return
+		}
+		if err := os.Remove(ObfsRotationFile); err != nil {
+			jsonResponse(w, 500, false, "Cancel failed", nil)
+			return
+		}
+		armObfsRotation()
+		_ = notifyAdmin(fmt.Sprintf("🚫 *ROTASI OBFS DIBATALKAN*\n\nObfs `%s` tidak jadi dipakai.", rot.Obfs))
+		jsonResponse(w, 200, true, "Rotation cancelled", rot)
+		return
+	case http.MethodPost:
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+
+	var req ObfsRotateRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonResponse(w, 400, false, "Invalid request", nil)
+			return
+		}
+	}
+	value := strings.TrimSpace(req.Obfs)
+	if value == "" {
+		if req.Length == 0 {
+			req.Length = 16
+		}
+		if req.Length < 8 || req.Length > 64 {
+			jsonResponse(w, 400, false, "length must be 8-64", nil)
+			return
+		}
+		var err error
+		if value, err = generateObfs(req.Length); err != nil {
+			jsonResponse(w, 500, false, "Generate obfs error", nil)
+			return
+		}
+	}
+	if err := validateObfs(value); err != nil {
+		jsonResponse(w, 400, false, err.Error(), nil)
+		return
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		jsonResponse(w, 500, false, "Read config error", nil)
+		return
+	}
+	if value == cfg.Obfs {
+		jsonResponse(w, 400, false, "New obfs is the same as the current one", nil)
+		return
+	}
+
+	var at time.Time
+	if req.At != "" {
+		if at, err = time.Parse(time.RFC3339, req.At); err != nil {
+			jsonResponse(w, 400, false, "Invalid at, use RFC3339", nil)
+			return
+		}
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	rot := ObfsRotation{Obfs: value, At: at, Created: time.Now()}
+	if req.DryRun {
+		jsonResponse(w, 200, true, "Dry run, nothing changed", map[string]interface{}{"current": cfg.Obfs, "rotation": rot})
+		return
+	}
+
+	if at.After(time.Now().Add(time.Minute)) {
+		b, _ := json.MarshalIndent(rot, "", "  ")
+		if err := writeFileAtomic(ObfsRotationFile, b, 0600); err != nil {
+			jsonResponse(w, 500, false, "Save rotation error", nil)
+			return
+		}
+		armObfsRotation()
+		_ = notifyAdminWithButtons(fmt.Sprintf("🕐 *ROTASI OBFS DIJADWALKAN*\n━━━━━━━━━━━━━━━━━━━━\n🕶 *Sekarang:* `%s`\n🕶 *Baru:* `%s`\n📅 *Berlaku:* %s\n━━━━━━━━━━━━━━━━━━━━\n_Kirim kartu akun baru ke pelanggan sebelum waktu tersebut._",
+			cfg.Obfs, value, at.Local().Format("2006-01-02 15:04")), [][2]string{{"📇 Kartu Akun Baru", "obfs_cards"}, {"🚫 Batalkan", "obfs_cancel"}})
+		jsonResponse(w, 200, true, "Rotation scheduled", rot)
+		return
+	}
+
+	j, started := jobs.submit("obfs-rotate", true, rotateObfsJob(value, false))
+	jobAccepted(w, j, started)
+}
+
+var (
+	AcmeFile = "/etc/zivpn/acme.json"
+	AcmeDir  = "/etc/zivpn/acme"
+)
+
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// AcmeCfg configures certificate issuance for the server domain. DNS-01
+// either calls the Cloudflare API or runs DNSHook as
+// "<hook> present|cleanup <fqdn> <value>". CACert is a PEM file of extra
+// roots to trust for Directory, for a private ACME server.
+type AcmeCfg struct {
+	Enabled         bool   `json:"enabled"`
+	Email           string `json:"email"`
+	Directory       string `json:"directory"`
+	CACert          string `json:"ca_cert,omitempty"`
+	Challenge       string `json:"challenge"`
+	HTTPAddr        string `json:"http_addr"`
+	DNSProvider     string `json:"dns_provider"`
+	CloudflareToken string `json:"cloudflare_token,omitempty"`
+	DNSHook         string `json:"dns_hook,omitempty"`
+	DNSWait         int    `json:"dns_wait_seconds"`
+	RenewDays       int    `json:"renew_before_days"`
+	Schedule        string `json:"schedule"`
+}
+
+func loadAcmeCfg() AcmeCfg {
+	cfg := AcmeCfg{
+		Directory: LetsEncryptURL,
+		Challenge: "http-01",
+		HTTPAddr:  ":80",
+		DNSWait:   30,
+		RenewDays: 30,
+		Schedule:  "17 3 * * *",
+	}
+	if b, err := ioutil.ReadFile(AcmeFile); err == nil {
+		_ = json.Unmarshal(b, &cfg)
+	}
+	return cfg
+}
+
+func saveAcmeCfg(cfg AcmeCfg) error {
+	b, _ := json.MarshalIndent(cfg, "", "  ")
+	return writeFileAtomic(AcmeFile, b, 0600)
+}
+
+type BotCfg struct {
+	BotToken string `json:"bot_token"`
+	AdminID  int64  `json:"admin_id"`
+}
+
+func loadBotCfg() BotCfg {
+	var bc BotCfg
+	if b, err := ioutil.ReadFile(BotConfigFile); err == nil {
+		_ = json.Unmarshal(b, &bc)
+	}
+	return bc
+}
+
+// notifyAdmin sends a Markdown message to the bot admin. It is a no-op
+// when the bot is not configured.
+func notifyAdmin(text string) error {
+	return notifyAdminWithButtons(text, nil)
+}
+
+// notifyAdminWithButtons is notifyAdmin with one row of inline buttons,
+// given as label -> callback data, that the bot handles like its own.
+func notifyAdminWithButtons(text string, buttons [][2]string) error {
+	bc := loadBotCfg()
+	if bc.BotToken == "" || bc.AdminID == 0 {
+		return nil
+	}
+	msg := map[string]interface{}{
+		"chat_id":    bc.AdminID,
+		"text":       text,
+		"parse_mode": "Markdown",
+	}
+	if len(buttons) > 0 {
+		row := []map[string]string{}
+		for _, b := range buttons {
+			row = append(row, map[string]string{"text": b[0], "callback_data": b[1]})
+		}
+		msg["reply_markup"] = map[string]interface{}{"inline_keyboard": [][]map[string]string{row}}
+	}
+	body, _ := json.Marshal(msg)
+	s := &telegramStore{cfg: BackupStoreCfg{BotToken: bc.BotToken, ChatID: bc.AdminID}}
+	return s.call("sendMessage", bytes.NewReader(body), "application/json", nil)
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:"), p.Detail)
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+type acmeAuthz struct {
+	Status     string                 `json:"status"`
+	Identifier struct{ Value string } `json:"identifier"`
+	Challenges []acmeChallenge        `json:"challenges"`
+}
+
+// acmeClient is a minimal RFC 8555 client: one ES256 account key, JWS
+// signed POSTs and POST-as-GET polling.
+type acmeClient struct {
+	dir   acmeDirectory
+	key   *ecdsa.PrivateKey
+	kid   string
+	nonce string
+	http  *http.Client
+}
+
+var b64 = base64.RawURLEncoding
+
+func loadAcmeAccountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(AcmeDir, "account.key")
+	if b, err := ioutil.ReadFile(path); err == nil {
+		blk, _ := pem.Decode(b)
+		if blk == nil {
+			return nil, fmt.Errorf("%s is not PEM", path)
+		}
+		return x509.ParseECPrivateKey(blk.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(AcmeDir, 0700); err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// acmeHTTPClient trusts the system roots plus those in caFile, if set.
+func acmeHTTPClient(caFile string) (*http.Client, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if caFile == "" {
+		return client, nil
+	}
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("ca_cert: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("ca_cert: %s has no PEM certificates", caFile)
+	}
+	client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return client, nil
+}
+
+func newAcmeClient(directory, caFile string) (*acmeClient, error) {
+	hc, err := acmeHTTPClient(caFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadAcmeAccountKey()
+	if err != nil {
+		return nil, fmt.Errorf("account key: %v", err)
+	}
+	c := &acmeClient{key: key, http: hc}
+	resp, err := c.http.Get(directory)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acme directory: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.dir); err != nil {
+		return nil, fmt.Errorf("acme directory: %v", err)
+	}
+	return c, nil
+}
+
+func (c *acmeClient) jwk() map[string]string {
+	pad := func(b []byte) []byte {
+		out := make([]byte, 32)
+		copy(out[32-len(b):], b)
+		return out
+	}
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64.EncodeToString(pad(c.key.X.Bytes())),
+		"y":   b64.EncodeToString(pad(c.key.Y.Bytes())),
+	}
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint used in key authorizations.
+func (c *acmeClient) thumbprint() string {
+	k := c.jwk()
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, k["crv"], k["kty"], k["x"], k["y"])))
+	return b64.EncodeToString(sum[:])
+}
+
+func (c *acmeClient) fetchNonce() error {
+	resp, err := c.http.Head(c.dir.NewNonce)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	if c.nonce == "" {
+		return fmt.Errorf("acme: no nonce from %s", c.dir.NewNonce)
+	}
+	return nil
+}
+
+// post sends a JWS request. A nil payload makes it a POST-as-GET. The
+// request is retried once on badNonce.
+func (c *acmeClient) post(endpoint string, payload interface{}, out interface{}) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		if c.nonce == "" {
+			if err := c.fetchNonce(); err != nil {
+				return nil, nil, err
+			}
+		}
+		protected := map[string]interface{}{"alg": "ES256", "nonce": c.nonce, "url": endpoint}
+		if c.kid != "" {
+			protected["kid"] = c.kid
+		} else {
+			protected["jwk"] = c.jwk()
+		}
+		ph, _ := json.Marshal(protected)
+		pl := ""
+		if payload != nil {
+			b, _ := json.Marshal(payload)
+			pl = b64.EncodeToString(b)
+		}
+		signing := b64.EncodeToString(ph) + "." + pl
+		sum := sha256.Sum256([]byte(signing))
+		r, s, err := ecdsa.Sign(crand.Reader, c.key, sum[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		sig := make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+		body, _ := json.Marshal(map[string]string{
+			"protected": b64.EncodeToString(ph),
+			"payload":   pl,
+			"signature": b64.EncodeToString(sig),
+		})
+
+		resp, err := c.http.Post(endpoint, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		c.nonce = resp.Header.Get("Replay-Nonce")
+
+		if resp.StatusCode >= 400 {
+			p := &acmeProblem{}
+			if json.Unmarshal(data, p) != nil || p.Type == "" {
+				return resp, data, fmt.Errorf("acme: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+			}
+			if strings.HasSuffix(p.Type, ":badNonce") && attempt == 0 {
+				continue
+			}
+			return resp, data, p
+		}
+		if out != nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return resp, data, fmt.Errorf("acme: decode %s: %v", endpoint, err)
+			}
+		}
+		return resp, data, nil
+	}
+}
+
+func (c *acmeClient) register(email string) error {
+	req := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		req["contact"] = []string{"mailto:" + email}
+	}
+	resp, _, err := c.post(c.dir.NewAccount, req, nil)
+	if err != nil {
+		return err
+	}
+	c.kid = resp.Header.Get("Location")
+	if c.kid == "" {
+		return fmt.Errorf("acme: account has no location")
+	}
+	return nil
+}
+
+// poll re-fetches endpoint until its status leaves pending/processing.
+func (c *acmeClient) poll(endpoint string, out interface{}, status func() string) error {
+	deadline := time.Now().Add(3 * time.Minute)
+	for {
+		resp, _, err := c.post(endpoint, nil, out)
+		if err != nil {
+			return err
+		}
+		switch status() {
+		case "pending", "processing":
+		default:
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("acme: timed out waiting for %s", endpoint)
+		}
+		wait := 2 * time.Second
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 && s < 60 {
+			wait = time.Duration(s) * time.Second
+		}
+		time.Sleep(wait)
+	}
+}
+
+// acmeSolver publishes and withdraws a challenge response.
+type acmeSolver interface {
+	Type() string
+	Present(domain, token, keyAuth string) error
+	CleanUp(domain, token, keyAuth string)
+}
+
+// httpSolver answers HTTP-01 from a temporary listener, normally on :80.
+type httpSolver struct {
+	addr   string
+	mu     sync.Mutex
+	tokens map[string]string
+	srv    *http.Server
+}
+
+func (s *httpSolver) Type() string { return "http-01" }
+
+func (s *httpSolver) Present(domain, token, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens == nil {
+		s.tokens = map[string]string{}
+	}
+	s.tokens[token] = keyAuth
+	if s.srv != nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("http-01 needs %s free: %v", s.addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/acme-challenge/", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		ka, ok := s.tokens[path.Base(r.URL.Path)]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, ka)
+	})
+	s.srv = &http.Server{Handler: mux, ReadTimeout: 10 * time.Second}
+	go s.srv.Serve(ln)
+	return nil
+}
+
+func (s *httpSolver) CleanUp(domain, token, keyAuth string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, token)
+	if len(s.tokens) == 0 && s.srv != nil {
+		s.srv.Close()
+		s.srv = nil
+	}
+}
+
+// dnsSolver answers DNS-01 with a TXT record at _acme-challenge.<domain>.
+type dnsSolver struct {
+	cfg      AcmeCfg
+	recordID string
+}
+
+func (s *dnsSolver) Type() string { return "dns-01" }
+
+func dnsValue(keyAuth string) string {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return b64.EncodeToString(sum[:])
+}
+
+func (s *dnsSolver) Present(domain, token, keyAuth string) error {
+	fqdn := "_acme-challenge." + domain
+	value := dnsValue(keyAuth)
+	switch s.cfg.DNSProvider {
+	case "cloudflare":
+		id, err := cloudflareTXT(s.cfg.CloudflareToken, domain, fqdn, value)
+		if err != nil {
+			return err
+		}
+		s.recordID = id
+	case "exec":
+		if s.cfg.DNSHook == "" {
+			return fmt.Errorf("dns_hook is not set")
+		}
+		if out, err := exec.Command(s.cfg.DNSHook, "present", fqdn, value).CombinedOutput(); err != nil {
+			return fmt.Errorf("dns hook: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	default:
+		return fmt.Errorf("unknown dns_provider %q, use cloudflare or exec", s.cfg.DNSProvider)
+	}
+	time.Sleep(time.Duration(s.cfg.DNSWait) * time.Second)
+	return nil
+}
+
+func (s *dnsSolver) CleanUp(domain, token, keyAuth string) {
+	fqdn := "_acme-challenge." + domain
+	switch s.cfg.DNSProvider {
+	case "cloudflare":
+		if s.recordID != "" {
+			if err := cloudflareDelete(s.cfg.CloudflareToken, domain, s.recordID); err != nil {
+				log.Println("acme dns cleanup:", err)
+			}
+		}
+	case "exec":
+		_ = exec.Command(s.cfg.DNSHook, "cleanup", fqdn, dnsValue(keyAuth)).Run()
+	}
+}
+
+func cloudflareCall(token, method, endpoint string, body interface{}, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "https://api.cloudflare.com/client/v4"+endpoint, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Success bool                       `json:"success"`
+		Errors  []struct{ Message string } `json:"errors"`
+		Result  json.RawMessage            `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if !res.Success {
+		msg := resp.Status
+		if len(res.Errors) > 0 {
+			msg = res.Errors[0].Message
+		}
+		return fmt.Errorf("cloudflare: %s", msg)
+	}
+	if out != nil {
+		return json.Unmarshal(res.Result, out)
+	}
+	return nil
+}
+
+// cloudflareZone finds the zone for domain by trying each parent name.
+func cloudflareZone(token, domain string) (string, error) {
+	labels := strings.Split(domain, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		var zones []struct{ ID string }
+		name := strings.Join(labels[i:], ".")
+		if err := cloudflareCall(token, "GET", "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone found for %s", domain)
+}
+
+func cloudflareTXT(token, domain, fqdn, value string) (string, error) {
+	zone, err := cloudflareZone(token, domain)
+	if err != nil {
+		return "", err
+	}
+	var rec struct{ ID string }
+	err = cloudflareCall(token, "POST", "/zones/"+zone+"/dns_records",
+		map[string]interface{}{"type": "TXT", "name": fqdn, "content": value, "ttl": 120}, &rec)
+	return zone + "/" + rec.ID, err
+}
+
+func cloudflareDelete(token, domain, id string) error {
+	parts := strings.SplitN(id, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("bad record id %q", id)
+	}
+	return cloudflareCall(token, "DELETE", "/zones/"+parts[0]+"/dns_records/"+parts[1], nil, nil)
+}
+
+func newAcmeSolver(cfg AcmeCfg) (acmeSolver, error) {
+	switch cfg.Challenge {
+	case "", "http-01":
+		return &httpSolver{addr: cfg.HTTPAddr}, nil
+	case "dns-01":
+		return &dnsSolver{cfg: cfg}, nil
+	}
+	return nil, fmt.Errorf("unknown challenge %q, use http-01 or dns-01", cfg.Challenge)
+}
+
+// obtainCertificate runs the full ACME order for domain and returns the
+// PEM certificate chain and private key.
+func obtainCertificate(cfg AcmeCfg, domain string, progress func(int, string)) (certPEM, keyPEM []byte, err error) {
+	solver, err := newAcmeSolver(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := newAcmeClient(cfg.Directory, cfg.CACert)
+	if err != nil {
+		return nil, nil, err
+	}
+	progress(10, "registering")
+	if err := c.register(cfg.Email); err != nil {
+		return nil, nil, err
+	}
+
+	var order acmeOrder
+	resp, _, err := c.post(c.dir.NewOrder, map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": domain}},
+	}, &order)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+	if orderURL == "" {
+		return nil, nil, fmt.Errorf("acme: new order response has no Location header")
+	}
+
+	progress(25, "validating")
+	for _, au := range order.Authorizations {
+		var authz acmeAuthz
+		if _, _, err := c.post(au, nil, &authz); err != nil {
+			return nil, nil, err
+		}
+		if authz.Status == "valid" {
+			continue
+		}
+		// Copy the challenge out: polling decodes over authz.Challenges.
+		var ch *acmeChallenge
+		for _, x := range authz.Challenges {
+			if x.Type == solver.Type() {
+				x := x
+				ch = &x
+			}
+		}
+		if ch == nil {
+			return nil, nil, fmt.Errorf("acme: server offers no %s challenge", solver.Type())
+		}
+		keyAuth := ch.Token + "." + c.thumbprint()
+		if err := solver.Present(authz.Identifier.Value, ch.Token, keyAuth); err != nil {
+			return nil, nil, err
+		}
+		_, _, err := c.post(ch.URL, map[string]interface{}{}, nil)
+		if err == nil {
+			err = c.poll(au, &authz, func() string { return authz.Status })
+		}
+		solver.CleanUp(authz.Identifier.Value, ch.Token, keyAuth)
+		if err != nil {
+			return nil, nil, err
+		}
+		if authz.Status != "valid" {
+			for _, x := range authz.Challenges {
+				if x.Type == solver.Type() && x.Error != nil {
+					return nil, nil, x.Error
+				}
+			}
+			return nil, nil, fmt.Errorf("acme: authorization for %s is %s", authz.Identifier.Value, authz.Status)
+		}
+	}
+
+	progress(60, "finalizing")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(crand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := c.post(order.Finalize, map[string]string{"csr": b64.EncodeToString(csr)}, &order); err != nil {
+		return nil, nil, err
+	}
+	if err := c.poll(orderURL, &order, func() string { return order.Status }); err != nil {
+		return nil, nil, err
+	}
+	if order.Status != "valid" || order.Certificate == "" {
+		if order.Error != nil {
+			return nil, nil, order.Error
+		}
+		return nil, nil, fmt.Errorf("acme: order is %s", order.Status)
+	}
+
+	progress(80, "downloading")
+	_, chain, err := c.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// installCertificate writes a new pair to the paths in config.json,
+// restarts the core and restores the old pair if it does not come up.
+// The caller must hold mutex.
+func installCertificate(certPEM, keyPEM []byte) error {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return fmt.Errorf("invalid certificate pair: %v", err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	oldCert, certErr := ioutil.ReadFile(cfg.Cert)
+	oldKey, keyErr := ioutil.ReadFile(cfg.Key)
+	restore := func() {
+		if certErr == nil && keyErr == nil {
+			_ = writeFileAtomic(cfg.Cert, oldCert, 0644)
+			_ = writeFileAtomic(cfg.Key, oldKey, 0600)
+		}
+	}
+
+	if err := writeFileAtomic(cfg.Key, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(cfg.Cert, certPEM, 0644); err != nil {
+		restore()
+		return err
+	}
+	if err := restartCore(); err != nil {
+		restore()
+		if rerr := restartCore(); rerr != nil {
+			return fmt.Errorf("%v; old certificate restored but service is still unhealthy: %v", err, rerr)
+		}
+		return fmt.Errorf("%v; old certificate restored", err)
+	}
+	return nil
+}
+
+// certExpiry returns the NotAfter of the first certificate in path.
+func certExpiry(path string) (time.Time, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return time.Time{}, fmt.Errorf("%s is not PEM", path)
+	}
+	crt, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return crt.NotAfter, nil
+}
+
+// issueCertificate obtains and installs a certificate for the current
+// domain.
+func issueCertificate(progress func(int, string)) (map[string]interface{}, error) {
+	domain := getDomain()
+	if err := validateDomain(domain); err != nil {
+		return nil, err
+	}
+	cfg := loadAcmeCfg()
+	certPEM, keyPEM, err := obtainCertificate(cfg, domain, progress)
+	if err != nil {
+		return nil, err
+	}
+	progress(90, "installing")
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := installCertificate(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{"domain": domain}
+	if c, err := loadConfig(); err == nil {
+		if exp, err := certExpiry(c.Cert); err == nil {
+			out["not_after"] = exp
+		}
+	}
+	return out, nil
+}
+
+// certRenewReason says why the installed certificate must be replaced, or
+// returns "" when it can stay. The installer's self-signed certificate and
+// one issued for a previous domain are replaced whatever their expiry.
+func certRenewReason(info CertInfo, err error, domain string, renewDays int) string {
+	switch {
+	case err != nil:
+		return "sertifikat tidak bisa dibaca"
+	case info.SelfSigned:
+		return "sertifikat self-signed"
+	case validateDomain(domain) == nil && !info.DomainMatch:
+		return "sertifikat bukan untuk domain ini"
+	case time.Until(info.NotAfter) <= time.Duration(renewDays)*24*time.Hour:
+		return "sertifikat akan expired"
+	}
+	return ""
+}
+
+// renewCertificate is the scheduled job: it issues a certificate when the
+// installed one is unreadable, self-signed, not valid for the domain or
+// within RenewDays of expiry, and alerts the admin when that fails.
+func renewCertificate() error {
+	cfg := loadAcmeCfg()
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var info CertInfo
+	certPEM, err := ioutil.ReadFile(c.Cert)
+	if err == nil {
+		info, err = parseCertPair(certPEM, nil)
+	}
+	reason := certRenewReason(info, err, getDomain(), cfg.RenewDays)
+	if reason == "" {
+		return nil
+	}
+	if _, ierr := issueCertificate(func(int, string) {}); ierr != nil {
+		left := "unknown"
+		if err == nil {
+			left = fmt.Sprintf("%d hari", info.DaysLeft)
+		}
+		_ = notifyAdmin(fmt.Sprintf("⚠️ *PERPANJANG SERTIFIKAT GAGAL*\n━━━━━━━━━━━━━━━━━━━━\n🌐 *Domain:* `%s`\n📌 *Alasan:* %s\n⏳ *Sisa:* %s\n❌ *Error:* %s", getDomain(), reason, left, ierr))
+		return ierr
+	}
+	_ = notifyAdmin(fmt.Sprintf("✅ *SERTIFIKAT DIPERPANJANG*\n\n🌐 *Domain:* `%s`\n📌 *Alasan:* %s", getDomain(), reason))
+	return nil
+}
+
+func syncAcmeRenewal(cfg AcmeCfg) error {
+	if !cfg.Enabled {
+		cron.remove("acme-renew")
+		return nil
+	}
+	return cron.set("acme-renew", cfg.Schedule, renewCertificate)
+}
+
+var domainLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+func validateDomain(d string) error {
+	if d == "" || d == "Unknown" || len(d) > 253 {
+		return fmt.Errorf("invalid domain %q", d)
+	}
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("domain %q must have at least two labels", d)
+	}
+	for _, l := range labels {
+		if !domainLabel.MatchString(l) {
+			return fmt.Errorf("invalid domain %q", d)
+		}
+	}
+	if net.ParseIP(d) != nil {
+		return fmt.Errorf("domain must be a hostname, not an IP")
+	}
+	return nil
+}
+
+// DomainRequest changes the domain. Acme, when present, is merged into the
+// saved ACME settings, so only the keys being changed need to be sent.
+type DomainRequest struct {
+	Domain    string          `json:"domain"`
+	IssueCert bool            `json:"issue_cert"`
+	Acme      json.RawMessage `json:"acme"`
+}
+
+// domainHandler serves GET (domain, ACME settings and certificate expiry)
+// and POST (change domain, optionally update ACME settings and issue a
+// certificate as a job) on /api/domain.
+func domainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		acme := loadAcmeCfg()
+		acme.CloudflareToken = ""
+		out := map[string]interface{}{"domain": getDomain(), "acme": acme}
+		if cfg, err := loadConfig(); err == nil {
+			if exp, err := certExpiry(cfg.Cert); err == nil {
+				out["cert_not_after"] = exp
+			}
+		}
+		if st, ok := cron.status("acme-renew"); ok {
+			out["renewal"] = st.summary()
+		}
+		jsonResponse(w, 200, true, "OK", out)
+		return
+	case http.MethodPost:
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+
+	var req DomainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonResponse(w, 400, false, "Invalid request", nil)
+		return
+	}
+	req.Domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(req.Domain), "."))
+	if req.Domain != "" {
+		if err := validateDomain(req.Domain); err != nil {
+			jsonResponse(w, 400, false, err.Error(), nil)
+			return
+		}
+	}
+
+	if len(req.Acme) > 0 {
+		cfg := loadAcmeCfg()
+		if err := json.Unmarshal(req.Acme, &cfg); err != nil {
+			jsonResponse(w, 400, false, "Invalid acme settings: "+err.Error(), nil)
+			return
+		}
+		if cfg.RenewDays <= 0 || cfg.DNSWait < 0 {
+			jsonResponse(w, 400, false, "renew_before_days must be positive and dns_wait_seconds not negative", nil)
+			return
+		}
+		if _, err := newAcmeSolver(cfg); err != nil {
+			jsonResponse(w, 400, false, err.Error(), nil)
+			return
+		}
+		if _, err := acmeHTTPClient(cfg.CACert); err != nil {
+			jsonResponse(w, 400, false, err.Error(), nil)
+			return
+		}
+		if _, err := parseCron(cfg.Schedule); cfg.Enabled && err != nil {
+			jsonResponse(w, 400, false, "Invalid schedule: "+err.Error(), nil)
+			return
+		}
+		if err := saveAcmeCfg(cfg); err != nil {
+			jsonResponse(w, 500, false, "Save ACME config error", nil)
+			return
+		}
+		if err := syncAcmeRenewal(cfg); err != nil {
+			jsonResponse(w, 500, false, "Schedule error: "+err.Error(), nil)
+			return
+		}
+	}
+
+	out := map[string]interface{}{"domain": getDomain()}
+	if req.Domain != "" && req.Domain != getDomain() {
+		if err := writeFileAtomic(DomainFile, []byte(req.Domain+"\n"), 0644); err != nil {
+			jsonResponse(w, 500, false, "Save domain error", nil)
+			return
+		}
+		out["domain"] = req.Domain
+		if ip := getPublicIP(); ip != "" {
+			if ips, err := net.LookupHost(req.Domain); err != nil || !containsString(ips, ip) {
+				out["warning"] = fmt.Sprintf("%s does not resolve to this server (%s)", req.Domain, ip)
+			}
+		}
+	}
+
+	if req.IssueCert {
+		j, started := jobs.submit("acme", true, func(progress func(int, string)) (interface{}, string, error) {
+			res, err := issueCertificate(progress)
+			if err != nil {
+				return nil, "Certificate request failed", err
+			}
+			return res, "Certificate installed", nil
+		})
+		out["job_id"] = j.ID
+		if !started {
+			jsonResponse(w, 202, true, "Job already running", out)
+			return
+		}
+		jsonResponse(w, 202, true, "Domain saved, certificate job started", out)
+		return
+	}
+	jsonResponse(w, 200, true, "Domain saved", out)
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	CertAlertFile = "/etc/zivpn/cert-alerts.json"
+	maxCertUpload = 1 << 20
+)
+
+// certAlertDays are the days-before-expiry at which the admin is alerted.
+var certAlertDays = []int{14, 7, 1}
+
+// CertInfo describes the certificate configured in config.json.
+type CertInfo struct {
+	CertPath    string    `json:"cert_path"`
+	KeyPath     string    `json:"key_path"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	SANs        []string  `json:"sans"`
+	Serial      string    `json:"serial"`
+	SHA256      string    `json:"sha256"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	DaysLeft    int       `json:"days_left"`
+	Expired     bool      `json:"expired"`
+	SelfSigned  bool      `json:"self_signed"`
+	KeyMatch    bool      `json:"key_match"`
+	KeyError    string    `json:"key_error,omitempty"`
+	DomainMatch bool      `json:"domain_match"`
+}
+
+// parseCertPair parses the first certificate in certPEM and checks it
+// against keyPEM. keyPEM may be nil when the key cannot be read.
+func parseCertPair(certPEM, keyPEM []byte) (CertInfo, error) {
+	var info CertInfo
+	blk, _ := pem.Decode(certPEM)
+	if blk == nil || blk.Type != "CERTIFICATE" {
+		return info, fmt.Errorf("certificate is not PEM encoded")
+	}
+	crt, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return info, fmt.Errorf("parse certificate: %v", err)
+	}
+
+	sum := sha256.Sum256(crt.Raw)
+	info.Subject = crt.Subject.String()
+	info.Issuer = crt.Issuer.String()
+	info.SANs = append([]string{}, crt.DNSNames...)
+	for _, ip := range crt.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	info.Serial = crt.SerialNumber.Text(16)
+	info.SHA256 = hex.EncodeToString(sum[:])
+	info.NotBefore, info.NotAfter = crt.NotBefore, crt.NotAfter
+	info.DaysLeft = int(math.Floor(time.Until(crt.NotAfter).Hours() / 24))
+	info.Expired = time.Now().After(crt.NotAfter)
+	info.SelfSigned = bytes.Equal(crt.RawSubject, crt.RawIssuer) && crt.CheckSignatureFrom(crt) == nil
+	if d := getDomain(); d != "Unknown" {
+		info.DomainMatch = crt.VerifyHostname(d) == nil
+	}
+
+	if keyPEM == nil {
+		info.KeyError = "key not readable"
+	} else if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		info.KeyError = err.Error()
+	} else {
+		info.KeyMatch = true
+	}
+	return info, nil
+}
+
+func inspectCertificate() (CertInfo, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return CertInfo{}, err
+	}
+	certPEM, err := ioutil.ReadFile(cfg.Cert)
+	if err != nil {
+		return CertInfo{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(cfg.Key)
+	if err != nil {
+		keyPEM = nil
+	}
+	info, err := parseCertPair(certPEM, keyPEM)
+	info.CertPath, info.KeyPath = cfg.Cert, cfg.Key
+	return info, err
+}
+
+// CertUpload is the body of POST /api/server/cert. Multipart uploads use
+// the file fields "cert" and "key" and a "dry_run" text field.
+type CertUpload struct {
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+	DryRun bool   `json:"dry_run"`
+}
+
+func readCertUpload(w http.ResponseWriter, r *http.Request) (CertUpload, error) {
+	var up CertUpload
+	r.Body = http.MaxBytesReader(w, r.Body, maxCertUpload)
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err := json.NewDecoder(r.Body).Decode(&up)
+		return up, err
+	}
+	if err := r.ParseMultipartForm(maxCertUpload); err != nil {
+		return up, err
+	}
+	for _, f := range []struct {
+		field string
+		dst   *string
+	}{{"cert", &up.Cert}, {"key", &up.Key}} {
+		file, _, err := r.FormFile(f.field)
+		if err != nil {
+			*f.dst = r.FormValue(f.field)
+			continue
+		}
+		b, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return up, err
+		}
+		*f.dst = string(b)
+	}
+	up.DryRun, _ = strconv.ParseBool(r.FormValue("dry_run"))
+	return up, nil
+}
+
+// serverCertHandler serves GET (inspect the installed certificate) and
+// POST (validate and install a replacement pair) on /api/server/cert.
+func serverCertHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		info, err := inspectCertificate()
+		if err != nil {
+			jsonResponse(w, 500, false, "Read certificate error: "+err.Error(), info)
+			return
+		}
+		jsonResponse(w, 200, true, "OK", info)
+		return
+	case http.MethodPost:
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+
+	up, err := readCertUpload(w, r)
+	if err != nil {
+		jsonResponse(w, 400, false, "Invalid request", nil)
+		return
+	}
+	if strings.TrimSpace(up.Cert) == "" || strings.TrimSpace(up.Key) == "" {
+		jsonResponse(w, 400, false, "cert and key are required", nil)
+		return
+	}
+	certPEM, keyPEM := []byte(up.Cert), []byte(up.Key)
+	info, err := parseCertPair(certPEM, keyPEM)
+	if err != nil {
+		jsonResponse(w, 400, false, err.Error(), nil)
+		return
+	}
+	switch {
+	case !info.KeyMatch:
+		jsonResponse(w, 400, false, "Key does not match certificate: "+info.KeyError, info)
+		return
+	case info.Expired:
+		jsonResponse(w, 400, false, "Certificate has expired", info)
+		return
+	case time.Now().Before(info.NotBefore):
+		jsonResponse(w, 400, false, "Certificate is not valid yet", info)
+		return
+	}
+	if up.DryRun {
+		jsonResponse(w, 200, true, "Dry run, certificate is valid", info)
+		return
+	}
+
+	j, started := jobs.submit("cert", true, func(progress func(int, string)) (interface{}, string, error) {
+		progress(30, "installing")
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err := installCertificate(certPEM, keyPEM); err != nil {
+			return info, "Certificate install failed", err
+		}
+		return info, "Certificate installed", nil
+	})
+	jobAccepted(w, j, started)
+}
+
+type certAlertState struct {
+	NotAfter time.Time `json:"not_after"`
+	Sent     []int     `json:"sent"`
+}
+
+// checkCertExpiry is the daily "cert-expiry" job. Each threshold in
+// certAlertDays is announced once per certificate; installing a new
+// certificate (a different NotAfter) resets the state.
+func checkCertExpiry() error {
+	info, err := inspectCertificate()
+	if err != nil {
+		return err
+	}
+
+	var st certAlertState
+	if b, err := ioutil.ReadFile(CertAlertFile); err == nil {
+		_ = json.Unmarshal(b, &st)
+	}
+	if !st.NotAfter.Equal(info.NotAfter) {
+		st = certAlertState{NotAfter: info.NotAfter}
+	}
+
+	due := 0
+	for _, d := range certAlertDays {
+		if info.DaysLeft <= d && !containsInt(st.Sent, d) {
+			st.Sent = append(st.Sent, d)
+			due = d
+		}
+	}
+	if due == 0 {
+		return nil
+	}
+
+	title := "⚠️ *SERTIFIKAT AKAN EXPIRED*"
+	if info.Expired {
+		title = "🚨 *SERTIFIKAT SUDAH EXPIRED*"
+	}
+	hint := "Upload sertifikat baru lewat `POST /api/server/cert` atau aktifkan ACME di `/api/domain`."
+	if loadAcmeCfg().Enabled {
+		hint = "ACME aktif, tapi perpanjangan otomatis belum berhasil. Cek status di `GET /api/domain`."
+	}
+	msg := fmt.Sprintf("%s\n━━━━━━━━━━━━━━━━━━━━\n🌐 *Domain:* `%s`\n📅 *Expired:* %s\n⏳ *Sisa:* %d hari\n━━━━━━━━━━━━━━━━━━━━\n%s",
+		title, getDomain(), info.NotAfter.Local().Format("2006-01-02 15:04"), info.DaysLeft, hint)
+	if err := notifyAdmin(msg); err != nil {
+		return err
+	}
+	b, _ := json.MarshalIndent(st, "", "  ")
+	return writeFileAtomic(CertAlertFile, b, 0644)
+}
+
+func containsInt(list []int, n int) bool {
+	for _, x := range list {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
+
+var NodesFile = "/etc/zivpn/nodes.json"
+
+const (
+	LocalNode   = "local"
+	nodeTimeout = 15 * time.Second
+)
+
+// Node is another ZiVPN server this API controls. Requests for it are
+// proxied with its own API key, so the bot only ever talks to this API.
+type Node struct {
+	Name  string    `json:"name"`
+	URL   string    `json:"url"`
+	Key   string    `json:"key,omitempty"`
+	Added time.Time `json:"added"`
+}
+
+// NodeResult is one node's answer in a fan-out request.
+type NodeResult struct {
+	Node    string      `json:"node"`
+	Success bool        `json:"success"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+var (
+	nodesMutex = &sync.Mutex{}
+	nodeName   = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+)
+
+func loadNodes() []Node {
+	var nodes []Node
+	if b, err := ioutil.ReadFile(NodesFile); err == nil {
+		_ = json.Unmarshal(b, &nodes)
+	}
+	return nodes
+}
+
+func saveNodes(nodes []Node) error {
+	if nodes == nil {
+		nodes = []Node{}
+	}
+	b, _ := json.MarshalIndent(nodes, "", "  ")
+	return writeFileAtomic(NodesFile, b, 0600)
+}
+
+func findNode(name string) (Node, bool) {
+	if name == LocalNode {
+		return localNode(), true
+	}
+	for _, n := range loadNodes() {
+		if n.Name == name {
+			return n, true
+		}
+	}
+	return Node{}, false
+}
+
+func localNode() Node {
+	return Node{Name: LocalNode, URL: "http://127.0.0.1" + Port + "/api", Key: getAuthToken()}
+}
+
+// allNodes is this server followed by the registered ones.
+func allNodes() []Node {
+	return append([]Node{localNode()}, loadNodes()...)
+}
+
+// normalizeNodeURL accepts "http://host:8080", ".../api" or ".../api/"
+// and returns the API base ending in /api.
+func normalizeNodeURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("url must be http(s)://host:port")
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api") + "/api"
+	u.RawQuery, u.Fragment = "", ""
+	return u.String(), nil
+}
+
+// call sends a JSON request to the node and decodes the standard Response.
+func (n Node) call(method, endpoint string, payload interface{}) (Response, error) {
+	var res Response
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return res, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, n.URL+endpoint, body)
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", n.Key)
+	resp, err := (&http.Client{Timeout: nodeTimeout}).Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&res); err != nil {
+		return res, fmt.Errorf("%s: invalid response (HTTP %d)", n.Name, resp.StatusCode)
+	}
+	return res, nil
+}
+
+// fanOut runs fn against every node concurrently and returns the results
+// in node order.
+func fanOut(nodes []Node, fn func(Node) NodeResult) []NodeResult {
+	out := make([]NodeResult, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n Node) {
+			defer wg.Done()
+			out[i] = fn(n)
+			out[i].Node = n.Name
+		}(i, n)
+	}
+	wg.Wait()
+	return out
+}
+
+func nodeRequest(method, endpoint string, payload interface{}) func(Node) NodeResult {
+	return func(n Node) NodeResult {
+		res, err := n.call(method, endpoint, payload)
+		if err != nil {
+			return NodeResult{Message: err.Error()}
+		}
+		return NodeResult{Success: res.Success, Message: res.Message, Data: res.Data}
+	}
+}
+
+// selectNodes filters allNodes by name; an empty only list means all.
+func selectNodes(only, skip []string) ([]Node, error) {
+	var out []Node
+	for _, n := range allNodes() {
+		if (len(only) == 0 || containsString(only, n.Name)) && !containsString(skip, n.Name) {
+			out = append(out, n)
+		}
+	}
+	for _, name := range only {
+		if _, ok := findNode(name); !ok {
+			return nil, fmt.Errorf("unknown node %q", name)
+		}
+	}
+	return out, nil
+}
+
+type NodeRequest struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Key  string `json:"key"`
+}
+
+// nodesHandler manages the registry on /api/nodes: GET lists nodes
+// without their keys, POST adds or updates one after checking that its
+// API answers with the given key, DELETE ?name= removes one.
+func nodesHandler(w http.ResponseWriter, r *http.Request) {
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		nodes := loadNodes()
+		for i := range nodes {
+			nodes[i].Key = ""
+		}
+		if nodes == nil {
+			nodes = []Node{}
+		}
+		jsonResponse(w, 200, true, "OK", nodes)
+	case http.MethodPost:
+		var req NodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonResponse(w, 400, false, "Invalid request", nil)
+			return
+		}
+		req.Name = strings.ToLower(strings.TrimSpace(req.Name))
+		if !nodeName.MatchString(req.Name) || req.Name == LocalNode {
+			jsonResponse(w, 400, false, "name must be 1-32 characters a-z, 0-9 or - and not \"local\"", nil)
+			return
+		}
+		u, err := normalizeNodeURL(req.URL)
+		if err != nil {
+			jsonResponse(w, 400, false, err.Error(), nil)
+			return
+		}
+		n := Node{Name: req.Name, URL: u, Key: strings.TrimSpace(req.Key), Added: time.Now()}
+		res, err := n.call("GET", "/info", nil)
+		if err != nil {
+			jsonResponse(w, 502, false, "Node unreachable: "+err.Error(), nil)
+			return
+		}
+		if !res.Success {
+			jsonResponse(w, 502, false, "Node rejected the request: "+res.Message, nil)
+			return
+		}
+
+		nodes := loadNodes()
+		replaced := false
+		for i := range nodes {
+			if nodes[i].Name == n.Name {
+				nodes[i], replaced = n, true
+			}
+		}
+		if !replaced {
+			nodes = append(nodes, n)
+		}
+		if err := saveNodes(nodes); err != nil {
+			jsonResponse(w, 500, false, "Save nodes error", nil)
+			return
+		}
+		n.Key = ""
+		jsonResponse(w, 200, true, "Node saved", map[string]interface{}{"node": n, "info": res.Data})
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		nodes := loadNodes()
+		var keep []Node
+		for _, n := range nodes {
+			if n.Name != name {
+				keep = append(keep, n)
+			}
+		}
+		if len(keep) == len(nodes) {
+			jsonResponse(w, 404, false, "Node not found", nil)
+			return
+		}
+		if err := saveNodes(keep); err != nil {
+			jsonResponse(w, 500, false, "Save nodes error", nil)
+			return
+		}
+		jsonResponse(w, 200, true, "Node removed", nil)
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+	}
+}
+
+// nodeProxyHandler forwards /api/nodes/{name}/{path} to {path} on that
+// node with the node's API key, so every existing endpoint (including
+// jobs, uploads and downloads) works remotely.
+func nodeProxyHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/nodes/")
+	name, path := rest, "/"
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, path = rest[:i], rest[i:]
+	}
+	n, ok := findNode(name)
+	if !ok {
+		jsonResponse(w, 404, false, "Node not found", nil)
+		return
+	}
+	if n.Name == LocalNode || path == "/" || strings.HasPrefix(path, "/nodes") {
+		jsonResponse(w, 400, false, "Invalid node path", nil)
+		return
+	}
+	target, err := url.Parse(n.URL)
+	if err != nil {
+		jsonResponse(w, 500, false, "Invalid node url", nil)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+			req.URL.Path = strings.TrimSuffix(target.Path, "/") + path
+			req.Host = target.Host
+			req.Header.Set("X-API-Key", n.Key)
+			req.Header.Del("X-Forwarded-For")
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			jsonResponse(w, 502, false, "Node "+n.Name+" unreachable: "+err.Error(), nil)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// clusterUsersHandler merges GET /api/users from every node.
+func clusterUsersHandler(w http.ResponseWriter, r *http.Request) {
+	res := fanOut(allNodes(), nodeRequest("GET", "/users", nil))
+	total := 0
+	for _, nr := range res {
+		if list, ok := nr.Data.([]interface{}); ok {
+			total += len(list)
+		}
+	}
+	jsonResponse(w, 200, true, "OK", map[string]interface{}{"total": total, "nodes": res})
+}
+
+// clusterInfoHandler merges GET /api/info from every node.
+func clusterInfoHandler(w http.ResponseWriter, r *http.Request) {
+	res := fanOut(allNodes(), nodeRequest("GET", "/info", nil))
+	online := 0
+	for _, nr := range res {
+		if nr.Success {
+			online++
+		}
+	}
+	jsonResponse(w, 200, true, fmt.Sprintf("%d/%d nodes online", online, len(res)), res)
+}
+
+type ClusterUserRequest struct {
+	Password string   `json:"password"`
+	Days     int      `json:"days"`
+	Nodes    []string `json:"nodes"`
+	Skip     []string `json:"skip"`
+}
+
+// clusterCreateUserHandler creates the same account on every node, or on
+// the nodes listed, and reports each node's result.
+func clusterCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	var req ClusterUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" || req.Days <= 0 {
+		jsonResponse(w, 400, false, "Invalid request", nil)
+		return
+	}
+	nodes, err := selectNodes(req.Nodes, req.Skip)
+	if err != nil {
+		jsonResponse(w, 400, false, err.Error(), nil)
+		return
+	}
+	if len(nodes) == 0 {
+		jsonResponse(w, 400, false, "No nodes selected", nil)
+		return
+	}
+	res := fanOut(nodes, nodeRequest("POST", "/user/create", UserRequest{Password: req.Password, Days: req.Days}))
+	ok := 0
+	for _, nr := range res {
+		if nr.Success {
+			ok++
+		}
+	}
+	jsonResponse(w, 200, ok == len(res), fmt.Sprintf("Created on %d/%d nodes", ok, len(res)), res)
+}
+
+var (
+	SyncFile      = "/etc/zivpn/sync.json"
+	SyncStateFile = "/etc/zivpn/sync-state.json"
+	SyncQueueFile = "/etc/zivpn/sync-queue.json"
+)
+
+const (
+	syncRetryBase  = 30 * time.Second
+	syncMaxBackoff = 30 * time.Minute
+)
+
+// SyncCfg sets this server's role in user sync. A primary pushes every
+// user change to Nodes (all registered nodes when empty); a secondary
+// accepts pushes on /api/sync/user.
+type SyncCfg struct {
+	Role  string   `json:"role"`
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// UserRecord is the complete state of one account as exchanged between
+// nodes. Updated decides conflicts: the newer record wins.
+type UserRecord struct {
+	Password  string    `json:"password"`
+	Expired   string    `json:"expired,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Suspended bool      `json:"suspended"`
+	Deleted   bool      `json:"deleted"`
+	Updated   time.Time `json:"updated"`
+}
+
+// syncVersion is what sync-state.json keeps per password; deleted
+// accounts stay as tombstones so an older push cannot bring them back.
+type syncVersion struct {
+	Updated time.Time `json:"updated"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+type SyncOp struct {
+	Node      string     `json:"node"`
+	Record    UserRecord `json:"record"`
+	Attempts  int        `json:"attempts"`
+	NextTry   time.Time  `json:"next_try"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+var (
+	syncMutex = &sync.Mutex{}
+	syncWake  = make(chan struct{}, 1)
+)
+
+func loadSyncCfg() SyncCfg {
+	var cfg SyncCfg
+	if b, err := ioutil.ReadFile(SyncFile); err == nil {
+		_ = json.Unmarshal(b, &cfg)
+	}
+	return cfg
+}
+
+func loadSyncState() map[string]syncVersion {
+	state := map[string]syncVersion{}
+	if b, err := ioutil.ReadFile(SyncStateFile); err == nil {
+		_ = json.Unmarshal(b, &state)
+	}
+	return state
+}
+
+func saveSyncState(state map[string]syncVersion) error {
+	b, _ := json.MarshalIndent(state, "", "  ")
+	return writeFileAtomic(SyncStateFile, b, 0600)
+}
+
+func loadSyncQueue() []SyncOp {
+	var q []SyncOp
+	if b, err := ioutil.ReadFile(SyncQueueFile); err == nil {
+		_ = json.Unmarshal(b, &q)
+	}
+	return q
+}
+
+func saveSyncQueue(q []SyncOp) error {
+	if q == nil {
+		q = []SyncOp{}
+	}
+	b, _ := json.MarshalIndent(q, "", "  ")
+	return writeFileAtomic(SyncQueueFile, b, 0600)
+}
+
+// syncTargets are the nodes a primary pushes to.
+func syncTargets(cfg SyncCfg) []Node {
+	var out []Node
+	for _, n := range loadNodes() {
+		if len(cfg.Nodes) == 0 || containsString(cfg.Nodes, n.Name) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// localRecords builds the records of every account in users.db plus the
+// tombstones of deleted ones. The caller must hold mutex.
+func localRecords(state map[string]syncVersion) map[string]UserRecord {
+	enabled := map[string]bool{}
+	if cfg, err := loadConfig(); err == nil {
+		for _, p := range cfg.Auth.Config {
+			enabled[p] = true
+		}
+	}
+	out := map[string]UserRecord{}
+	users, _ := loadUsers()
+	for _, l := range users {
+		parts := strings.Split(l, "|")
+		if len(parts) < 2 {
+			continue
+		}
+		rec := UserRecord{
+			Password:  strings.TrimSpace(parts[0]),
+			Expired:   strings.TrimSpace(parts[1]),
+			Suspended: !enabled[strings.TrimSpace(parts[0])],
+		}
+		if len(parts) > 2 {
+			rec.Note = strings.TrimSpace(strings.Join(parts[2:], "|"))
+		}
+		rec.Updated = state[rec.Password].Updated
+		out[rec.Password] = rec
+	}
+	for p, v := range state {
+		if _, ok := out[p]; !ok && v.Deleted {
+			out[p] = UserRecord{Password: p, Deleted: true, Updated: v.Updated}
+		}
+	}
+	return out
+}
+
+// userChanged stamps the accounts with the current time and, on a
+// primary, queues them for every secondary. Handlers call it after they
+// have saved users.db and config.json, still holding mutex.
+func userChanged(passwords ...string) {
+	cfg := loadSyncCfg()
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	state := loadSyncState()
+	recs := localRecords(state)
+	now := time.Now()
+	var changed []UserRecord
+	for _, p := range passwords {
+		rec, ok := recs[p]
+		if !ok {
+			rec = UserRecord{Password: p, Deleted: true}
+		}
+		rec.Updated = now
+		state[p] = syncVersion{Updated: now, Deleted: rec.Deleted}
+		changed = append(changed, rec)
+	}
+	if err := saveSyncState(state); err != nil {
+		log.Println("sync state:", err)
+	}
+	if cfg.Role == "primary" {
+		enqueueSync(syncTargets(cfg), changed)
+	}
+}
+
+// enqueueSync adds records to the push queue, replacing any older entry
+// for the same node and account. The caller must hold syncMutex.
+func enqueueSync(nodes []Node, recs []UserRecord) {
+	if len(nodes) == 0 || len(recs) == 0 {
+		return
+	}
+	q := loadSyncQueue()
+	for _, n := range nodes {
+		for _, rec := range recs {
+			op := SyncOp{Node: n.Name, Record: rec, NextTry: time.Now()}
+			replaced := false
+			for i := range q {
+				if q[i].Node == n.Name && q[i].Record.Password == rec.Password {
+					q[i], replaced = op, true
+				}
+			}
+			if !replaced {
+				q = append(q, op)
+			}
+		}
+	}
+	if err := saveSyncQueue(q); err != nil {
+		log.Println("sync queue:", err)
+	}
+	select {
+	case syncWake <- struct{}{}:
+	default:
+	}
+}
+
+// pushSync sends one record. A node that already has a newer change
+// answers with stale=true, which settles the conflict in its favour.
+func pushSync(op SyncOp) error {
+	n, ok := findNode(op.Node)
+	if !ok {
+		return nil
+	}
+	res, err := n.call("POST", "/sync/user", op.Record)
+	if err != nil {
+		return err
+	}
+	if res.Success {
+		return nil
+	}
+	if d, ok := res.Data.(map[string]interface{}); ok && d["stale"] == true {
+		log.Printf("sync %s on %s: node has a newer change", op.Record.Password, op.Node)
+		return nil
+	}
+	return fmt.Errorf("%s", res.Message)
+}
+
+// processSyncQueue pushes every due operation. Failures are retried with
+// exponential backoff; the queue survives API restarts.
+func processSyncQueue() {
+	syncMutex.Lock()
+	var due []SyncOp
+	now := time.Now()
+	for _, op := range loadSyncQueue() {
+		if !op.NextTry.After(now) {
+			due = append(due, op)
+		}
+	}
+	syncMutex.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	errs := make([]error, len(due))
+	for i, op := range due {
+		errs[i] = pushSync(op)
+	}
+
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	q := loadSyncQueue()
+	var keep []SyncOp
+	for _, op := range q {
+		done := false
+		for i, d := range due {
+			if d.Node != op.Node || d.Record.Password != op.Record.Password || !d.Record.Updated.Equal(op.Record.Updated) {
+				continue
+			}
+			if errs[i] == nil {
+				done = true
+				break
+			}
+			op.Attempts++
+			op.LastError = errs[i].Error()
+			backoff := syncRetryBase << uint(op.Attempts-1)
+			if backoff > syncMaxBackoff || backoff <= 0 {
+				backoff = syncMaxBackoff
+			}
+			op.NextTry = time.Now().Add(backoff)
+		}
+		if !done {
+			keep = append(keep, op)
+		}
+	}
+	if err := saveSyncQueue(keep); err != nil {
+		log.Println("sync queue:", err)
+	}
+}
+
+func runSyncQueue() {
+	t := time.NewTicker(15 * time.Second)
+	defer t.Stop()
+	for {
+		processSyncQueue()
+		select {
+		case <-syncWake:
+		case <-t.C:
+		}
+	}
+}
+
+// applyUserRecord makes users.db and config.json match rec. The caller
+// must hold mutex.
+func applyUserRecord(rec UserRecord) (bool, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return false, err
+	}
+	users, err := loadUsers()
+	if err != nil {
+		return false, err
+	}
+
+	line := fmt.Sprintf("%s | %s", rec.Password, rec.Expired)
+	if rec.Note != "" {
+		line += " | " + rec.Note
+	}
+	var out []string
+	found := false
+	for _, l := range users {
+		if strings.TrimSpace(strings.Split(l, "|")[0]) != rec.Password {
+			out = append(out, l)
+			continue
+		}
+		found = true
+		if !rec.Deleted {
+			out = append(out, line)
+		}
+	}
+	if !found && !rec.Deleted {
+		out = append(out, line)
+	}
+
+	enabled := !rec.Deleted && !rec.Suspended
+	has := containsString(cfg.Auth.Config, rec.Password)
+	authChanged := enabled != has
+	if enabled && !has {
+		cfg.Auth.Config = append(cfg.Auth.Config, rec.Password)
+	}
+	if !enabled && has {
+		var auth []string
+		for _, p := range cfg.Auth.Config {
+			if p != rec.Password {
+				auth = append(auth, p)
+			}
+		}
+		cfg.Auth.Config = auth
+	}
+
+	usersChanged := !reflect.DeepEqual(out, users)
+	if usersChanged {
+		if err := saveUsers(out); err != nil {
+			return false, err
+		}
+	}
+	if authChanged {
+		if err := saveConfig(cfg); err != nil {
+			_ = saveUsers(users)
+			return false, err
+		}
+	}
+	return usersChanged || authChanged, nil
+}
+
+// syncUserHandler is the secondary side of POST /api/sync/user.
+func syncUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	if loadSyncCfg().Role != "secondary" {
+		jsonResponse(w, 409, false, "Sync is not enabled on this node, set role to secondary", nil)
+		return
+	}
+	var rec UserRecord
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil || !validPassword(rec.Password) || rec.Updated.IsZero() {
+		jsonResponse(w, 400, false, "Invalid request", nil)
+		return
+	}
+	if !rec.Deleted {
+		if _, err := time.Parse("2006-01-02", rec.Expired); err != nil {
+			jsonResponse(w, 400, false, "Invalid expired date", nil)
+			return
+		}
+	}
+	rec.Note = strings.NewReplacer("|", "/", "\n", " ", "\r", " ").Replace(rec.Note)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	state := loadSyncState()
+	if cur, ok := state[rec.Password]; ok && !cur.Updated.Before(rec.Updated) {
+		if cur.Updated.Equal(rec.Updated) {
+			jsonResponse(w, 200, true, "Already applied", nil)
+			return
+		}
+		jsonResponse(w, 409, false, "Stale: node has a newer change", map[string]interface{}{
+			"stale":  true,
+			"record": localRecords(state)[rec.Password],
+		})
+		return
+	}
+
+	changed, err := applyUserRecord(rec)
+	if err != nil {
+		jsonResponse(w, 500, false, "Apply error: "+err.Error(), nil)
+		return
+	}
+	state[rec.Password] = syncVersion{Updated: rec.Updated, Deleted: rec.Deleted}
+	if err := saveSyncState(state); err != nil {
+		jsonResponse(w, 500, false, "Save sync state error", nil)
+		return
+	}
+	if changed {
+		go restartAll()
+	}
+	jsonResponse(w, 200, true, "Applied", map[string]bool{"changed": changed})
+}
+
+func sortedRecords(m map[string]UserRecord) []UserRecord {
+	out := make([]UserRecord, 0, len(m))
+	for _, rec := range m {
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Password < out[j].Password })
+	return out
+}
+
+// syncUsersHandler lists this node's records for drift reports.
+func syncUsersHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	syncMutex.Lock()
+	recs := localRecords(loadSyncState())
+	syncMutex.Unlock()
+	mutex.Unlock()
+	jsonResponse(w, 200, true, "OK", sortedRecords(recs))
+}
+
+type DriftEntry struct {
+	Password string      `json:"password"`
+	Issue    string      `json:"issue"`
+	Newer    string      `json:"newer,omitempty"`
+	Primary  *UserRecord `json:"primary,omitempty"`
+	Node     *UserRecord `json:"node,omitempty"`
+}
+
+type DriftReport struct {
+	Node    string       `json:"node"`
+	Success bool         `json:"success"`
+	Message string       `json:"message,omitempty"`
+	InSync  bool         `json:"in_sync"`
+	Pending int          `json:"pending"`
+	Entries []DriftEntry `json:"entries"`
+}
+
+// diffRecords compares the primary's records with a node's. Tombstones
+// count as absent.
+func diffRecords(local, remote map[string]UserRecord) []DriftEntry {
+	out := []DriftEntry{}
+	keys := map[string]bool{}
+	for k := range local {
+		keys[k] = true
+	}
+	for k := range remote {
+		keys[k] = true
+	}
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, p := range names {
+		l, lok := local[p]
+		n, nok := remote[p]
+		lok, nok = lok && !l.Deleted, nok && !n.Deleted
+		e := DriftEntry{Password: p}
+		switch {
+		case !lok && !nok:
+			continue
+		case lok && !nok:
+			e.Issue = "missing"
+		case !lok && nok:
+			e.Issue = "extra"
+		case l.Expired != n.Expired || l.Suspended != n.Suspended:
+			e.Issue = "differs"
+		default:
+			continue
+		}
+		if _, ok := local[p]; ok {
+			rec := l
+			e.Primary = &rec
+		}
+		if _, ok := remote[p]; ok {
+			rec := n
+			e.Node = &rec
+		}
+		switch {
+		case e.Primary != nil && (e.Node == nil || e.Primary.Updated.After(e.Node.Updated)):
+			e.Newer = "primary"
+		case e.Node != nil && (e.Primary == nil || e.Node.Updated.After(e.Primary.Updated)):
+			e.Newer = "node"
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// syncDriftHandler compares every sync target with this node on
+// GET /api/sync/drift.
+func syncDriftHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := loadSyncCfg()
+	mutex.Lock()
+	syncMutex.Lock()
+	local := localRecords(loadSyncState())
+	queue := loadSyncQueue()
+	syncMutex.Unlock()
+	mutex.Unlock()
+
+	targets := syncTargets(cfg)
+	reports := make([]DriftReport, len(targets))
+	var wg sync.WaitGroup
+	for i, n := range targets {
+		wg.Add(1)
+		go func(i int, n Node) {
+			defer wg.Done()
+			rep := DriftReport{Node: n.Name, Entries: []DriftEntry{}}
+			for _, op := range queue {
+				if op.Node == n.Name {
+					rep.Pending++
+				}
+			}
+			res, err := n.call("GET", "/sync/users", nil)
+			if err != nil || !res.Success {
+				rep.Message = res.Message
+				if err != nil {
+					rep.Message = err.Error()
+				}
+				reports[i] = rep
+				return
+			}
+			remote := map[string]UserRecord{}
+			b, _ := json.Marshal(res.Data)
+			var list []UserRecord
+			_ = json.Unmarshal(b, &list)
+			for _, rec := range list {
+				remote[rec.Password] = rec
+			}
+			rep.Success = true
+			rep.Entries = diffRecords(local, remote)
+			rep.InSync = len(rep.Entries) == 0
+			reports[i] = rep
+		}(i, n)
+	}
+	wg.Wait()
+	jsonResponse(w, 200, true, "OK", map[string]interface{}{"role": cfg.Role, "nodes": reports})
+}
+
+type ResyncRequest struct {
+	Node  string `json:"node"`
+	Force bool   `json:"force"`
+}
+
+// syncResyncHandler queues every local record for one or all targets.
+// Without force, nodes keep changes newer than the primary's; force
+// stamps the records with the current time so the primary wins.
+func syncResyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	var req ResyncRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonResponse(w, 400, false, "Invalid request", nil)
+			return
+		}
+	}
+	cfg := loadSyncCfg()
+	if cfg.Role != "primary" {
+		jsonResponse(w, 409, false, "Only a primary can resync", nil)
+		return
+	}
+	var targets []Node
+	for _, n := range syncTargets(cfg) {
+		if req.Node == "" || n.Name == req.Node {
+			targets = append(targets, n)
+		}
+	}
+	if len(targets) == 0 {
+		jsonResponse(w, 404, false, "No matching sync node", nil)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	state := loadSyncState()
+	recs := sortedRecords(localRecords(state))
+	if req.Force {
+		now := time.Now()
+		for i := range recs {
+			recs[i].Updated = now
+			state[recs[i].Password] = syncVersion{Updated: now, Deleted: recs[i].Deleted}
+		}
+		if err := saveSyncState(state); err != nil {
+			jsonResponse(w, 500, false, "Save sync state error", nil)
+			return
+		}
+	}
+	enqueueSync(targets, recs)
+	jsonResponse(w, 200, true, fmt.Sprintf("%d records queued for %d nodes", len(recs), len(targets)), nil)
+}
+
+// syncHandler serves GET (role, targets and queue) and POST (set role and
+// nodes) on /api/sync.
+func syncHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		cfg := loadSyncCfg()
+		syncMutex.Lock()
+		queue := loadSyncQueue()
+		syncMutex.Unlock()
+		if queue == nil {
+			queue = []SyncOp{}
+		}
+		names := []string{}
+		for _, n := range syncTargets(cfg) {
+			names = append(names, n.Name)
+		}
+		out := map[string]interface{}{"role": cfg.Role, "queue": queue}
+		if cfg.Role == "primary" {
+			out["targets"] = names
+		}
+		jsonResponse(w, 200, true, "OK", out)
+	case http.MethodPost:
+		var cfg SyncCfg
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			jsonResponse(w, 400, false, "Invalid request", nil)
+			return
+		}
+		if cfg.Role != "" && cfg.Role != "primary" && cfg.Role != "secondary" {
+			jsonResponse(w, 400, false, "role must be primary, secondary or empty", nil)
+			return
+		}
+		for _, name := range cfg.Nodes {
+			if _, ok := findNode(name); !ok || name == LocalNode {
+				jsonResponse(w, 400, false, fmt.Sprintf("unknown node %q", name), nil)
+				return
+			}
+		}
+		b, _ := json.MarshalIndent(cfg, "", "  ")
+		if err := writeFileAtomic(SyncFile, b, 0644); err != nil {
+			jsonResponse(w, 500, false, "Save sync config error", nil)
+			return
+		}
+		jsonResponse(w, 200, true, "Sync config saved", cfg)
+	default:
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+	}
+}
+
+type SuspendRequest struct {
+	Password string `json:"password"`
+	Suspend  *bool  `json:"suspend"`
+}
+
+// suspendUserHandler disables (or with "suspend": false re-enables) an
+// account without touching its expiry: the password is removed from
+// config.json but kept in users.db.
+func suspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	var req SuspendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		jsonResponse(w, 400, false, "Invalid request", nil)
+		return
+	}
+	suspend := req.Suspend == nil || *req.Suspend
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	syncMutex.Lock()
+	rec, ok := localRecords(loadSyncState())[req.Password]
+	syncMutex.Unlock()
+	if !ok || rec.Deleted {
+		jsonResponse(w, 404, false, "User not found", nil)
+		return
+	}
+	rec.Suspended = suspend
+	changed, err := applyUserRecord(rec)
+	if err != nil {
+		jsonResponse(w, 500, false, "Save error", nil)
+		return
+	}
+	msg := "User resumed"
+	if suspend {
+		msg = "User suspended"
+	}
+	if changed {
+		userChanged(req.Password)
+		go restartAll()
+	}
+	jsonResponse(w, 200, true, msg, map[string]interface{}{"password": req.Password, "suspended": suspend})
+}
+
+var JobDir = "/etc/zivpn/jobs"
+
+const (
+	jobKeep = 50
+	jobTTL  = 7 * 24 * time.Hour
+)
+
+const (
+	JobQueued      = "queued"
+	JobRunning     = "running"
+	JobSucceeded   = "succeeded"
+	JobFailed      = "failed"
+	JobInterrupted = "interrupted"
+)
+
+// Job is a long-running operation (backup, restore) started by an API call
+// and polled through /api/jobs/{id}. Every state change is written to
+// JobDir so results survive an API restart.
+type Job struct {
+	ID       string      `json:"id"`
+	Type     string      `json:"type"`
+	Status   string      `json:"status"`
+	Progress int         `json:"progress"`
+	Stage    string      `json:"stage,omitempty"`
+	Message  string      `json:"message,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	Created  time.Time   `json:"created"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+}
+
+func (j *Job) done() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobInterrupted
+}
+
+// jobFunc does the work of a job. progress may be called at any time to
+// report a percentage and a short stage name. The returned message is shown
+// to the user; result is stored even when err is non-nil.
+type jobFunc func(progress func(int, string)) (result interface{}, message string, err error)
+
+type jobQueue struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+var jobs = &jobQueue{jobs: make(map[string]*Job)}
+
+func jobPath(id string) string {
+	return filepath.Join(JobDir, id+".json")
+}
+
+// save must be called with q.mu held.
+func (q *jobQueue) save(j *Job) {
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		log.Println("job", j.ID, err)
+		return
+	}
+	if err := writeFileAtomic(jobPath(j.ID), b, 0600); err != nil {
+		log.Println("job", j.ID, err)
+	}
+}
+
+// load reads persisted jobs, marks the ones that were still running when
+// the API stopped as interrupted and drops old entries.
+func (q *jobQueue) load() {
+	_ = os.MkdirAll(JobDir, 0700)
+	entries, err := ioutil.ReadDir(JobDir)
+	if err != nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var all []*Job
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(JobDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var j Job
+		if json.Unmarshal(b, &j) != nil || j.ID == "" {
+			continue
+		}
+		if !j.done() {
+			now := time.Now()
+			j.Status = JobInterrupted
+			j.Error = "API restarted before the job finished"
+			j.Finished = &now
+			q.save(&j)
+		}
+		all = append(all, &j)
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a].Created.After(all[b].Created) })
+	for i, j := range all {
+		if i >= jobKeep || time.Since(j.Created) > jobTTL {
+			_ = os.Remove(jobPath(j.ID))
+			continue
+		}
+		q.jobs[j.ID] = j
+	}
+}
+
+// submit starts fn in the background. For exclusive jobs, an unfinished
+// job of the same type is returned instead and fn is not started.
+func (q *jobQueue) submit(kind string, exclusive bool, fn jobFunc) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if exclusive {
+		for _, j := range q.jobs {
+			if j.Type == kind && !j.done() {
+				return *j, false
+			}
+		}
+	}
+
+	j := &Job{
+		ID:      fmt.Sprintf("%s-%s", kind, generateBackupID()),
+		Type:    kind,
+		Status:  JobQueued,
+		Created: time.Now(),
+	}
+	q.jobs[j.ID] = j
+	q.save(j)
+	go q.run(j, fn)
+	return *j, true
+}
+
+func (q *jobQueue) run(j *Job, fn jobFunc) {
+	q.mu.Lock()
+	now := time.Now()
+	j.Status = JobRunning
+	j.Started = &now
+	q.save(j)
+	q.mu.Unlock()
+
+	progress := func(p int, stage string) {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if p > j.Progress {
+			j.Progress = p
+		}
+		j.Stage = stage
+		q.save(j)
+	}
+
+	result, message, err := fn(progress)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now = time.Now()
+	j.Finished = &now
+	j.Result = result
+	j.Message = message
+	j.Stage = ""
+	if err != nil {
+		j.Status = JobFailed
+		j.Error = err.Error()
+		log.Printf("job %s failed: %v", j.ID, err)
+	} else {
+		j.Status = JobSucceeded
+		j.Progress = 100
+	}
+	q.save(j)
+}
+
+func (q *jobQueue) get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+func (q *jobQueue) list() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]Job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		out = append(out, *j)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created.After(out[b].Created) })
+	return out
+}
+
+// jobsHandler serves GET /api/jobs (recent jobs) and GET /api/jobs/{id}.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	if id == "" {
+		jsonResponse(w, 200, true, "OK", jobs.list())
+		return
+	}
+	j, ok := jobs.get(id)
+	if !ok {
+		jsonResponse(w, 404, false, "Job not found", nil)
+		return
+	}
+	jsonResponse(w, 200, true, j.Status, j)
+}
+
+func jobAccepted(w http.ResponseWriter, j Job, started bool) {
+	msg := "Job started"
+	if !started {
+		msg = "Job already running"
+	}
+	jsonResponse(w, 202, true, msg, map[string]interface{}{
+		"job_id": j.ID,
+		"status": j.Status,
+	})
+}
+
+var SchedulerStateFile = "/etc/zivpn/scheduler-state.json"
+
+// cronSpec is a parsed five-field cron expression (minute hour day-of-month
+// month day-of-week), stored as bitsets.
+type cronSpec struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	domAny bool
+	dowAny bool
+}
+
+var cronAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			r := strings.SplitN(part, "-", 2)
+			a, err1 := strconv.Atoi(r[0])
+			b, err2 := strconv.Atoi(r[1])
+			if err1 != nil || err2 != nil || a > b {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max {
+			return 0, fmt.Errorf("value %q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	expr = strings.TrimSpace(expr)
+	full := expr
+	if a, ok := cronAliases[expr]; ok {
+		full = a
+	}
+	f := strings.Fields(full)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields, got %d", len(f))
+	}
+	s := &cronSpec{expr: expr, domAny: f[2] == "*", dowAny: f[4] == "*"}
+	var err error
+	if s.minute, err = parseCronField(f[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if s.hour, err = parseCronField(f[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if s.dom, err = parseCronField(f[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if s.month, err = parseCronField(f[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	// Both 0 and 7 mean Sunday.
+	if s.dow, err = parseCronField(f[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	return s, nil
+}
+
+func (s *cronSpec) matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 || s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	domOK := s.dom&(1<<uint(t.Day())) != 0
+	dowOK := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// next returns the first matching minute strictly after t, or the zero
+// time if none occurs within five years (e.g. "0 0 30 2 *").
+func (s *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if s.matches(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+type JobStatus struct {
+	Name         string    `json:"name"`
+	Schedule     string    `json:"schedule"`
+	Running      bool      `json:"running"`
+	LastRun      time.Time `json:"last_run,omitempty"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastSuccess  time.Time `json:"last_success,omitempty"`
+	NextRun      time.Time `json:"next_run,omitempty"`
+}
+
+// summary is st without the timestamps that have never been set.
+func (st JobStatus) summary() map[string]interface{} {
+	out := map[string]interface{}{
+		"schedule": st.Schedule,
+		"running":  st.Running,
+	}
+	if !st.LastRun.IsZero() {
+		out["last_run"] = st.LastRun
+		out["last_duration"] = st.LastDuration
+	}
+	if !st.LastSuccess.IsZero() {
+		out["last_success"] = st.LastSuccess
+	}
+	if st.LastError != "" {
+		out["last_error"] = st.LastError
+	}
+	if !st.NextRun.IsZero() {
+		out["next_run"] = st.NextRun
+	}
+	return out
+}
+
+type cronJob struct {
+	spec   *cronSpec
+	run    func() error
+	status JobStatus
+}
+
+// scheduler runs named jobs on cron schedules inside the API process and
+// remembers their last outcome across restarts.
+type scheduler struct {
+	mu   sync.Mutex
+	jobs map[string]*cronJob
+	past map[string]JobStatus
+}
+
+var cron = &scheduler{jobs: make(map[string]*cronJob), past: make(map[string]JobStatus)}
+
+func (s *scheduler) loadState() {
+	b, err := ioutil.ReadFile(SchedulerStateFile)
+	if err != nil {
+		return
+	}
+	var st map[string]JobStatus
+	if json.Unmarshal(b, &st) == nil {
+		s.mu.Lock()
+		s.past = st
+		s.mu.Unlock()
+	}
+}
+
+// saveState must be called with s.mu held.
+func (s *scheduler) saveState() {
+	st := map[string]JobStatus{}
+	for k, v := range s.past {
+		st[k] = v
+	}
+	for k, j := range s.jobs {
+		st[k] = j.status
+	}
+	b, _ := json.MarshalIndent(st, "", "  ")
+	if err := writeFileAtomic(SchedulerStateFile, b, 0600); err != nil {
+		log.Println("scheduler state:", err)
+	}
+}
+
+func (s *scheduler) set(name, expr string, run func() error) error {
+	spec, err := parseCron(expr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[name]
+	if !ok {
+		j = &cronJob{status: s.past[name]}
+		s.jobs[name] = j
+	}
+	j.spec, j.run = spec, run
+	j.status.Name = name
+	j.status.Schedule = spec.expr
+	j.status.NextRun = spec.next(time.Now())
+	return nil
+}
+
+func (s *scheduler) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[name]; ok {
+		j.status.NextRun = time.Time{}
+		s.past[name] = j.status
+		delete(s.jobs, name)
+	}
+}
+
+func (s *scheduler) status(name string) (JobStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[name]; ok {
+		return j.status, true
+	}
+	st, ok := s.past[name]
+	return st, ok
+}
+
+func (s *scheduler) runJob(name string, j *cronJob) {
+	s.mu.Lock()
+	if j.status.Running {
+		s.mu.Unlock()
+		return
+	}
+	j.status.Running = true
+	s.mu.Unlock()
+
+	start := time.Now()
+	err := j.run()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.status.Running = false
+	j.status.LastRun = start
+	j.status.LastDuration = time.Since(start).Round(time.Millisecond).String()
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+		log.Printf("scheduled job %s failed: %v", name, err)
+	} else {
+		j.status.LastSuccess = start
+	}
+	s.saveState()
+}
+
+// start ticks at the top of every minute and launches due jobs.
+func (s *scheduler) start() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		tick := time.Now().Truncate(time.Minute)
+
+		s.mu.Lock()
+		for name, j := range s.jobs {
+			if j.spec.matches(tick) {
+				go s.runJob(name, j)
+			}
+			j.status.NextRun = j.spec.next(tick)
+		}
+		s.mu.Unlock()
+	}
+}
+
+type Retention struct {
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+}
+
+var defaultRetention = Retention{Daily: 7, Weekly: 4, Monthly: 3}
+
+func loadAutoBackupCfg() AutoBackupCfg {
+	cfg := AutoBackupCfg{Enabled: false, Schedule: "0 2 * * *", Retention: defaultRetention}
+	if b, err := ioutil.ReadFile(AutoBackupFile); err == nil {
+		json.Unmarshal(b, &cfg)
+	}
+	return cfg
+}
+
+func saveAutoBackupCfg(cfg AutoBackupCfg) error {
+	b, _ := json.MarshalIndent(cfg, "", "  ")
+	return writeFileAtomic(AutoBackupFile, b, 0644)
+}
+
+// retentionKeep picks which backups survive a keep-N daily/weekly/monthly
+// policy: the newest backup of each of the N most recent days, ISO weeks
+// and months is kept, everything else may be deleted.
+func retentionKeep(list []BackupObject, p Retention) map[string]bool {
+	sorted := append([]BackupObject(nil), list...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ModTime.After(sorted[j].ModTime) })
+
+	keep := map[string]bool{}
+	bucket := func(n int, key func(time.Time) string) {
+		seen := map[string]bool{}
+		for _, o := range sorted {
+			if len(seen) >= n {
+				return
+			}
+			k := key(o.ModTime.Local())
+			if !seen[k] {
+				seen[k] = true
+				keep[o.ID] = true
+			}
+		}
+	}
+	bucket(p.Daily, func(t time.Time) string { return t.Format("2006-01-02") })
+	bucket(p.Weekly, func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	})
+	bucket(p.Monthly, func(t time.Time) string { return t.Format("2006-01") })
+	return keep
+}
+
+func applyRetention(p Retention) (int, error) {
+	if p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0 {
+		return 0, nil
+	}
+	store, err := backupStore()
+	if err != nil {
+		return 0, err
+	}
+	list, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+	keep := retentionKeep(list, p)
+	deleted := 0
+	for _, o := range list {
+		if keep[o.ID] {
+			continue
+		}
+		if err := store.Delete(o.ID); err != nil {
+			log.Println("cleanup", o.Name, err)
+			continue
+		}
+		_ = os.Remove(manifestCachePath(o.Name))
+		deleted++
+	}
+	backupCountCache.invalidate()
+	return deleted, nil
+}
+
+func scheduledBackup() error {
+	obj, _, _, err := runBackup(nil)
+	if err != nil {
+		return err
+	}
+	log.Println("scheduled backup uploaded:", obj.Name)
+	if _, err := applyRetention(loadAutoBackupCfg().Retention); err != nil {
+		return fmt.Errorf("backup %s ok, retention failed: %v", obj.Name, err)
+	}
+	return nil
+}
+
+// syncAutoBackup registers or removes the backup job to match cfg.
+func syncAutoBackup(cfg AutoBackupCfg) error {
+	if !cfg.Enabled {
+		cron.remove("backup")
+		return nil
+	}
+	return cron.set("backup", cfg.Schedule, scheduledBackup)
+}
+
+func cleanupOldBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	deleted, err := applyRetention(loadAutoBackupCfg().Retention)
+	if err != nil {
+		jsonResponse(w, 500, false, err.Error(), nil)
+		return
+	}
+	jsonResponse(w, 200, true, "Cleanup OK", map[string]int{
+		"deleted": deleted,
+	})
+}
+
+func toggleAutoBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	cfg := loadAutoBackupCfg()
+	cfg.Enabled = !cfg.Enabled
+
+	if _, err := parseCron(cfg.Schedule); cfg.Enabled && err != nil {
+		jsonResponse(w, 400, false, "Invalid schedule: "+err.Error(), nil)
+		return
+	}
+	if err := saveAutoBackupCfg(cfg); err != nil {
+		jsonResponse(w, 500, false, "Save config error", nil)
+		return
+	}
+	if err := syncAutoBackup(cfg); err != nil {
+		jsonResponse(w, 500, false, "Schedule error: "+err.Error(), nil)
+		return
+	}
+
+	jsonResponse(w, 200, true, "OK", autoBackupStatus(cfg))
+}
+
+type AutoBackupScheduleRequest struct {
+	Schedule  string     `json:"schedule"`
+	Enabled   *bool      `json:"enabled"`
+	Retention *Retention `json:"retention"`
+}
+
+func setAutoBackupScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, 405, false, "Method not allowed", nil)
+		return
+	}
+	var req AutoBackupScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonResponse(w, 400, false, "Invalid request", nil)
+		return
+	}
+
+	cfg := loadAutoBackupCfg()
+	if req.Schedule != "" {
+		spec, err := parseCron(req.Schedule)
+		if err != nil {
+			jsonResponse(w, 400, false, "Invalid schedule: "+err.Error(), nil)
+			return
+		}
+		if spec.next(time.Now()).IsZero() {
+			jsonResponse(w, 400, false, "Invalid schedule: never runs", nil)
+			return
+		}
+		cfg.Schedule = spec.expr
+	}
+	if req.Enabled != nil {
+		cfg.Enabled = *req.Enabled
+	}
+	if req.Retention != nil {
+		if req.Retention.Daily < 0 || req.Retention.Weekly < 0 || req.Retention.Monthly < 0 {
+			jsonResponse(w, 400, false, "Retention values must not be negative", nil)
+			return
+		}
+		cfg.Retention = *req.Retention
+	}
+
+	if err := saveAutoBackupCfg(cfg); err != nil {
+		jsonResponse(w, 500, false, "Save config error", nil)
+		return
+	}
+	if err := syncAutoBackup(cfg); err != nil {
+		jsonResponse(w, 500, false, "Schedule error: "+err.Error(), nil)
+		return
+	}
+	jsonResponse(w, 200, true, "Schedule updated", autoBackupStatus(cfg))
+}
+
+func autoBackupStatus(cfg AutoBackupCfg) map[string]interface{} {
+	st, _ := cron.status("backup")
+	out := st.summary()
+	out["enabled"] = cfg.Enabled
+	out["schedule"] = cfg.Schedule
+	out["retention"] = cfg.Retention
+	if !cfg.Enabled {
+		delete(out, "next_run")
+	}
+	return out
+}
+
+func getAutoBackupStatusHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, 200, true, "OK", autoBackupStatus(loadAutoBackupCfg()))
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	reloadAuthToken()
+	if b, err := ioutil.ReadFile(MetricsKeyFile); err == nil {
+		MetricsToken = strings.TrimSpace(string(b))
 	}
 
 	os.MkdirAll(BackupDir, 0755)
 
-	http.HandleFunc("/api/user/create", authMiddleware(createUserHandler))
-	http.HandleFunc("/api/user/delete", authMiddleware(deleteUserHandler))
-	http.HandleFunc("/api/user/renew", authMiddleware(renewUserHandler))
-	http.HandleFunc("/api/users", authMiddleware(listUsersHandler))
-	http.HandleFunc("/api/info", authMiddleware(getSystemInfoHandler))
-	http.HandleFunc("/api/backup", authMiddleware(handleBackupHandler))
-	http.HandleFunc("/api/backup/list", authMiddleware(listBackupsHandler))
-	http.HandleFunc("/api/restore", authMiddleware(restoreHandler))
-	http.HandleFunc("/api/backup/cleanup", authMiddleware(cleanupOldBackupsHandler))
-	http.HandleFunc("/api/backup/auto", authMiddleware(toggleAutoBackupHandler))
-	http.HandleFunc("/api/backup/auto/status", authMiddleware(getAutoBackupStatusHandler))
+	apiGuard = newGuard(loadSecurityCfg())
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			apiGuard.sweep(30 * time.Minute)
+		}
+	}()
+	go func() {
+		for range time.Tick(30 * time.Second) {
+			online.refresh()
+		}
+	}()
+
+	go followCoreLog(loadLogIngestCfg())
+
+	jobs.load()
+	cleanUploads()
+	sweepArchives(archiveTTL)
+	cron.loadState()
+	_ = os.Remove("/etc/cron.d/zivpn-backup")
+	if err := syncAutoBackup(loadAutoBackupCfg()); err != nil {
+		log.Println("auto backup:", err)
+	}
+	if err := syncAcmeRenewal(loadAcmeCfg()); err != nil {
+		log.Println("acme renewal:", err)
+	}
+	if err := cron.set("cert-expiry", "0 9 * * *", checkCertExpiry); err != nil {
+		log.Println("cert expiry:", err)
+	}
+	loadLicense()
+	if err := cron.set("license", "0 * * * *", refreshLicense); err != nil {
+		log.Println("license:", err)
+	}
+	go func() {
+		if err := refreshLicense(); err != nil {
+			log.Println("license:", err)
+		}
+	}()
+	go cron.start()
+
+	applyBans()
+	initDNAT()
+	armObfsRotation()
+	go runSyncQueue()
+	go func() {
+		for range time.Tick(time.Minute) {
+			expireBans()
+		}
+	}()
+
+	http.HandleFunc("/api/user/create", instrument("/api/user/create", authMiddleware(createUserHandler)))
+	http.HandleFunc("/api/user/delete", instrument("/api/user/delete", authMiddleware(deleteUserHandler)))
+	http.HandleFunc("/api/user/renew", instrument("/api/user/renew", authMiddleware(renewUserHandler)))
+	http.HandleFunc("/api/users", instrument("/api/users", authMiddleware(listUsersHandler)))
+	http.HandleFunc("/api/info", instrument("/api/info", authMiddleware(getSystemInfoHandler)))
+	http.HandleFunc("/api/backup", instrument("/api/backup", authMiddleware(handleBackupHandler)))
+	http.HandleFunc("/api/backup/list", instrument("/api/backup/list", authMiddleware(listBackupsHandler)))
+	http.HandleFunc("/api/backup/verify", instrument("/api/backup/verify", authMiddleware(verifyBackupHandler)))
+	http.HandleFunc("/api/restore", instrument("/api/restore", authMiddleware(restoreHandler)))
+	http.HandleFunc("/api/backup/cleanup", instrument("/api/backup/cleanup", authMiddleware(cleanupOldBackupsHandler)))
+	http.HandleFunc("/api/backup/auto", instrument("/api/backup/auto", authMiddleware(toggleAutoBackupHandler)))
+	http.HandleFunc("/api/backup/auto/status", instrument("/api/backup/auto/status", authMiddleware(getAutoBackupStatusHandler)))
+	http.HandleFunc("/api/users/import", instrument("/api/users/import", authMiddleware(importUsersHandler)))
+	http.HandleFunc("/api/users/export", instrument("/api/users/export", authMiddleware(exportUsersHandler)))
+	http.HandleFunc("/api/backup/archive", instrument("/api/backup/archive", authMiddleware(backupArchiveHandler)))
+	http.HandleFunc("/api/backup/encryption", instrument("/api/backup/encryption", authMiddleware(backupEncryptionHandler)))
+	http.HandleFunc("/api/restore/upload", instrument("/api/restore/upload", authMiddleware(restoreUploadHandler)))
+	http.HandleFunc("/api/server/config", instrument("/api/server/config", authMiddleware(serverConfigHandler)))
+	http.HandleFunc("/api/server/cert", instrument("/api/server/cert", authMiddleware(serverCertHandler)))
+	http.HandleFunc("/api/server/ports", instrument("/api/server/ports", authMiddleware(serverPortsHandler)))
+	http.HandleFunc("/api/server/obfs/rotate", instrument("/api/server/obfs/rotate", authMiddleware(obfsRotateHandler)))
+	http.HandleFunc("/api/users/cards", instrument("/api/users/cards", authMiddleware(accountCardsHandler)))
+	http.HandleFunc("/api/nodes", instrument("/api/nodes", authMiddleware(nodesHandler)))
+	http.HandleFunc("/api/nodes/", instrument("/api/nodes/{name}", authMiddleware(nodeProxyHandler)))
+	http.HandleFunc("/api/cluster/users", instrument("/api/cluster/users", authMiddleware(clusterUsersHandler)))
+	http.HandleFunc("/api/cluster/info", instrument("/api/cluster/info", authMiddleware(clusterInfoHandler)))
+	http.HandleFunc("/api/cluster/user/create", instrument("/api/cluster/user/create", authMiddleware(clusterCreateUserHandler)))
+	http.HandleFunc("/api/user/suspend", instrument("/api/user/suspend", authMiddleware(suspendUserHandler)))
+	http.HandleFunc("/api/sync", instrument("/api/sync", authMiddleware(syncHandler)))
+	http.HandleFunc("/api/sync/user", instrument("/api/sync/user", authMiddleware(syncUserHandler)))
+	http.HandleFunc("/api/sync/users", instrument("/api/sync/users", authMiddleware(syncUsersHandler)))
+	http.HandleFunc("/api/sync/drift", instrument("/api/sync/drift", authMiddleware(syncDriftHandler)))
+	http.HandleFunc("/api/sync/resync", instrument("/api/sync/resync", authMiddleware(syncResyncHandler)))
+	http.HandleFunc("/api/license", instrument("/api/license", authMiddleware(licenseHandler)))
+	http.HandleFunc("/api/domain", instrument("/api/domain", authMiddleware(domainHandler)))
+	http.HandleFunc("/api/jobs", instrument("/api/jobs", authMiddleware(jobsHandler)))
+	http.HandleFunc("/api/jobs/", instrument("/api/jobs/{id}", authMiddleware(jobsHandler)))
+	http.HandleFunc("/api/backup/auto/schedule", instrument("/api/backup/auto/schedule", authMiddleware(setAutoBackupScheduleHandler)))
+	http.HandleFunc("/api/security/stats", instrument("/api/security/stats", authMiddleware(securityStatsHandler)))
+	http.HandleFunc("/api/online", instrument("/api/online", authMiddleware(onlineHandler)))
+	http.HandleFunc("/api/session/kick", instrument("/api/session/kick", authMiddleware(kickHandler)))
+	http.HandleFunc("/api/session/unban", instrument("/api/session/unban", authMiddleware(unbanHandler)))
+	http.HandleFunc("/api/session/bans", instrument("/api/session/bans", authMiddleware(listBansHandler)))
+	http.HandleFunc("/api/logs", instrument("/api/logs", authMiddleware(logsHandler)))
+	http.HandleFunc("/metrics", metricsAuth(metricsHandler))
 
 	log.Println("ZiVPN API running on", Port)
 	log.Fatal(http.ListenAndServe(Port, nil))
@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -23,6 +28,12 @@ const (
 
 var ApiKey = ""
 
+// AllServers is the activeServer value for the aggregated view.
+const AllServers = "*"
+
+// activeServer is the node picked in the main menu; "" is this server.
+var activeServer = ""
+
 type BotConfig struct {
 	BotToken string `json:"bot_token"`
 	AdminID  int64  `json:"admin_id"`
@@ -37,6 +48,10 @@ var userStates = make(map[int64]string)
 var tempUserData = make(map[int64]map[string]string)
 var lastMessageIDs = make(map[int64]int)
 
+// botMu serializes access to the chat state above. The update loop holds it
+// while handling an update; background job polls take it before replying.
+var botMu sync.Mutex
+
 func main() {
 	if b, err := ioutil.ReadFile(ApiKeyFile); err == nil {
 		ApiKey = strings.TrimSpace(string(b))
@@ -60,23 +75,37 @@ func main() {
 				bot.Send(msg)
 				continue
 			}
+			botMu.Lock()
 			handleMessage(bot, update.Message, cfg.AdminID)
+			botMu.Unlock()
 		} else if update.CallbackQuery != nil {
 			if update.CallbackQuery.From.ID != cfg.AdminID {
 				bot.Request(tgbotapi.NewCallback(update.CallbackQuery.ID, "Akses Ditolak"))
 				continue
 			}
+			botMu.Lock()
 			handleCallback(bot, update.CallbackQuery, cfg.AdminID)
+			botMu.Unlock()
 		}
 	}
 }
 
 func handleMessage(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, adminID int64) {
+	if doc := backupDocument(msg); doc != nil {
+		resetState(msg.From.ID)
+		tempUserData[msg.From.ID] = map[string]string{"backup_id": doc.FileName, "file_id": doc.FileID}
+		showRestoreModes(bot, msg.Chat.ID)
+		return
+	}
 	if state, ok := userStates[msg.From.ID]; ok && state != "" {
 		handleState(bot, msg, state)
 		return
 	}
 	if msg.IsCommand() {
+		if activeServer == AllServers && msg.Command() != "start" && msg.Command() != "menu" {
+			sendServerRequired(bot, msg.Chat.ID)
+			return
+		}
 		switch msg.Command() {
 		case "start", "menu":
 			showMainMenu(bot, msg.Chat.ID)
@@ -85,9 +114,15 @@ func handleMessage(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, adminID int64) {
 		case "restore":
 			userStates[msg.From.ID] = "restore_id"
 			tempUserData[msg.From.ID] = make(map[string]string)
-			sendStyledMessage(bot, msg.Chat.ID, "🔄 *RESTORE BACKUP*\n\nSilakan masukkan **ID Backup**:")
+			sendStyledMessage(bot, msg.Chat.ID, "🔄 *RESTORE BACKUP*\n\nSilakan masukkan **ID Backup** atau kirim file backup (`.zip`):")
 		case "listbackup":
 			listBackups(bot, msg.Chat.ID)
+		case "logs":
+			n, err := strconv.Atoi(strings.TrimSpace(msg.CommandArguments()))
+			if err != nil || n <= 0 {
+				n = 10
+			}
+			showErrorLogs(bot, msg.Chat.ID, n)
 		default:
 			sendStyledMessage(bot, msg.Chat.ID, "❌ *PERINTAH TIDAK DIKENAL*\n\nGunakan `/menu` untuk membuka menu utama.")
 		}
@@ -97,7 +132,36 @@ func handleMessage(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, adminID int64) {
 func handleCallback(bot *tgbotapi.BotAPI, q *tgbotapi.CallbackQuery, adminID int64) {
 	data := q.Data
 	bot.Request(tgbotapi.NewCallback(q.ID, ""))
+	if activeServer == AllServers && !allServersAction(data) {
+		sendServerRequired(bot, q.Message.Chat.ID)
+		return
+	}
 	switch {
+	case data == "menu_servers":
+		showServerPicker(bot, q.Message.Chat.ID, "")
+	case strings.HasPrefix(data, "srv_pick:"):
+		activeServer = strings.TrimPrefix(data, "srv_pick:")
+		if activeServer == "local" {
+			activeServer = ""
+		}
+		showMainMenu(bot, q.Message.Chat.ID)
+	case data == "srv_add":
+		userStates[q.From.ID] = "node_name"
+		tempUserData[q.From.ID] = make(map[string]string)
+		sendStyledMessage(bot, q.Message.Chat.ID, "➕ *TAMBAH SERVER*\n\nMasukkan **nama** server (huruf kecil, angka, `-`), contoh: `sg-1`:")
+	case data == "srv_remove":
+		showNodeRemoval(bot, q.Message.Chat.ID)
+	case strings.HasPrefix(data, "srv_del:"):
+		removeNode(bot, q.Message.Chat.ID, strings.TrimPrefix(data, "srv_del:"))
+	case strings.HasPrefix(data, "create_all:"):
+		opts := tempUserData[q.From.ID]
+		if opts == nil || opts["create_all"] != strings.TrimPrefix(data, "create_all:") {
+			sendStyledMessage(bot, q.Message.Chat.ID, "⌛ *TOMBOL KEDALUWARSA*\n\n_Buat akun lagi lalu tekan tombolnya._")
+		} else {
+			days, _ := strconv.Atoi(opts["days"])
+			resetState(q.From.ID)
+			createUserOnAll(bot, q.Message.Chat.ID, opts["username"], days, []string{serverName(activeServer)})
+		}
 	case data == "menu_create":
 		userStates[q.From.ID] = "create_username"
 		tempUserData[q.From.ID] = make(map[string]string)
@@ -112,18 +176,58 @@ func handleCallback(bot *tgbotapi.BotAPI, q *tgbotapi.CallbackQuery, adminID int
 		listUsers(bot, q.Message.Chat.ID)
 	case data == "menu_info":
 		systemInfo(bot, q.Message.Chat.ID)
+	case data == "menu_online":
+		showOnline(bot, q.Message.Chat.ID)
+	case data == "menu_bans":
+		showBans(bot, q.Message.Chat.ID)
+	case strings.HasPrefix(data, "kick:"):
+		kickSession(bot, q.Message.Chat.ID, strings.TrimPrefix(data, "kick:"))
+	case strings.HasPrefix(data, "unban:"):
+		unbanIP(bot, q.Message.Chat.ID, strings.TrimPrefix(data, "unban:"))
 	case data == "menu_backup":
 		showBackupMenu(bot, q.Message.Chat.ID)
+	case data == "menu_server":
+		showServerSettings(bot, q.Message.Chat.ID)
+	case strings.HasPrefix(data, "server_edit:"):
+		field := strings.TrimPrefix(data, "server_edit:")
+		userStates[q.From.ID] = "server_value"
+		tempUserData[q.From.ID] = map[string]string{"field": field}
+		sendStyledMessage(bot, q.Message.Chat.ID, serverFieldPrompts[field])
+	case data == "server_apply":
+		opts := tempUserData[q.From.ID]
+		if opts == nil || opts["field"] == "" {
+			sendStyledMessage(bot, q.Message.Chat.ID, "❌ *SESI KADALUARSA*\n\nUlangi dari menu Server Settings.")
+			return
+		}
+		resetState(q.From.ID)
+		applyServerSetting(bot, q.Message.Chat.ID, opts)
+	case data == "obfs_rotate":
+		showObfsRotate(bot, q.Message.Chat.ID)
+	case strings.HasPrefix(data, "obfs_rotate:"):
+		hours, _ := strconv.Atoi(strings.TrimPrefix(data, "obfs_rotate:"))
+		rotateObfs(bot, q.Message.Chat.ID, hours)
+	case data == "obfs_cancel":
+		cancelObfsRotation(bot, q.Message.Chat.ID)
+	case data == "obfs_cards":
+		sendAccountCards(bot, q.Message.Chat.ID)
 	case data == "backup_create":
 		createBackup(bot, q.Message.Chat.ID)
 	case data == "backup_list":
 		listBackups(bot, q.Message.Chat.ID)
+	case data == "backup_telegram":
+		sendBackupDocument(bot, q.Message.Chat.ID)
 	case data == "backup_restore":
 		userStates[q.From.ID] = "restore_id"
 		tempUserData[q.From.ID] = make(map[string]string)
-		sendStyledMessage(bot, q.Message.Chat.ID, "🔄 *RESTORE BACKUP*\n\nSilakan masukkan **ID Backup**:")
+		sendStyledMessage(bot, q.Message.Chat.ID, "🔄 *RESTORE BACKUP*\n\nSilakan masukkan **ID Backup** atau kirim file backup (`.zip`):")
 	case data == "backup_auto":
 		toggleAutoBackup(bot, q.Message.Chat.ID)
+	case data == "backup_pass":
+		showBackupPassphrase(bot, q.Message.Chat.ID)
+	case data == "backup_pass_set":
+		userStates[q.From.ID] = "backup_passphrase"
+		tempUserData[q.From.ID] = make(map[string]string)
+		sendStyledMessage(bot, q.Message.Chat.ID, "🔐 *GANTI PASSPHRASE*\n\nKirim passphrase baru (minimal 12 karakter). Untuk restore backup dari server lain, kirim passphrase server tersebut.\n\n_Pesan Anda akan dihapus setelah diterima._")
 	case data == "cancel":
 		resetState(q.From.ID)
 		showMainMenu(bot, q.Message.Chat.ID)
@@ -150,6 +254,35 @@ func handleCallback(bot *tgbotapi.BotAPI, q *tgbotapi.CallbackQuery, adminID int
 			),
 		)
 		sendAndTrack(bot, msg)
+	case strings.HasPrefix(data, "restore_mode:"):
+		opts := tempUserData[q.From.ID]
+		if opts == nil || opts["backup_id"] == "" {
+			sendStyledMessage(bot, q.Message.Chat.ID, "❌ *SESI RESTORE KADALUARSA*\n\nUlangi dari menu backup.")
+			return
+		}
+		opts["mode"] = strings.TrimPrefix(data, "restore_mode:")
+		if opts["mode"] == "config" {
+			opts["strategy"] = "replace"
+			previewRestore(bot, q.Message.Chat.ID, opts)
+			return
+		}
+		showRestoreStrategies(bot, q.Message.Chat.ID)
+	case strings.HasPrefix(data, "restore_strategy:"):
+		opts := tempUserData[q.From.ID]
+		if opts == nil || opts["backup_id"] == "" {
+			sendStyledMessage(bot, q.Message.Chat.ID, "❌ *SESI RESTORE KADALUARSA*\n\nUlangi dari menu backup.")
+			return
+		}
+		opts["strategy"] = strings.TrimPrefix(data, "restore_strategy:")
+		previewRestore(bot, q.Message.Chat.ID, opts)
+	case data == "restore_confirm":
+		opts := tempUserData[q.From.ID]
+		if opts == nil || opts["backup_id"] == "" {
+			sendStyledMessage(bot, q.Message.Chat.ID, "❌ *SESI RESTORE KADALUARSA*\n\nUlangi dari menu backup.")
+			return
+		}
+		resetState(q.From.ID)
+		restoreBackup(bot, q.Message.Chat.ID, opts)
 	case strings.HasPrefix(data, "confirm_delete:"):
 		username := strings.TrimPrefix(data, "confirm_delete:")
 		deleteUser(bot, q.Message.Chat.ID, username)
@@ -174,8 +307,8 @@ func handleState(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, state string) {
 			return
 		}
 		username := tempUserData[uid]["username"]
-		createUser(bot, msg.Chat.ID, username, days)
 		resetState(uid)
+		createUser(bot, msg.Chat.ID, uid, username, days)
 	case "renew_days":
 		days, err := strconv.Atoi(text)
 		if err != nil || days <= 0 {
@@ -185,9 +318,36 @@ func handleState(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, state string) {
 		username := tempUserData[uid]["username"]
 		renewUser(bot, msg.Chat.ID, username, days)
 		resetState(uid)
-	case "restore_id":
-		restoreBackup(bot, msg.Chat.ID, text)
+	case "node_name":
+		tempUserData[uid]["name"] = strings.ToLower(text)
+		userStates[uid] = "node_url"
+		sendStyledMessage(bot, msg.Chat.ID, "🔗 *URL API*\n\nMasukkan URL API server, contoh: `http://203.0.113.10:8080`")
+	case "node_url":
+		tempUserData[uid]["url"] = text
+		userStates[uid] = "node_key"
+		sendStyledMessage(bot, msg.Chat.ID, "🔑 *API KEY*\n\nMasukkan isi `/etc/zivpn/apikey` di server tersebut:")
+	case "node_key":
+		opts := tempUserData[uid]
 		resetState(uid)
+		_, _ = bot.Request(tgbotapi.NewDeleteMessage(msg.Chat.ID, msg.MessageID))
+		addNode(bot, msg.Chat.ID, opts["name"], opts["url"], text)
+	case "server_value":
+		opts := tempUserData[uid]
+		if opts == nil {
+			resetState(uid)
+			return
+		}
+		opts["value"] = text
+		delete(userStates, uid)
+		previewServerSetting(bot, msg.Chat.ID, opts)
+	case "backup_passphrase":
+		resetState(uid)
+		_, _ = bot.Request(tgbotapi.NewDeleteMessage(msg.Chat.ID, msg.MessageID))
+		setBackupPassphrase(bot, msg.Chat.ID, text)
+	case "restore_id":
+		tempUserData[uid] = map[string]string{"backup_id": text}
+		delete(userStates, uid)
+		showRestoreModes(bot, msg.Chat.ID)
 	default:
 		resetState(uid)
 	}
@@ -214,21 +374,10 @@ func createTrialUser(bot *tgbotapi.BotAPI, chatID int64) {
 			domain = "Unknown"
 		}
 
-		msg := fmt.Sprintf(
-			"✨ *AKUN TRIAL BERHASIL DIBUAT*\n"+
-				"━━━━━━━━━━━━━━━━━━━━\n"+
-				"👤 **Username**\n`%s`\n\n"+
-				"🔑 **Password**\n`%s`\n\n"+
-				"🌐 **Domain**\n`%s`\n\n"+
-				"⏰ **Masa Aktif**\n1 Hari\n\n"+
-				"📅 **Expired**\n`%s`\n"+
-				"━━━━━━━━━━━━━━━━━━━━\n"+
-				"_Akun trial akan otomatis terhapus setelah expired._",
-			data["password"],
-			data["password"],
-			domain,
-			data["expired"],
-		)
+		data["domain"] = domain
+		msg := accountCard("✨ *AKUN TRIAL BERHASIL DIBUAT*", data,
+			"⏰ **Masa Aktif**\n1 Hari\n\n",
+			"_Akun trial akan otomatis terhapus setelah expired._")
 
 		reply := tgbotapi.NewMessage(chatID, msg)
 		reply.ParseMode = "Markdown"
@@ -248,31 +397,41 @@ func createBackup(bot *tgbotapi.BotAPI, chatID int64) {
 		return
 	}
 
-	if success, ok := res["success"].(bool); ok && success {
-		data := res["data"].(map[string]interface{})
-
-		backupID := fmt.Sprintf("%v", data["backup_id"])
-		filename := fmt.Sprintf("%v", data["filename"])
-		downloadURL := fmt.Sprintf("%v", data["download_url"])
+	runJob(bot, chatID, "🔄 *MEMBUAT BACKUP...*", res, func(job map[string]interface{}, err error) {
+		if err != nil {
+			sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT BACKUP*\n\nError: "+err.Error())
+			return
+		}
 
-		msg := fmt.Sprintf(
-			"✅ *BACKUP BERHASIL DIBUAT*\n"+
-				"━━━━━━━━━━━━━━━━━━━━\n"+
-				"📁 **Google Drive File ID**\n```\n%s\n```\n\n"+
-				"📄 **Nama File**\n`%s`\n\n"+
-				"🔗 **Download URL**\n`%s`\n"+
-				"━━━━━━━━━━━━━━━━━━━━\n"+
-				"_Gunakan File ID saat melakukan restore._",
-			backupID,
-			filename,
-			downloadURL,
-		)
+		if job["status"] == "succeeded" {
+			data, _ := job["result"].(map[string]interface{})
+
+			backupID := fmt.Sprintf("%v", data["backup_id"])
+			filename := fmt.Sprintf("%v", data["filename"])
+			downloadURL, _ := data["download_url"].(string)
+			store, _ := data["store"].(string)
+
+			var b strings.Builder
+			b.WriteString("✅ *BACKUP BERHASIL DIBUAT*\n")
+			b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+			b.WriteString(fmt.Sprintf("📁 **Backup ID**\n```\n%s\n```\n\n", backupID))
+			b.WriteString(fmt.Sprintf("📄 **Nama File**\n`%s`\n\n", filename))
+			if store != "" {
+				b.WriteString(fmt.Sprintf("🗄 **Storage**\n`%s`\n\n", store))
+			}
+			if downloadURL != "" {
+				b.WriteString(fmt.Sprintf("🔗 **Download URL**\n`%s`\n", downloadURL))
+			}
+			b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+			b.WriteString("_Gunakan Backup ID saat melakukan restore._")
+			msg := b.String()
 
-		sendStyledMessage(bot, chatID, msg)
-		return
-	}
+			sendStyledMessage(bot, chatID, msg)
+			return
+		}
 
-	sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT BACKUP*")
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT BACKUP*\n\nError: "+fmt.Sprintf("%v", job["error"]))
+	})
 }
 
 func listBackups(bot *tgbotapi.BotAPI, chatID int64) {
@@ -292,7 +451,7 @@ func listBackups(bot *tgbotapi.BotAPI, chatID int64) {
 		}
 
 		var b strings.Builder
-		b.WriteString("📦 *DAFTAR BACKUP (Google Drive)*\n")
+		b.WriteString("📦 *DAFTAR BACKUP*\n")
 		b.WriteString("━━━━━━━━━━━━━━━━━━━━\n\n")
 
 		for i, it := range arr {
@@ -301,8 +460,24 @@ func listBackups(bot *tgbotapi.BotAPI, chatID int64) {
 			file := fmt.Sprintf("%v", m["filename"])
 			size := m["size"]
 			sizeStr := formatBytes(size)
-			downloadURL := fmt.Sprintf("%v", m["download_url"])
+			downloadURL, _ := m["download_url"].(string)
+			if mf, ok := m["manifest"].(map[string]interface{}); ok {
+				created := fmt.Sprintf("%v", mf["created"])
+				if t, err := time.Parse(time.RFC3339Nano, created); err == nil {
+					created = t.Local().Format("02 Jan 2006 15:04")
+				}
+				sizeStr = fmt.Sprintf("%s, %v user, %s", sizeStr, mf["user_count"], created)
+			}
 
+			if downloadURL == "" {
+				b.WriteString(fmt.Sprintf(
+					"**%d.** 📁 `%s`\n"+
+						"   ├─ 📄 *File:* `%s`\n"+
+						"   └─ 💾 *Size:* `%s`\n\n",
+					i+1, fileID, file, sizeStr,
+				))
+				continue
+			}
 			b.WriteString(fmt.Sprintf(
 				"**%d.** 📁 `%s`\n"+
 					"   ├─ 📄 *File:* `%s`\n"+
@@ -319,27 +494,422 @@ func listBackups(bot *tgbotapi.BotAPI, chatID int64) {
 	sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL DAFTAR BACKUP*")
 }
 
-func restoreBackup(bot *tgbotapi.BotAPI, chatID int64, backupID string) {
-	sendStyledMessage(bot, chatID,
-		fmt.Sprintf("🔄 *MEMPROSES RESTORE...*\n\nID Backup (Drive ID): `%s`", backupID))
+var restoreModeLabels = map[string]string{
+	"full":   "📦 Full",
+	"users":  "👥 User saja",
+	"config": "⚙️ Config saja",
+}
+
+var restoreStrategyLabels = map[string]string{
+	"replace": "♻️ Replace",
+	"merge":   "🔀 Merge",
+}
+
+func showRestoreModes(bot *tgbotapi.BotAPI, chatID int64) {
+	msg := tgbotapi.NewMessage(chatID, "🔄 *RESTORE BACKUP*\n\n"+
+		"Pilih data yang akan direstore:\n\n"+
+		"📦 *Full* — semua file (config, user, domain, sertifikat, API key)\n"+
+		"👥 *User saja* — daftar user, tanpa mengubah domain/sertifikat\n"+
+		"⚙️ *Config saja* — pengaturan server, user saat ini tetap")
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(restoreModeLabels["full"], "restore_mode:full"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(restoreModeLabels["users"], "restore_mode:users"),
+			tgbotapi.NewInlineKeyboardButtonData(restoreModeLabels["config"], "restore_mode:config"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+func showRestoreStrategies(bot *tgbotapi.BotAPI, chatID int64) {
+	msg := tgbotapi.NewMessage(chatID, "🔄 *RESTORE BACKUP*\n\n"+
+		"Bagaimana user dari backup digabung?\n\n"+
+		"♻️ *Replace* — user saat ini diganti isi backup\n"+
+		"🔀 *Merge* — gabungkan, expired paling lama yang dipakai")
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(restoreStrategyLabels["merge"], "restore_strategy:merge"),
+			tgbotapi.NewInlineKeyboardButtonData(restoreStrategyLabels["replace"], "restore_strategy:replace"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
 
-	res, err := apiCall("POST", "/restore", map[string]interface{}{
-		"backup_id": backupID,
+func restorePayload(opts map[string]string, dryRun bool) map[string]interface{} {
+	return map[string]interface{}{
+		"backup_id": opts["backup_id"],
+		"mode":      opts["mode"],
+		"strategy":  opts["strategy"],
+		"dry_run":   dryRun,
+	}
+}
+
+// startRestore starts a restore job from the backup store, or from the
+// Telegram file the admin sent when opts has a file_id, and follows it like
+// runJob. It must be called with botMu held.
+func startRestore(bot *tgbotapi.BotAPI, chatID int64, opts map[string]string, dryRun bool, title string, done func(map[string]interface{}, error)) {
+	if opts["file_id"] == "" {
+		res, err := apiCall("POST", "/restore", restorePayload(opts, dryRun))
+		if err != nil {
+			done(nil, err)
+			return
+		}
+		runJob(bot, chatID, title, res, done)
+		return
+	}
+	origin := originOf(chatID)
+	var res map[string]interface{}
+	inBackground(func() (err error) {
+		res, err = uploadRestore(bot, origin.base, opts, dryRun)
+		return err
+	}, func(err error) {
+		if err != nil {
+			done(nil, err)
+			return
+		}
+		followJob(bot, chatID, origin, title, res, done)
 	})
+}
 
+// uploadRestore streams the Telegram file in opts to base's
+// /restore/upload. It makes no bot state changes, so it runs without botMu.
+func uploadRestore(bot *tgbotapi.BotAPI, base string, opts map[string]string, dryRun bool) (map[string]interface{}, error) {
+	url, err := bot.GetFileDirectURL(opts["file_id"])
 	if err != nil {
-		sendStyledMessage(bot, chatID, "❌ *GAGAL RESTORE*\n\nError: "+err.Error())
-		return
+		return nil, err
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download file Telegram gagal: %s", resp.Status)
 	}
 
-	if ok, _ := res["success"].(bool); ok {
-		sendStyledMessage(bot, chatID,
-			"✅ *RESTORE BERHASIL*\n\n_Sistem berhasil direstore dari Google Drive._")
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		mw.WriteField("mode", opts["mode"])
+		mw.WriteField("strategy", opts["strategy"])
+		mw.WriteField("dry_run", strconv.FormatBool(dryRun))
+		part, err := mw.CreateFormFile("file", opts["backup_id"])
+		if err == nil {
+			_, err = io.Copy(part, resp.Body)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest("POST", base+"/restore/upload", pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if ApiKey != "" {
+		req.Header.Set("X-API-Key", ApiKey)
+	}
+	client := &http.Client{Timeout: 5 * time.Minute}
+	r, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	var res map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// backupDocument returns the backup file attached to msg, or to the message
+// it replies to.
+func backupDocument(msg *tgbotapi.Message) *tgbotapi.Document {
+	for _, m := range []*tgbotapi.Message{msg, msg.ReplyToMessage} {
+		if m == nil || m.Document == nil {
+			continue
+		}
+		name := strings.ToLower(m.Document.FileName)
+		if strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".zip.enc") || strings.HasSuffix(name, ".zip.age") {
+			return m.Document
+		}
+	}
+	return nil
+}
+
+// sendBackupDocument asks the API for a fresh backup archive and sends it
+// to the chat as a file, so no backup store is needed.
+func sendBackupDocument(bot *tgbotapi.BotAPI, chatID int64) {
+	sendStyledMessage(bot, chatID, "🔄 *MEMBUAT BACKUP...*\n\n_Arsip akan dikirim ke chat ini._")
+
+	origin := originOf(chatID)
+	res, err := apiCall("POST", "/backup/archive", nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT BACKUP*\n\nError: "+err.Error())
 		return
 	}
+	followJob(bot, chatID, origin, "🔄 *MEMBUAT BACKUP...*", res, func(job map[string]interface{}, err error) {
+		if err == nil && job["status"] != "succeeded" {
+			err = fmt.Errorf("%v", job["error"])
+		}
+		if err != nil {
+			sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT BACKUP*\n\nError: "+err.Error())
+			return
+		}
+		jobID := fmt.Sprintf("%v", job["id"])
+		inBackground(func() error {
+			return sendArchive(bot, chatID, origin.base, jobID)
+		}, func(err error) {
+			if err != nil {
+				sendStyledMessage(bot, chatID, "❌ *GAGAL MENGIRIM BACKUP*\n\nError: "+err.Error())
+				return
+			}
+			// Drop the progress message unless the admin moved on meanwhile.
+			if id, ok := lastMessageIDs[chatID]; ok && origin.tracked && id == origin.msgID {
+				deleteLastMessage(bot, chatID)
+			}
+		})
+	})
+}
+
+// sendArchive downloads the archive of a finished archive job from base and
+// sends it to chatID as a document. It runs without botMu.
+func sendArchive(bot *tgbotapi.BotAPI, chatID int64, base, jobID string) error {
+	req, err := http.NewRequest("GET", base+"/backup/archive?job="+url.QueryEscape(jobID), nil)
+	if err != nil {
+		return err
+	}
+	if ApiKey != "" {
+		req.Header.Set("X-API-Key", ApiKey)
+	}
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var res map[string]interface{}
+		_ = json.Unmarshal(body, &res)
+		return fmt.Errorf("%v", res["message"])
+	}
+
+	name := "zivpn-backup.zip"
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+	created := resp.Header.Get("X-Backup-Created")
+	if t, err := time.Parse(time.RFC3339, created); err == nil {
+		created = t.Local().Format("02 Jan 2006 15:04")
+	}
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: name, Bytes: body})
+	doc.Caption = fmt.Sprintf("💾 *BACKUP ZIVPN*\n━━━━━━━━━━━━━━━━━━━━\n📄 `%s`\n👥 %s user\n🕒 %s\n━━━━━━━━━━━━━━━━━━━━\n_Balas file ini atau kirim ulang ke bot untuk restore._",
+		name, resp.Header.Get("X-Backup-Users"), created)
+	doc.ParseMode = "Markdown"
+	_, err = bot.Send(doc)
+	return err
+}
+
+func countList(v interface{}) int {
+	arr, _ := v.([]interface{})
+	return len(arr)
+}
+
+func previewRestore(bot *tgbotapi.BotAPI, chatID int64, opts map[string]string) {
+	sendStyledMessage(bot, chatID, "🔍 *MEMERIKSA BACKUP...*\n\n_Sedang membuat preview restore._")
 
+	startRestore(bot, chatID, opts, true, "🔍 *MEMERIKSA BACKUP...*", func(res map[string]interface{}, err error) {
+		if err != nil {
+			sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBACA BACKUP*\n\nError: "+err.Error())
+			return
+		}
+		if res["status"] != "succeeded" {
+			sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBACA BACKUP*\n\nPesan: "+fmt.Sprintf("%v", res["error"]))
+			return
+		}
+
+		data, _ := res["result"].(map[string]interface{})
+		users, _ := data["users"].(map[string]interface{})
+		files, _ := data["files"].([]interface{})
+
+		var b strings.Builder
+		b.WriteString("🔍 *PREVIEW RESTORE*\n")
+		b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+		b.WriteString(fmt.Sprintf("📁 **Backup ID**: `%s`\n", opts["backup_id"]))
+		b.WriteString(fmt.Sprintf("🧩 **Mode**: %s\n", restoreModeLabels[opts["mode"]]))
+		b.WriteString(fmt.Sprintf("🔀 **Strategi**: %s\n\n", restoreStrategyLabels[opts["strategy"]]))
+		b.WriteString("📄 *File:*\n")
+		for _, it := range files {
+			f, _ := it.(map[string]interface{})
+			b.WriteString(fmt.Sprintf("   • `%v` — %v\n", f["name"], f["action"]))
+		}
+		b.WriteString("\n👥 *User:*\n")
+		b.WriteString(fmt.Sprintf("   ➕ Ditambah: `%d`\n", countList(users["added"])))
+		b.WriteString(fmt.Sprintf("   ➖ Dihapus: `%d`\n", countList(users["removed"])))
+		b.WriteString(fmt.Sprintf("   ✏️ Berubah: `%d`\n", countList(users["changed"])))
+		b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+		b.WriteString("_Lanjutkan restore?_")
+
+		msg := tgbotapi.NewMessage(chatID, b.String())
+		msg.ParseMode = "Markdown"
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("✅ Restore", "restore_confirm"),
+				tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+			),
+		)
+		sendAndTrack(bot, msg)
+	})
+}
+
+func restoreBackup(bot *tgbotapi.BotAPI, chatID int64, opts map[string]string) {
 	sendStyledMessage(bot, chatID,
-		"❌ *GAGAL RESTORE*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+		fmt.Sprintf("🔄 *MEMPROSES RESTORE...*\n\nID Backup: `%s`", opts["backup_id"]))
+
+	startRestore(bot, chatID, opts, false, "🔄 *MEMPROSES RESTORE...*", func(res map[string]interface{}, err error) {
+		if err != nil {
+			sendStyledMessage(bot, chatID, "❌ *GAGAL RESTORE*\n\nError: "+err.Error())
+			return
+		}
+
+		if res["status"] == "succeeded" {
+			sendStyledMessage(bot, chatID,
+				"✅ *RESTORE BERHASIL*\n\n_Sistem berhasil direstore dari backup._")
+			return
+		}
+
+		msg := "❌ *GAGAL RESTORE*\n\nPesan: " + fmt.Sprintf("%v", res["error"])
+		if data, ok := res["result"].(map[string]interface{}); ok {
+			if rb, _ := data["rolled_back"].(bool); rb {
+				msg += "\n\n♻️ _Konfigurasi sebelumnya sudah dikembalikan._"
+			}
+		}
+		sendStyledMessage(bot, chatID, msg)
+	})
+}
+
+var jobStageLabels = map[string]string{
+	"archiving":   "Membuat arsip",
+	"encrypting":  "Enkripsi arsip",
+	"uploading":   "Upload ke storage",
+	"downloading": "Download backup",
+	"restoring":   "Menerapkan restore",
+	"applying":    "Menerapkan & cek service",
+}
+
+// jobOrigin is the API a job was started on and the message that shows its
+// progress. Both can change while the bot waits for the job.
+type jobOrigin struct {
+	base    string
+	msgID   int
+	tracked bool
+}
+
+func originOf(chatID int64) jobOrigin {
+	msgID, tracked := lastMessageIDs[chatID]
+	return jobOrigin{base: apiBase(), msgID: msgID, tracked: tracked}
+}
+
+// inBackground runs work, such as a large transfer, without blocking the
+// update loop. It must be called with botMu held; done runs with botMu
+// held again once work returned.
+func inBackground(work func() error, done func(error)) {
+	go func() {
+		err := work()
+		botMu.Lock()
+		defer botMu.Unlock()
+		done(err)
+	}()
+}
+
+// runJob follows the job started by an API call without blocking the update
+// loop. It must be called with botMu held; done runs later with botMu held
+// again, once the job finished or polling gave up.
+func runJob(bot *tgbotapi.BotAPI, chatID int64, title string, res map[string]interface{}, done func(map[string]interface{}, error)) {
+	followJob(bot, chatID, originOf(chatID), title, res, done)
+}
+
+// followJob is runJob for a job started on origin.
+func followJob(bot *tgbotapi.BotAPI, chatID int64, origin jobOrigin, title string, res map[string]interface{}, done func(map[string]interface{}, error)) {
+	if ok, _ := res["success"].(bool); !ok {
+		done(nil, fmt.Errorf("%v", res["message"]))
+		return
+	}
+	data, _ := res["data"].(map[string]interface{})
+	jobID, _ := data["job_id"].(string)
+	if jobID == "" {
+		done(nil, fmt.Errorf("API tidak mengembalikan job ID"))
+		return
+	}
+
+	var job map[string]interface{}
+	inBackground(func() (err error) {
+		job, err = waitJob(bot, chatID, origin, jobID, title)
+		return err
+	}, func(err error) {
+		done(job, err)
+	})
+}
+
+// waitJob polls a job on origin's API and edits origin's message with its
+// progress. It returns the finished job.
+func waitJob(bot *tgbotapi.BotAPI, chatID int64, origin jobOrigin, jobID, title string) (map[string]interface{}, error) {
+	last := ""
+	deadline := time.Now().Add(30 * time.Minute)
+	for time.Now().Before(deadline) {
+		r, err := apiRequest(origin.base, "GET", "/jobs/"+jobID, nil)
+		if err != nil {
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		job, _ := r["data"].(map[string]interface{})
+		if job == nil {
+			return nil, fmt.Errorf("%v", r["message"])
+		}
+		switch job["status"] {
+		case "succeeded", "failed", "interrupted":
+			if job["error"] == nil {
+				job["error"] = job["message"]
+			}
+			return job, nil
+		}
+
+		progress, _ := job["progress"].(float64)
+		stage, _ := job["stage"].(string)
+		if label, ok := jobStageLabels[stage]; ok {
+			stage = label
+		}
+		if stage == "" {
+			stage = "Menunggu antrean"
+		}
+		bar := strings.Repeat("█", int(progress)/10) + strings.Repeat("░", 10-int(progress)/10)
+		text := fmt.Sprintf("%s\n━━━━━━━━━━━━━━━━━━━━\n`%s` %d%%\n📌 *Tahap:* %s\n🆔 *Job:* `%s`", title, bar, int(progress), stage, jobID)
+		if origin.tracked && text != last {
+			edit := tgbotapi.NewEditMessageText(chatID, origin.msgID, text)
+			edit.ParseMode = "Markdown"
+			_, _ = bot.Request(edit)
+			last = text
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return nil, fmt.Errorf("job %s belum selesai, cek lagi nanti", jobID)
 }
 
 func formatBytes(size interface{}) string {
@@ -368,6 +938,19 @@ func formatBytes(size interface{}) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
+func formatUptime(sec int64) string {
+	d := sec / 86400
+	h := (sec % 86400) / 3600
+	m := (sec % 3600) / 60
+	if d > 0 {
+		return fmt.Sprintf("%d hari, %d jam, %d menit", d, h, m)
+	}
+	if h > 0 {
+		return fmt.Sprintf("%d jam, %d menit", h, m)
+	}
+	return fmt.Sprintf("%d menit", m)
+}
+
 func showBackupMenu(bot *tgbotapi.BotAPI, chatID int64) {
 	msg := tgbotapi.NewMessage(chatID, "💾 *BACKUP MANAGER*\n\n_Pilih opsi backup yang diinginkan:_")
 	msg.ParseMode = "Markdown"
@@ -380,6 +963,10 @@ func showBackupMenu(bot *tgbotapi.BotAPI, chatID int64) {
 			tgbotapi.NewInlineKeyboardButtonData("⏰ Auto Backup", "backup_auto"),
 			tgbotapi.NewInlineKeyboardButtonData("📋 List Backup", "backup_list"),
 		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📤 Kirim ke Telegram", "backup_telegram"),
+			tgbotapi.NewInlineKeyboardButtonData("🔐 Passphrase", "backup_pass"),
+		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("🏠 Menu Utama", "cancel"),
 		),
@@ -395,41 +982,110 @@ func toggleAutoBackup(bot *tgbotapi.BotAPI, chatID int64) {
 		return
 	}
 	if success, ok := res["success"].(bool); ok && success {
-		sendStyledMessage(bot, chatID, "✅ *AUTO BACKUP DIPERBARUI*")
+		data, _ := res["data"].(map[string]interface{})
+		status := "🔴 Nonaktif"
+		if on, _ := data["enabled"].(bool); on {
+			status = "🟢 Aktif"
+		}
+		text := fmt.Sprintf("✅ *AUTO BACKUP DIPERBARUI*\n━━━━━━━━━━━━━━━━━━━━\n📌 *Status:* %s\n🕒 *Jadwal:* `%v`\n", status, data["schedule"])
+		if ret, ok := data["retention"].(map[string]interface{}); ok {
+			text += fmt.Sprintf("🗂️ *Retensi:* %v harian, %v mingguan, %v bulanan\n", ret["daily"], ret["weekly"], ret["monthly"])
+		}
+		if next, ok := data["next_run"].(string); ok {
+			text += "⏭️ *Berikutnya:* " + formatBackupTime(next) + "\n"
+		}
+		if last, ok := data["last_run"].(string); ok {
+			text += "⏮️ *Terakhir:* " + formatBackupTime(last) + "\n"
+		}
+		if e, ok := data["last_error"].(string); ok {
+			text += "⚠️ *Error Terakhir:* " + e + "\n"
+		}
+		sendStyledMessage(bot, chatID, text)
 		return
 	}
 	sendStyledMessage(bot, chatID, "❌ *GAGAL MENGUBAH SETTING AUTO BACKUP*")
 }
 
-func showUserSelection(bot *tgbotapi.BotAPI, chatID int64, page int, action string) {
-	users, err := getUsers()
+func showBackupPassphrase(bot *tgbotapi.BotAPI, chatID int64) {
+	res, err := apiCall("GET", "/backup/encryption", nil)
 	if err != nil {
-		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL USER*\n\nError: "+err.Error())
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBACA ENKRIPSI BACKUP*\n\nError: "+err.Error())
 		return
 	}
-	if len(users) == 0 {
-		sendStyledMessage(bot, chatID, "📭 *TIDAK ADA USER*\n\n_Belum ada user yang terdaftar._")
+	data, _ := res["data"].(map[string]interface{})
+	if ok, _ := res["success"].(bool); !ok || data == nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBACA ENKRIPSI BACKUP*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
 		return
 	}
-	perPage := 8
-	totalPages := (len(users)+perPage-1)/perPage
-	if page < 1 {
-		page = 1
-	}
-	if page > totalPages {
-		page = totalPages
-	}
-	start := (page - 1) * perPage
-	end := start + perPage
-	if end > len(users) {
-		end = len(users)
+	pass, _ := data["passphrase"].(string)
+	if pass == "" {
+		pass = "_belum dibuat, dibuat otomatis saat backup pertama_"
+	} else {
+		pass = "`" + pass + "`"
 	}
-	var rows [][]tgbotapi.InlineKeyboardButton
-	for _, u := range users[start:end] {
-		pass := fmt.Sprintf("%v", u["password"])
-		exp := fmt.Sprintf("%v", u["expired"])
-		label := fmt.Sprintf("%s (%s)", pass, exp)
-		if len(label) > 34 {
+	text := fmt.Sprintf("🔐 *ENKRIPSI BACKUP*\n━━━━━━━━━━━━━━━━━━━━\n📌 *Mode:* `%v`\n🔑 *Passphrase:* %s\n━━━━━━━━━━━━━━━━━━━━\n_Simpan passphrase ini di luar server. Di VPS baru, isi passphrase server lama sebelum restore backup `.zip.enc`._", data["mode"], pass)
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Ganti Passphrase", "backup_pass_set"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Kembali", "menu_backup"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+func setBackupPassphrase(bot *tgbotapi.BotAPI, chatID int64, pass string) {
+	res, err := apiCall("POST", "/backup/encryption", map[string]string{"passphrase": pass})
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGGANTI PASSPHRASE*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); !ok {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGGANTI PASSPHRASE*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+		return
+	}
+	sendStyledMessage(bot, chatID, "✅ *PASSPHRASE DIPERBARUI*\n━━━━━━━━━━━━━━━━━━━━\nBackup berikutnya memakai passphrase baru, dan backup `.zip.enc` yang dibuat dengan passphrase ini sekarang bisa direstore.\n━━━━━━━━━━━━━━━━━━━━\n_Backup lama dengan passphrase sebelumnya perlu passphrase lama untuk direstore._")
+}
+
+func formatBackupTime(s string) string {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.Local().Format("02 Jan 2006 15:04")
+	}
+	return s
+}
+
+func showUserSelection(bot *tgbotapi.BotAPI, chatID int64, page int, action string) {
+	users, err := getUsers()
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL USER*\n\nError: "+err.Error())
+		return
+	}
+	if len(users) == 0 {
+		sendStyledMessage(bot, chatID, "📭 *TIDAK ADA USER*\n\n_Belum ada user yang terdaftar._")
+		return
+	}
+	perPage := 8
+	totalPages := (len(users)+perPage-1)/perPage
+	if page < 1 {
+		page = 1
+	}
+	if page > totalPages {
+		page = totalPages
+	}
+	start := (page - 1) * perPage
+	end := start + perPage
+	if end > len(users) {
+		end = len(users)
+	}
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, u := range users[start:end] {
+		pass := fmt.Sprintf("%v", u["password"])
+		exp := fmt.Sprintf("%v", u["expired"])
+		label := fmt.Sprintf("%s (%s)", pass, exp)
+		if len(label) > 34 {
 			label = label[:31] + "..."
 		}
 		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("select_%s:%s", action, pass))))
@@ -454,12 +1110,14 @@ func showUserSelection(bot *tgbotapi.BotAPI, chatID int64, page int, action stri
 func showMainMenu(bot *tgbotapi.BotAPI, chatID int64) {
 	ipInfo, _ := getIpInfo()
 	domain := "Unknown"
+	var lic map[string]interface{}
 	if res, err := apiCall("GET", "/info", nil); err == nil {
 		if s, ok := res["success"].(bool); ok && s {
 			if d, ok := res["data"].(map[string]interface{}); ok {
 				if dd, ok := d["domain"].(string); ok && dd != "" {
 					domain = dd
 				}
+				lic, _ = d["license"].(map[string]interface{})
 			}
 		}
 	}
@@ -467,11 +1125,21 @@ func showMainMenu(bot *tgbotapi.BotAPI, chatID int64) {
 	var b strings.Builder
 	b.WriteString("🚀 *ZIVPN CONTROL PANEL*\n")
 	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n\n")
-	b.WriteString(fmt.Sprintf("🌐 **Domain**: `%s`\n", domain))
-	if ipInfo.City != "" {
+	if activeServer == AllServers {
+		b.WriteString(fmt.Sprintf("🖥 **Server**: 🌐 Semua Server (%d)\n", len(listNodes())+1))
+	} else {
+		b.WriteString(fmt.Sprintf("🖥 **Server**: `%s`\n", serverLabel(activeServer)))
+		b.WriteString(fmt.Sprintf("🌐 **Domain**: `%s`\n", domain))
+	}
+	if ipInfo.City != "" && activeServer == "" {
 		b.WriteString(fmt.Sprintf("📍 **Lokasi**: %s\n", ipInfo.City))
 		b.WriteString(fmt.Sprintf("📡 **ISP**: %s\n", ipInfo.Isp))
 	}
+	if activeServer != AllServers {
+		if line := licenseLine(lic); line != "" {
+			b.WriteString(line + "\n")
+		}
+	}
 	b.WriteString("\n📌 _Pilih menu di bawah untuk melanjutkan:_")
 	
 	msg := tgbotapi.NewMessage(chatID, b.String())
@@ -488,14 +1156,43 @@ func showMainMenu(bot *tgbotapi.BotAPI, chatID int64) {
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("📋 List User", "menu_list"),
 			tgbotapi.NewInlineKeyboardButtonData("📊 Info System", "menu_info"),
+			tgbotapi.NewInlineKeyboardButtonData("👥 Online", "menu_online"),
 		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("💾 Backup", "menu_backup"),
+			tgbotapi.NewInlineKeyboardButtonData("⚙️ Server Settings", "menu_server"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🖥 Pilih Server", "menu_servers"),
 		),
 	)
 	sendAndTrack(bot, msg)
 }
 
+// licenseLine summarizes the "license" field of /api/info for the main
+// menu. Servers without a license source show nothing.
+func licenseLine(lic map[string]interface{}) string {
+	if lic == nil {
+		return ""
+	}
+	exp, _ := lic["expires"].(string)
+	grace, _ := lic["grace_until"].(string)
+	days, _ := lic["days_left"].(float64)
+	switch lic["state"] {
+	case "active":
+		return fmt.Sprintf("🔑 **Lisensi**: ✅ Aktif s/d %s (%d hari)", exp, int(days))
+	case "grace":
+		return fmt.Sprintf("🔑 **Lisensi**: ⚠️ Habis %s, masa tenggang s/d %s", exp, grace)
+	case "expired":
+		return fmt.Sprintf("🔑 **Lisensi**: ⛔ Berakhir %s, menu manajemen dikunci", exp)
+	case "unauthorized":
+		return fmt.Sprintf("🔑 **Lisensi**: ⛔ IP `%v` tidak terdaftar", lic["ip"])
+	case "unknown":
+		return "🔑 **Lisensi**: ❔ Belum bisa dicek"
+	}
+	return ""
+}
+
 func sendStyledMessage(bot *tgbotapi.BotAPI, chatID int64, text string) {
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = "Markdown"
@@ -532,7 +1229,26 @@ func sendAndTrack(bot *tgbotapi.BotAPI, msg tgbotapi.MessageConfig) {
 	lastMessageIDs[msg.ChatID] = sent.MessageID
 }
 
+// apiBase is the API prefix for the active server. Other nodes are reached
+// through the local API's /nodes proxy, which adds their keys.
+func apiBase() string {
+	if activeServer == "" || activeServer == AllServers {
+		return ApiUrl
+	}
+	return ApiUrl + "/nodes/" + activeServer
+}
+
+// apiCall calls the active server.
 func apiCall(method, endpoint string, payload interface{}) (map[string]interface{}, error) {
+	return apiRequest(apiBase(), method, endpoint, payload)
+}
+
+// localApiCall calls this server's API regardless of the active server.
+func localApiCall(method, endpoint string, payload interface{}) (map[string]interface{}, error) {
+	return apiRequest(ApiUrl, method, endpoint, payload)
+}
+
+func apiRequest(base, method, endpoint string, payload interface{}) (map[string]interface{}, error) {
 	var body []byte
 	var err error
 	if payload != nil {
@@ -542,7 +1258,7 @@ func apiCall(method, endpoint string, payload interface{}) (map[string]interface
 		}
 	}
 	client := &http.Client{Timeout: 30 * time.Second}
-	req, err := http.NewRequest(method, ApiUrl+endpoint, bytes.NewBuffer(body))
+	req, err := http.NewRequest(method, base+endpoint, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -597,6 +1313,10 @@ func getUsers() ([]map[string]interface{}, error) {
 }
 
 func listUsers(bot *tgbotapi.BotAPI, chatID int64) {
+	if activeServer == AllServers {
+		listClusterUsers(bot, chatID)
+		return
+	}
 	users, err := getUsers()
 	if err != nil {
 		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL USER*\n\nError: "+err.Error())
@@ -636,7 +1356,11 @@ func listUsers(bot *tgbotapi.BotAPI, chatID int64) {
 	sendAndTrack(bot, msg)
 }
 
-func createUser(bot *tgbotapi.BotAPI, chatID int64, username string, days int) {
+func createUser(bot *tgbotapi.BotAPI, chatID, uid int64, username string, days int) {
+	if activeServer == AllServers {
+		createUserOnAll(bot, chatID, username, days, nil)
+		return
+	}
 	res, err := apiCall("POST", "/user/create", map[string]interface{}{
 		"password": username,
 		"days":     days,
@@ -655,23 +1379,22 @@ func createUser(bot *tgbotapi.BotAPI, chatID int64, username string, days int) {
 			domain = "Unknown"
 		}
 
-		msg := fmt.Sprintf(
-			"✅ *AKUN BERHASIL DIBUAT*\n"+
-				"━━━━━━━━━━━━━━━━━━━━\n"+
-				"👤 **Username**\n`%v`\n\n"+
-				"🔑 **Password**\n`%v`\n\n"+
-				"🌐 **Domain**\n`%s`\n\n"+
-				"📅 **Expired**\n`%v`\n"+
-				"━━━━━━━━━━━━━━━━━━━━\n"+
-				"_Simpan informasi akun dengan baik._",
-			data["password"],
-			data["password"],
-			domain,
-			data["expired"],
-		)
+		data["domain"] = domain
+		msg := accountCard("✅ *AKUN BERHASIL DIBUAT*", data, "", "_Simpan informasi akun dengan baik._")
 
 		reply := tgbotapi.NewMessage(chatID, msg)
 		reply.ParseMode = "Markdown"
+		if len(listNodes()) > 0 {
+			// Callback data is capped at 64 bytes, so the button carries a
+			// short token and the account stays in tempUserData.
+			token := strconv.Itoa(100000 + rand.Intn(900000))
+			tempUserData[uid] = map[string]string{"create_all": token, "username": username, "days": strconv.Itoa(days)}
+			reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonData("🌐 Buat di Semua Server", "create_all:"+token),
+				),
+			)
+		}
 		bot.Send(reply)
 
 		return
@@ -680,6 +1403,32 @@ func createUser(bot *tgbotapi.BotAPI, chatID int64, username string, days int) {
 	sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT AKUN*: "+fmt.Sprintf("%v", res["message"]))
 }
 
+// accountCard renders the account details a customer needs. extra is
+// inserted before the expiry date; obfs and port are shown when the API
+// returns them, including a pending obfs rotation.
+func accountCard(title string, data map[string]interface{}, extra, footer string) string {
+	var b strings.Builder
+	b.WriteString(title + "\n")
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	b.WriteString(fmt.Sprintf("👤 **Username**\n`%v`\n\n", data["password"]))
+	b.WriteString(fmt.Sprintf("🔑 **Password**\n`%v`\n\n", data["password"]))
+	b.WriteString(fmt.Sprintf("🌐 **Domain**\n`%v`\n\n", data["domain"]))
+	if v, ok := data["obfs"].(string); ok && v != "" {
+		b.WriteString(fmt.Sprintf("🕶 **Obfs**\n`%s`\n\n", v))
+	}
+	if v, ok := data["next_obfs"].(string); ok && v != "" {
+		b.WriteString(fmt.Sprintf("🆕 **Obfs Baru** (mulai %s)\n`%s`\n\n", formatBackupTime(fmt.Sprintf("%v", data["switch_at"])), v))
+	}
+	if v, ok := data["port"].(string); ok && v != "" {
+		b.WriteString(fmt.Sprintf("🔌 **Port UDP**\n`%s`\n\n", v))
+	}
+	b.WriteString(extra)
+	b.WriteString(fmt.Sprintf("📅 **Expired**\n`%v`\n", data["expired"]))
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	b.WriteString(footer)
+	return b.String()
+}
+
 func deleteUser(bot *tgbotapi.BotAPI, chatID int64, username string) {
 	sendStyledMessage(bot, chatID, "🗑 *MENGHAPUS AKUN...*\n\nUsername: `"+username+"`")
 	res, err := apiCall("POST", "/user/delete", map[string]interface{}{"password": username})
@@ -732,6 +1481,10 @@ func renewUser(bot *tgbotapi.BotAPI, chatID int64, username string, days int) {
 }
 
 func systemInfo(bot *tgbotapi.BotAPI, chatID int64) {
+	if activeServer == AllServers {
+		clusterInfo(bot, chatID)
+		return
+	}
 	res, err := apiCall("GET", "/info", nil)
 	if err != nil {
 		sendStyledMessage(bot, chatID, "❌ Gagal mengambil info: "+err.Error())
@@ -740,6 +1493,18 @@ func systemInfo(bot *tgbotapi.BotAPI, chatID int64) {
 
 	data := res["data"].(map[string]interface{})
 	get := func(k string) string { return strings.TrimSpace(fmt.Sprintf("%v", data[k])) }
+	sub := func(k string) map[string]interface{} {
+		m, _ := data[k].(map[string]interface{})
+		return m
+	}
+	mem, disk, load := sub("memory"), sub("disk"), sub("load")
+	ram := fmt.Sprintf("%s / %s (%v%%)", formatBytes(mem["used"]), formatBytes(mem["total"]), mem["percent"])
+	diskStr := fmt.Sprintf("%s / %s (%v%%)", formatBytes(disk["used"]), formatBytes(disk["total"]), disk["percent"])
+	loadStr := fmt.Sprintf("%v, %v, %v", load["load1"], load["load5"], load["load15"])
+	uptime := "Unknown"
+	if sec, ok := data["uptime_seconds"].(float64); ok {
+		uptime = formatUptime(int64(sec))
+	}
 
 	var b strings.Builder
 	b.WriteString("*🖥️ VPS INFORMATION*\n")
@@ -750,9 +1515,10 @@ func systemInfo(bot *tgbotapi.BotAPI, chatID int64) {
 	b.WriteString(fmt.Sprintf("🧬 *Kernel*     : `%s`\n", get("kernel")))
 	b.WriteString(fmt.Sprintf("💠 *CPU*        : `%s`\n", get("cpu")))
 	b.WriteString(fmt.Sprintf("⚙️ *Cores*      : `%s`\n", get("cores")))
-	b.WriteString(fmt.Sprintf("📦 *RAM*        : `%s`\n", get("ram")))
-	b.WriteString(fmt.Sprintf("💽 *Disk*       : `%s`\n", get("disk")))
-	b.WriteString(fmt.Sprintf("⏱ *Uptime*     : `%s`\n", get("uptime")))
+	b.WriteString(fmt.Sprintf("📦 *RAM*        : `%s`\n", ram))
+	b.WriteString(fmt.Sprintf("💽 *Disk*       : `%s`\n", diskStr))
+	b.WriteString(fmt.Sprintf("📈 *Load*       : `%s`\n", loadStr))
+	b.WriteString(fmt.Sprintf("⏱ *Uptime*     : `%s`\n", uptime))
 	b.WriteString(fmt.Sprintf("🛰 *Service*    : `%s`\n", get("service")))
 	b.WriteString(fmt.Sprintf("👥 *Active Users* : `%s`\n", get("user_count")))
 	b.WriteString(fmt.Sprintf("🗂 *Backups*    : `%s`\n", get("backup_count")))
@@ -779,4 +1545,738 @@ func loadConfig() (BotConfig, error) {
 		return cfg, err
 	}
 	return cfg, nil
-}
\ No newline at end of file
+}
+
+func showOnline(bot *tgbotapi.BotAPI, chatID int64) {
+	res, err := apiCall("GET", "/online", nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL DATA ONLINE*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); !ok {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL DATA ONLINE*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+		return
+	}
+
+	data, _ := res["data"].(map[string]interface{})
+	sessions, _ := data["sessions"].([]interface{})
+
+	var b strings.Builder
+	b.WriteString("👥 *USER ONLINE*\n")
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n\n")
+	if len(sessions) == 0 {
+		b.WriteString("_Tidak ada sesi aktif saat ini._\n")
+	}
+	for i, it := range sessions {
+		m, _ := it.(map[string]interface{})
+		account := fmt.Sprintf("%v", m["account"])
+		if account == "" || account == "<nil>" {
+			account = "?"
+		}
+		since := fmt.Sprintf("%v", m["first_seen"])
+		if t, err := time.Parse(time.RFC3339Nano, since); err == nil {
+			since = t.Format("02 Jan 15:04")
+		}
+		b.WriteString(fmt.Sprintf(
+			"**%d.** 🟢 `%s`\n"+
+				"   ├─ 🌍 *IP:* `%v`\n"+
+				"   ├─ ⏱ *Sejak:* `%s`\n"+
+				"   └─ 📶 *Traffic:* `⬇ %s / ⬆ %s`\n\n",
+			i+1, account, m["client_ip"], since, formatBytes(m["rx_bytes"]), formatBytes(m["tx_bytes"]),
+		))
+	}
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	b.WriteString(fmt.Sprintf("📡 *Total:* `%v` IP, `%v` akun", data["clients"], data["accounts"]))
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, it := range sessions {
+		if i >= 10 {
+			break
+		}
+		m, _ := it.(map[string]interface{})
+		ip := fmt.Sprintf("%v", m["client_ip"])
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⛔ Kick "+ip, "kick:"+ip),
+		))
+	}
+	rows = append(rows,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Refresh", "menu_online"),
+			tgbotapi.NewInlineKeyboardButtonData("🚫 Ban List", "menu_bans"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Kembali", "cancel"),
+		),
+	)
+
+	m := tgbotapi.NewMessage(chatID, b.String())
+	m.ParseMode = "Markdown"
+	m.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, m)
+}
+
+func kickSession(bot *tgbotapi.BotAPI, chatID int64, ip string) {
+	res, err := apiCall("POST", "/session/kick", map[string]interface{}{
+		"ip":     ip,
+		"reason": "kicked via bot",
+	})
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL KICK*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); ok {
+		sendStyledMessage(bot, chatID, fmt.Sprintf("⛔ *SESI DIPUTUS*\n\nIP `%s` diblokir sementara.", ip))
+		showBans(bot, chatID)
+		return
+	}
+	sendStyledMessage(bot, chatID, "❌ *GAGAL KICK*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+}
+
+func unbanIP(bot *tgbotapi.BotAPI, chatID int64, ip string) {
+	res, err := apiCall("POST", "/session/unban", map[string]interface{}{"ip": ip})
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL UNBAN*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); !ok {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL UNBAN*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+		return
+	}
+	showBans(bot, chatID)
+}
+
+func showBans(bot *tgbotapi.BotAPI, chatID int64) {
+	res, err := apiCall("GET", "/session/bans", nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL BAN LIST*\n\nError: "+err.Error())
+		return
+	}
+	arr, _ := res["data"].([]interface{})
+
+	var b strings.Builder
+	b.WriteString("🚫 *DAFTAR IP DIBLOKIR*\n")
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n\n")
+	if len(arr) == 0 {
+		b.WriteString("_Tidak ada IP yang diblokir._\n")
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, it := range arr {
+		m, _ := it.(map[string]interface{})
+		ip := fmt.Sprintf("%v", m["ip"])
+		until := fmt.Sprintf("%v", m["expires"])
+		if t, err := time.Parse(time.RFC3339Nano, until); err == nil {
+			until = t.Format("02 Jan 15:04")
+		}
+		b.WriteString(fmt.Sprintf("**%d.** `%s`\n   └─ ⏰ *Sampai:* `%s`\n\n", i+1, ip, until))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Unban "+ip, "unban:"+ip),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("👥 Online", "menu_online"),
+		tgbotapi.NewInlineKeyboardButtonData("🔙 Kembali", "cancel"),
+	))
+
+	m := tgbotapi.NewMessage(chatID, b.String())
+	m.ParseMode = "Markdown"
+	m.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, m)
+}
+
+func showErrorLogs(bot *tgbotapi.BotAPI, chatID int64, n int) {
+	if n > 50 {
+		n = 50
+	}
+	res, err := apiCall("GET", fmt.Sprintf("/logs?level=error&limit=%d", n), nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL LOG*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); !ok {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL LOG*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+		return
+	}
+	arr, _ := res["data"].([]interface{})
+	if len(arr) == 0 {
+		sendStyledMessage(bot, chatID, "✅ *TIDAK ADA ERROR*\n\n_Belum ada log error dari core ZiVPN._")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("📜 *%d LOG ERROR TERAKHIR*\n", len(arr)))
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n\n")
+	for _, it := range arr {
+		m, _ := it.(map[string]interface{})
+		at := fmt.Sprintf("%v", m["time"])
+		if t, err := time.Parse(time.RFC3339Nano, at); err == nil {
+			at = t.Local().Format("02 Jan 15:04:05")
+		}
+		line := fmt.Sprintf("%v", m["message"])
+		if ip, ok := m["client_ip"].(string); ok && ip != "" {
+			line += " (" + ip + ")"
+		}
+		line = strings.ReplaceAll(line, "`", "'")
+		b.WriteString(fmt.Sprintf("🕒 `%s`\n`%s`\n\n", at, line))
+	}
+
+	m := tgbotapi.NewMessage(chatID, b.String())
+	m.ParseMode = "Markdown"
+	m.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Kembali ke Menu", "cancel"),
+		),
+	)
+	sendAndTrack(bot, m)
+}
+
+var serverFieldPrompts = map[string]string{
+	"listen": "🔌 *UBAH PORT LISTEN*\n\nMasukkan port baru (contoh: `5667`) atau `IP:port`:",
+	"obfs":   "🕶 *UBAH OBFS*\n\nMasukkan obfs baru (1-64 karakter, tanpa spasi/tanda kutip):",
+	"cert":   "📜 *UBAH SERTIFIKAT*\n\nMasukkan path sertifikat dan private key dipisah spasi:\n`/etc/zivpn/zivpn.crt /etc/zivpn/zivpn.key`",
+}
+
+func showServerSettings(bot *tgbotapi.BotAPI, chatID int64) {
+	res, err := apiCall("GET", "/server/config", nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBACA CONFIG*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); !ok {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBACA CONFIG*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+		return
+	}
+	data, _ := res["data"].(map[string]interface{})
+
+	var b strings.Builder
+	b.WriteString("⚙️ *SERVER SETTINGS*\n")
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	b.WriteString(fmt.Sprintf("🔌 **Listen**: `%v`\n", data["listen"]))
+	b.WriteString(fmt.Sprintf("🕶 **Obfs**: `%v`\n", data["obfs"]))
+	b.WriteString(fmt.Sprintf("📜 **Cert**: `%v`\n", data["cert"]))
+	b.WriteString(fmt.Sprintf("🔑 **Key**: `%v`\n", data["key"]))
+	b.WriteString(fmt.Sprintf("👥 **Auth**: `%v`\n", data["auth_mode"]))
+	if ores, err := apiCall("GET", "/server/obfs/rotate", nil); err == nil {
+		if od, ok := ores["data"].(map[string]interface{}); ok {
+			if p, ok := od["pending"].(map[string]interface{}); ok {
+				b.WriteString(fmt.Sprintf("🕐 **Obfs baru**: `%v` mulai %s\n", p["obfs"], formatBackupTime(fmt.Sprintf("%v", p["at"]))))
+			}
+		}
+	}
+	if cres, err := apiCall("GET", "/server/cert", nil); err == nil {
+		if cert, ok := cres["data"].(map[string]interface{}); ok && cert["not_after"] != nil {
+			b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+			b.WriteString(certSummary(cert))
+		}
+	}
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	b.WriteString("_Perubahan dicek dulu, lalu service direstart. Jika gagal, setting lama dikembalikan otomatis._")
+
+	msg := tgbotapi.NewMessage(chatID, b.String())
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔌 Listen", "server_edit:listen"),
+			tgbotapi.NewInlineKeyboardButtonData("🕶 Obfs", "server_edit:obfs"),
+			tgbotapi.NewInlineKeyboardButtonData("📜 Sertifikat", "server_edit:cert"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Rotasi Obfs", "obfs_rotate"),
+			tgbotapi.NewInlineKeyboardButtonData("📇 Kartu Akun", "obfs_cards"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🏠 Menu Utama", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+// certSummary formats the /api/server/cert fields shown in Server Settings.
+func certSummary(cert map[string]interface{}) string {
+	var b strings.Builder
+	days, _ := cert["days_left"].(float64)
+	status := "✅"
+	switch {
+	case cert["expired"] == true:
+		status = "🚨 EXPIRED"
+	case days <= 14:
+		status = "⚠️"
+	}
+	b.WriteString(fmt.Sprintf("🔐 **Sertifikat**: %s `%v` hari lagi\n", status, days))
+	b.WriteString(fmt.Sprintf("🏷 **Subject**: `%v`\n", cert["subject"]))
+	if cert["self_signed"] == true {
+		b.WriteString("🏢 **Issuer**: self-signed\n")
+	} else {
+		b.WriteString(fmt.Sprintf("🏢 **Issuer**: `%v`\n", cert["issuer"]))
+	}
+	if cert["key_match"] != true {
+		b.WriteString("❌ **Key tidak cocok dengan sertifikat**\n")
+	}
+	if cert["domain_match"] != true {
+		b.WriteString("⚠️ **Domain tidak tercakup sertifikat**\n")
+	}
+	return b.String()
+}
+
+func serverPatch(opts map[string]string, dryRun bool) map[string]interface{} {
+	p := map[string]interface{}{"dry_run": dryRun}
+	v := strings.TrimSpace(opts["value"])
+	switch opts["field"] {
+	case "listen":
+		if _, err := strconv.Atoi(v); err == nil {
+			v = ":" + v
+		}
+		p["listen"] = v
+	case "obfs":
+		p["obfs"] = v
+	case "cert":
+		f := strings.Fields(v)
+		if len(f) > 0 {
+			p["cert"] = f[0]
+		}
+		if len(f) > 1 {
+			p["key"] = f[1]
+		}
+	}
+	return p
+}
+
+func previewServerSetting(bot *tgbotapi.BotAPI, chatID int64, opts map[string]string) {
+	res, err := apiCall("PATCH", "/server/config", serverPatch(opts, true))
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMERIKSA SETTING*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); !ok {
+		sendStyledMessage(bot, chatID, "❌ *SETTING TIDAK VALID*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+		return
+	}
+	data, _ := res["data"].(map[string]interface{})
+	changes, _ := data["changes"].([]interface{})
+	if len(changes) == 0 {
+		sendStyledMessage(bot, chatID, "ℹ️ *TIDAK ADA PERUBAHAN*\n\n_Setting sama dengan yang sekarang._")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("🔍 *PREVIEW PERUBAHAN*\n")
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	for _, it := range changes {
+		c, _ := it.(map[string]interface{})
+		b.WriteString(fmt.Sprintf("• *%v*\n   `%v` ➜ `%v`\n", c["field"], c["old"], c["new"]))
+	}
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	b.WriteString("_Service zivpn akan direstart. Terapkan?_")
+
+	msg := tgbotapi.NewMessage(chatID, b.String())
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Terapkan", "server_apply"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+func applyServerSetting(bot *tgbotapi.BotAPI, chatID int64, opts map[string]string) {
+	sendStyledMessage(bot, chatID, "⚙️ *MENERAPKAN SETTING...*")
+	res, err := apiCall("PATCH", "/server/config", serverPatch(opts, false))
+	finish := func(res map[string]interface{}, err error) {
+		if err != nil {
+			sendStyledMessage(bot, chatID, "❌ *GAGAL MENERAPKAN SETTING*\n\nError: "+err.Error())
+			return
+		}
+		if res["status"] == "succeeded" {
+			sendStyledMessage(bot, chatID, "✅ *SETTING DITERAPKAN*\n\n_Service zivpn berjalan normal dengan setting baru._")
+			return
+		}
+		msg := "❌ *GAGAL MENERAPKAN SETTING*\n\nPesan: " + fmt.Sprintf("%v", res["error"])
+		if data, ok := res["result"].(map[string]interface{}); ok {
+			if rb, _ := data["rolled_back"].(bool); rb {
+				msg += "\n\n♻️ _Setting sebelumnya sudah dikembalikan._"
+			}
+		}
+		sendStyledMessage(bot, chatID, msg)
+	}
+	if err != nil {
+		finish(nil, err)
+		return
+	}
+	runJob(bot, chatID, "⚙️ *MENERAPKAN SETTING...*", res, finish)
+}
+
+func showObfsRotate(bot *tgbotapi.BotAPI, chatID int64) {
+	msg := tgbotapi.NewMessage(chatID, "🔄 *ROTASI OBFS*\n━━━━━━━━━━━━━━━━━━━━\nObfs baru dibuat acak. Client dengan obfs lama tidak bisa terhubung setelah pergantian.\n\n_Jadwalkan ke depan agar ada waktu mengirim kartu akun baru ke pelanggan._")
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⚡ Sekarang", "obfs_rotate:0"),
+			tgbotapi.NewInlineKeyboardButtonData("🕐 1 Jam", "obfs_rotate:1"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🌙 24 Jam", "obfs_rotate:24"),
+			tgbotapi.NewInlineKeyboardButtonData("📅 3 Hari", "obfs_rotate:72"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+// rotateObfs switches now when hours is 0, otherwise schedules the switch.
+// The API notifies the admin chat with a button for the new account cards.
+func rotateObfs(bot *tgbotapi.BotAPI, chatID int64, hours int) {
+	payload := map[string]interface{}{}
+	if hours > 0 {
+		payload["at"] = time.Now().Add(time.Duration(hours) * time.Hour).Format(time.RFC3339)
+	}
+	sendStyledMessage(bot, chatID, "🔄 *MENGGANTI OBFS...*")
+	res, err := apiCall("POST", "/server/obfs/rotate", payload)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *ROTASI OBFS GAGAL*\n\nError: "+err.Error())
+		return
+	}
+	if hours > 0 {
+		if ok, _ := res["success"].(bool); !ok {
+			sendStyledMessage(bot, chatID, "❌ *ROTASI OBFS GAGAL*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+			return
+		}
+		deleteLastMessage(bot, chatID)
+		return
+	}
+	runJob(bot, chatID, "🔄 *MENGGANTI OBFS...*", res, func(job map[string]interface{}, err error) {
+		if err != nil {
+			sendStyledMessage(bot, chatID, "❌ *ROTASI OBFS GAGAL*\n\nError: "+err.Error())
+			return
+		}
+		if job["status"] != "succeeded" {
+			sendStyledMessage(bot, chatID, "❌ *ROTASI OBFS GAGAL*\n\nPesan: "+fmt.Sprintf("%v", job["error"]))
+			return
+		}
+		deleteLastMessage(bot, chatID)
+	})
+}
+
+func cancelObfsRotation(bot *tgbotapi.BotAPI, chatID int64) {
+	res, err := apiCall("DELETE", "/server/obfs/rotate", nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBATALKAN*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); !ok {
+		sendStyledMessage(bot, chatID, "ℹ️ *TIDAK ADA ROTASI TERJADWAL*")
+	}
+}
+
+// sendAccountCards sends one card per active account, or a text file when
+// there are too many for individual messages.
+func sendAccountCards(bot *tgbotapi.BotAPI, chatID int64) {
+	res, err := apiCall("GET", "/users/cards", nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT KARTU AKUN*\n\nError: "+err.Error())
+		return
+	}
+	cards, _ := res["data"].([]interface{})
+	if len(cards) == 0 {
+		sendStyledMessage(bot, chatID, "ℹ️ *TIDAK ADA AKUN AKTIF*")
+		return
+	}
+
+	if len(cards) <= 10 {
+		for _, it := range cards {
+			c, _ := it.(map[string]interface{})
+			msg := tgbotapi.NewMessage(chatID, accountCard("📇 *KARTU AKUN*", c, "", "_Teruskan pesan ini ke pelanggan._"))
+			msg.ParseMode = "Markdown"
+			bot.Send(msg)
+		}
+		return
+	}
+
+	var b strings.Builder
+	for _, it := range cards {
+		c, _ := it.(map[string]interface{})
+		b.WriteString(fmt.Sprintf("Username : %v\nPassword : %v\nDomain   : %v\nObfs     : %v\n", c["password"], c["password"], c["domain"], c["obfs"]))
+		if v, ok := c["next_obfs"].(string); ok && v != "" {
+			b.WriteString(fmt.Sprintf("Obfs baru: %s (mulai %s)\n", v, formatBackupTime(fmt.Sprintf("%v", c["switch_at"]))))
+		}
+		b.WriteString(fmt.Sprintf("Port UDP : %v\nExpired  : %v\n\n", c["port"], c["expired"]))
+	}
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: "kartu-akun.txt", Bytes: []byte(b.String())})
+	doc.Caption = fmt.Sprintf("📇 *KARTU AKUN*\n\n%d akun aktif.", len(cards))
+	doc.ParseMode = "Markdown"
+	if _, err := bot.Send(doc); err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGIRIM KARTU AKUN*\n\nError: "+err.Error())
+	}
+}
+
+// listNodes returns the servers registered on this API.
+func listNodes() []map[string]interface{} {
+	var out []map[string]interface{}
+	res, err := localApiCall("GET", "/nodes", nil)
+	if err != nil {
+		return out
+	}
+	list, _ := res["data"].([]interface{})
+	for _, it := range list {
+		if n, ok := it.(map[string]interface{}); ok {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func serverName(name string) string {
+	if name == "" {
+		return "local"
+	}
+	return name
+}
+
+func serverLabel(name string) string {
+	if name == "" {
+		return "local (server ini)"
+	}
+	return name
+}
+
+// allServersAction reports whether a callback works in the aggregated
+// view; everything else needs a single server.
+func allServersAction(data string) bool {
+	switch data {
+	case "menu_create", "menu_list", "menu_info", "menu_servers", "cancel":
+		return true
+	}
+	return strings.HasPrefix(data, "srv_")
+}
+
+func sendServerRequired(bot *tgbotapi.BotAPI, chatID int64) {
+	showServerPicker(bot, chatID, "⚠️ _Menu tersebut hanya untuk satu server. Pilih server dulu._\n\n")
+}
+
+func showServerPicker(bot *tgbotapi.BotAPI, chatID int64, note string) {
+	nodes := listNodes()
+	mark := func(name string) string {
+		if activeServer == name {
+			return "✅ "
+		}
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("🖥 *PILIH SERVER*\n")
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	b.WriteString(note)
+	b.WriteString(fmt.Sprintf("Server terdaftar: *%d* + server ini\n\n", len(nodes)))
+	b.WriteString("_Semua menu berikutnya dijalankan di server yang dipilih. 🌐 Semua Server menampilkan gabungan user & info dan membuat akun di semua server._")
+
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(mark("")+"🏠 local (server ini)", "srv_pick:local")),
+	}
+	for _, n := range nodes {
+		name := fmt.Sprintf("%v", n["name"])
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(mark(name)+"🖥 "+name, "srv_pick:"+name)))
+	}
+	if len(nodes) > 0 {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(mark(AllServers)+"🌐 Semua Server", "srv_pick:"+AllServers)))
+	}
+	manage := tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("➕ Tambah Server", "srv_add"))
+	if len(nodes) > 0 {
+		manage = append(manage, tgbotapi.NewInlineKeyboardButtonData("🗑 Hapus Server", "srv_remove"))
+	}
+	rows = append(rows, manage, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🔙 Kembali", "cancel")))
+
+	msg := tgbotapi.NewMessage(chatID, b.String())
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, msg)
+}
+
+func addNode(bot *tgbotapi.BotAPI, chatID int64, name, url, key string) {
+	sendStyledMessage(bot, chatID, "🔄 *MENGHUBUNGI SERVER...*")
+	res, err := localApiCall("POST", "/nodes", map[string]interface{}{"name": name, "url": url, "key": key})
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENAMBAH SERVER*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); !ok {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENAMBAH SERVER*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+		return
+	}
+	domain := ""
+	if data, ok := res["data"].(map[string]interface{}); ok {
+		if info, ok := data["info"].(map[string]interface{}); ok {
+			domain = fmt.Sprintf("%v", info["domain"])
+		}
+	}
+	sendStyledMessage(bot, chatID, fmt.Sprintf("✅ *SERVER DITAMBAHKAN*\n━━━━━━━━━━━━━━━━━━━━\n🖥 **Nama**: `%s`\n🌐 **Domain**: `%s`\n━━━━━━━━━━━━━━━━━━━━\n_Pilih server ini lewat 🖥 Pilih Server._", name, domain))
+}
+
+func showNodeRemoval(bot *tgbotapi.BotAPI, chatID int64) {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, n := range listNodes() {
+		name := fmt.Sprintf("%v", n["name"])
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🗑 "+name, "srv_del:"+name)))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🔙 Kembali", "menu_servers")))
+	msg := tgbotapi.NewMessage(chatID, "🗑 *HAPUS SERVER*\n\n_Server hanya dihapus dari daftar. Akun dan data di server tersebut tidak diubah._")
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, msg)
+}
+
+func removeNode(bot *tgbotapi.BotAPI, chatID int64, name string) {
+	res, err := localApiCall("DELETE", "/nodes?name="+name, nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGHAPUS SERVER*\n\nError: "+err.Error())
+		return
+	}
+	if ok, _ := res["success"].(bool); !ok {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGHAPUS SERVER*\n\nPesan: "+fmt.Sprintf("%v", res["message"]))
+		return
+	}
+	if activeServer == name || (activeServer == AllServers && len(listNodes()) == 0) {
+		activeServer = ""
+	}
+	showServerPicker(bot, chatID, "")
+}
+
+// nodeResults returns the per-node entries of a /cluster response.
+func nodeResults(v interface{}) []map[string]interface{} {
+	var out []map[string]interface{}
+	list, _ := v.([]interface{})
+	for _, it := range list {
+		if m, ok := it.(map[string]interface{}); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func listClusterUsers(bot *tgbotapi.BotAPI, chatID int64) {
+	res, err := localApiCall("GET", "/cluster/users", nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MENGAMBIL USER*\n\nError: "+err.Error())
+		return
+	}
+	data, _ := res["data"].(map[string]interface{})
+
+	var b strings.Builder
+	b.WriteString("📋 *DAFTAR USER SEMUA SERVER*\n")
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	for _, nr := range nodeResults(data["nodes"]) {
+		b.WriteString(fmt.Sprintf("\n🖥 *%v*\n", nr["node"]))
+		if ok, _ := nr["success"].(bool); !ok {
+			b.WriteString(fmt.Sprintf("   ⚠️ _%v_\n", nr["message"]))
+			continue
+		}
+		users := nodeResults(nr["data"])
+		if len(users) == 0 {
+			b.WriteString("   _Tidak ada user_\n")
+		}
+		for _, u := range users {
+			icon := "🟢"
+			if u["status"] == "Expired" {
+				icon = "🔴"
+			}
+			b.WriteString(fmt.Sprintf("   %s `%v` └ 📅 `%v`\n", icon, u["password"], u["expired"]))
+		}
+	}
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	b.WriteString(fmt.Sprintf("👥 Total: *%v* user", data["total"]))
+
+	msg := tgbotapi.NewMessage(chatID, b.String())
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Kembali ke Menu", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+func clusterInfo(bot *tgbotapi.BotAPI, chatID int64) {
+	res, err := localApiCall("GET", "/cluster/info", nil)
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ Gagal mengambil info: "+err.Error())
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("*🌐 INFO SEMUA SERVER*\n")
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	for _, nr := range nodeResults(res["data"]) {
+		b.WriteString(fmt.Sprintf("\n🖥 *%v*\n", nr["node"]))
+		d, ok := nr["data"].(map[string]interface{})
+		if success, _ := nr["success"].(bool); !success || !ok {
+			b.WriteString(fmt.Sprintf("   🔴 _%v_\n", nr["message"]))
+			continue
+		}
+		mem, _ := d["memory"].(map[string]interface{})
+		load, _ := d["load"].(map[string]interface{})
+		b.WriteString(fmt.Sprintf("   🔗 `%v` (`%v`)\n", d["domain"], d["public_ip"]))
+		b.WriteString(fmt.Sprintf("   🛰 `%v` · 👥 `%v` user\n", d["service"], d["user_count"]))
+		b.WriteString(fmt.Sprintf("   📦 RAM `%v%%` · 📈 Load `%v`\n", mem["percent"], load["load1"]))
+	}
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━\n")
+	b.WriteString(fmt.Sprintf("_%v_", res["message"]))
+
+	m := tgbotapi.NewMessage(chatID, b.String())
+	m.ParseMode = "Markdown"
+	m.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Kembali", "cancel"),
+		),
+	)
+	sendAndTrack(bot, m)
+}
+
+// createUserOnAll creates the account on every server except skip and
+// shows the card from the first server that succeeded with a per-server
+// summary.
+func createUserOnAll(bot *tgbotapi.BotAPI, chatID int64, username string, days int, skip []string) {
+	sendStyledMessage(bot, chatID, "🌐 *MEMBUAT AKUN DI SEMUA SERVER...*")
+	res, err := localApiCall("POST", "/cluster/user/create", map[string]interface{}{
+		"password": username,
+		"days":     days,
+		"skip":     skip,
+	})
+	if err != nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT AKUN*\nError: "+err.Error())
+		return
+	}
+	results := nodeResults(res["data"])
+	if len(results) == 0 {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT AKUN*: "+fmt.Sprintf("%v", res["message"]))
+		return
+	}
+
+	var status strings.Builder
+	var card map[string]interface{}
+	for _, nr := range results {
+		if ok, _ := nr["success"].(bool); ok {
+			d, _ := nr["data"].(map[string]interface{})
+			if domain, ok := d["domain"].(string); ok && domain != "" {
+				status.WriteString(fmt.Sprintf("🟢 `%v` → `%s`\n", nr["node"], domain))
+			} else {
+				status.WriteString(fmt.Sprintf("🟢 `%v`\n", nr["node"]))
+			}
+			if card == nil && d["expired"] != nil {
+				card = d
+			}
+		} else {
+			status.WriteString(fmt.Sprintf("🔴 `%v`: %v\n", nr["node"], nr["message"]))
+		}
+	}
+	status.WriteString("\n_" + fmt.Sprintf("%v", res["message"]) + "_")
+
+	deleteLastMessage(bot, chatID)
+	if card == nil {
+		sendStyledMessage(bot, chatID, "❌ *GAGAL MEMBUAT AKUN*\n━━━━━━━━━━━━━━━━━━━━\n"+status.String())
+		return
+	}
+	msg := tgbotapi.NewMessage(chatID, accountCard("✅ *AKUN DIBUAT DI SEMUA SERVER*", card, "🖥 **Server**\n"+status.String()+"\n\n", "_Akun yang sama berlaku di semua server di atas._"))
+	msg.ParseMode = "Markdown"
+	bot.Send(msg)
+}